@@ -0,0 +1,128 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Runs a benchmark for each of the camera photos in test/cam
+func benchmarkCamImages(b *testing.B, fn func(b *testing.B, data []byte)) {
+	names, err := filepath.Glob("test/cam/*.jpg")
+	if err != nil || len(names) == 0 {
+		b.Fatal("no images in test/cam")
+	}
+	logOutput = io.Discard
+	defer func() { logOutput = os.Stdout }()
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			b.Fatal(err)
+		}
+		b.Run(filepath.Base(name), func(b *testing.B) {
+			fn(b, data)
+		})
+	}
+}
+
+func benchmarkDecode(b *testing.B, data []byte, options *Options) *Header {
+	header, err := decodeJPEGSafe(bytes.NewReader(data), "bench.jpg", options)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return header
+}
+
+// Benchmarks a stage of the pipeline on all block rows, the stages before it run once
+// and their output is restored before every run of the stage
+func benchmarkStage(b *testing.B, before []func(*Header, int, int), stage func(*Header, int, int)) {
+	benchmarkCamImages(b, func(b *testing.B, data []byte) {
+		header := benchmarkDecode(b, data, &Options{coefficientsOnly: true})
+		for _, fn := range before {
+			fn(header, 0, header.blockHeightReal)
+		}
+		planes := make([][][64]int16, len(header.planes))
+		for c := range planes {
+			planes[c] = append([][64]int16{}, header.planes[c].blocks...)
+		}
+		header.image = newImage(header.width, header.height)
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			b.StopTimer()
+			for c := range planes {
+				copy(header.planes[c].blocks, planes[c])
+			}
+			b.StartTimer()
+			stage(header, 0, header.blockHeightReal)
+		}
+	})
+}
+
+// The marker segments up to the first scan
+func BenchmarkMarkers(b *testing.B) {
+	benchmarkCamImages(b, func(b *testing.B, data []byte) {
+		for n := 0; n < b.N; n++ {
+			benchmarkDecode(b, data, &Options{metadataOnly: true})
+		}
+	})
+}
+
+// The marker segments and the entropy decoding of the scans
+func BenchmarkHuffman(b *testing.B) {
+	benchmarkCamImages(b, func(b *testing.B, data []byte) {
+		b.SetBytes(int64(len(data)))
+		for n := 0; n < b.N; n++ {
+			benchmarkDecode(b, data, &Options{coefficientsOnly: true})
+		}
+	})
+}
+
+func BenchmarkDequantize(b *testing.B) {
+	benchmarkStage(b, nil, dequantize)
+}
+
+func BenchmarkInverseDCT(b *testing.B) {
+	benchmarkStage(b, []func(*Header, int, int){dequantize}, inverseDCT)
+}
+
+// Spreads the chrominance and converts to RGB into the image
+func BenchmarkConvertColorSpace(b *testing.B) {
+	benchmarkStage(b, []func(*Header, int, int){dequantize, inverseDCT}, func(header *Header, start int, end int) {
+		convertColorSpace(header, header.image, 0, 0)
+	})
+}
+
+// The whole decode with a Decoder that reuses the memory of the decode before
+func BenchmarkDecoder(b *testing.B) {
+	benchmarkCamImages(b, func(b *testing.B, data []byte) {
+		b.SetBytes(int64(len(data)))
+		decoder := newDecoder(&Options{})
+		for n := 0; n < b.N; n++ {
+			if _, err := decoder.decode(bytes.NewReader(data), "bench.jpg"); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkWriteBitMap(b *testing.B) {
+	benchmarkCamImages(b, func(b *testing.B, data []byte) {
+		header := benchmarkDecode(b, data, &Options{})
+		b.ResetTimer()
+		for n := 0; n < b.N; n++ {
+			encodeBitMap(io.Discard, header.image, Density{})
+		}
+	})
+}
+
+// The whole decoder
+func BenchmarkDecode(b *testing.B) {
+	benchmarkCamImages(b, func(b *testing.B, data []byte) {
+		b.SetBytes(int64(len(data)))
+		for n := 0; n < b.N; n++ {
+			benchmarkDecode(b, data, &Options{})
+		}
+	})
+}
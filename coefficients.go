@@ -0,0 +1,248 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// The JSON form of the coefficients of an image, the blocks and tables are in natural order
+type CoefficientsJSON struct {
+	Width              int                     `json:"width"`
+	Height             int                     `json:"height"`
+	QuantizationTables []QuantizationTableJSON `json:"quantizationTables"`
+	Components         []ComponentJSON         `json:"components"`
+}
+
+type QuantizationTableJSON struct {
+	Id    int        `json:"id"`
+	Table [64]uint16 `json:"table"`
+}
+
+type ComponentJSON struct {
+	Id                int       `json:"id"`
+	HSamplingFactor   int       `json:"hSamplingFactor"`
+	VSamplingFactor   int       `json:"vSamplingFactor"`
+	QuantizationTable int       `json:"quantizationTable"`
+	BlocksWide        int       `json:"blocksWide"`
+	BlocksHigh        int       `json:"blocksHigh"`
+	Blocks            [][64]int `json:"blocks"`
+}
+
+// Returns the quantized coefficients of an image decoded with options.coefficientsOnly
+func readCoefficients(header *Header) *Coefficients {
+	coeffs := &Coefficients{
+		width:   header.width,
+		height:  header.height,
+		qTables: append([]QuantizationTable{}, header.qTables...),
+	}
+	for c := range header.cComponents {
+		comp := &header.cComponents[c]
+		plane := CoefficientPlane{
+			Id:              comp.Id,
+			hSamplingFactor: comp.hSamplingFactor,
+			vSamplingFactor: comp.vSamplingFactor,
+			qTableId:        coefficientTable(coeffs, comp),
+			blocksWide:      header.planes[c].blocksWide,
+			blocksHigh:      header.planes[c].blocksHigh,
+		}
+		plane.blocks = make([][64]int, len(header.planes[c].blocks))
+		for b, block := range header.planes[c].blocks {
+			for a := 0; a < 64; a++ {
+				plane.blocks[b][a] = int(block[a])
+			}
+		}
+		coeffs.planes = append(coeffs.planes, plane)
+	}
+	return coeffs
+}
+
+// Returns the id of the table the component latched in the tables of coeffs. A table that was
+// redefined after the first scan of the component is added again with an id that is free.
+func coefficientTable(coeffs *Coefficients, comp *ColorComponent) int {
+	if comp.qTable == nil {
+		return comp.qTableId
+	}
+	for t := range coeffs.qTables {
+		if coeffs.qTables[t].Id == comp.qTableId && coeffs.qTables[t].table == comp.qTable.table {
+			return comp.qTableId
+		}
+	}
+	free := -1
+	for id := 3; id >= 0; id-- {
+		found := false
+		for t := range coeffs.qTables {
+			if coeffs.qTables[t].Id == id {
+				found = true
+				if coeffs.qTables[t].table == comp.qTable.table {
+					return id
+				}
+			}
+		}
+		if !found {
+			free = id
+		}
+	}
+	if free == -1 {
+		// The four ids are in use, the table of the component replaces its id
+		for t := range coeffs.qTables {
+			if coeffs.qTables[t].Id == comp.qTableId {
+				coeffs.qTables[t].table = comp.qTable.table
+			}
+		}
+		return comp.qTableId
+	}
+	coeffs.qTables = append(coeffs.qTables, QuantizationTable{Id: free, table: comp.qTable.table})
+	return free
+}
+
+// Decodes the quantized DCT coefficients of a JPEG without dequantizing them,
+// like libjpeg's jpeg_read_coefficients. The header holds the markers of the file.
+func decodeCoefficients(filename string) (*Header, *Coefficients) {
+	header := decodeJPEG(filename, &Options{coefficientsOnly: true})
+	return header, readCoefficients(header)
+}
+
+// Returns a block of a plane
+func (coeffs *Coefficients) block(p int, x int, y int) *[64]int {
+	plane := &coeffs.planes[p]
+	return &plane.blocks[x+y*plane.blocksWide]
+}
+
+// Returns the quantization table of a plane
+func (coeffs *Coefficients) quantizationTable(p int) *QuantizationTable {
+	for t := range coeffs.qTables {
+		if coeffs.qTables[t].Id == coeffs.planes[p].qTableId {
+			return &coeffs.qTables[t]
+		}
+	}
+	return nil
+}
+
+// Checks that the coefficients can be written, modified coefficients have to stay in
+// the range of 8-bit JPEGs (ITU T.81 F.1.2) and the planes have to cover whole MCUs.
+func (coeffs *Coefficients) validate() error {
+	if coeffs.width <= 0 || coeffs.height <= 0 || coeffs.width > 0xFFFF || coeffs.height > 0xFFFF {
+		return fmt.Errorf("invalid image size %dx%d", coeffs.width, coeffs.height)
+	}
+	if len(coeffs.planes) != 1 && len(coeffs.planes) != 3 {
+		return fmt.Errorf("%d components, expected 1 or 3", len(coeffs.planes))
+	}
+	for t := range coeffs.qTables {
+		if coeffs.qTables[t].Id < 0 || coeffs.qTables[t].Id > 3 {
+			return fmt.Errorf("invalid quantization table id %d", coeffs.qTables[t].Id)
+		}
+		for a := 0; a < 64; a++ {
+			if coeffs.qTables[t].table[a] == 0 || coeffs.qTables[t].table[a] > 255 {
+				return fmt.Errorf("quantization table %d has the value %d", coeffs.qTables[t].Id, coeffs.qTables[t].table[a])
+			}
+		}
+	}
+	hMax := coeffs.planes[0].hSamplingFactor
+	vMax := coeffs.planes[0].vSamplingFactor
+	mcusX := (coeffs.width + 8*hMax - 1) / (8 * hMax)
+	mcusY := (coeffs.height + 8*vMax - 1) / (8 * vMax)
+	for p := range coeffs.planes {
+		plane := &coeffs.planes[p]
+		if plane.hSamplingFactor < 1 || plane.vSamplingFactor < 1 || plane.hSamplingFactor > hMax || plane.vSamplingFactor > vMax {
+			return fmt.Errorf("component %d has the sampling factors %dx%d", plane.Id, plane.hSamplingFactor, plane.vSamplingFactor)
+		}
+		if plane.blocksWide != mcusX*plane.hSamplingFactor || plane.blocksHigh != mcusY*plane.vSamplingFactor || len(plane.blocks) != plane.blocksWide*plane.blocksHigh {
+			return fmt.Errorf("component %d has %dx%d blocks, expected %dx%d", plane.Id, plane.blocksWide, plane.blocksHigh, mcusX*plane.hSamplingFactor, mcusY*plane.vSamplingFactor)
+		}
+		if coeffs.quantizationTable(p) == nil {
+			return fmt.Errorf("component %d uses the missing quantization table %d", plane.Id, plane.qTableId)
+		}
+		for b := range plane.blocks {
+			if plane.blocks[b][0] < -1024 || plane.blocks[b][0] > 1023 {
+				return fmt.Errorf("component %d block %d has the DC coefficient %d", plane.Id, b, plane.blocks[b][0])
+			}
+			for a := 1; a < 64; a++ {
+				if plane.blocks[b][a] < -1023 || plane.blocks[b][a] > 1023 {
+					return fmt.Errorf("component %d block %d has the AC coefficient %d", plane.Id, b, plane.blocks[b][a])
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Writes a JPEG from quantized coefficients, like libjpeg's jpeg_write_coefficients.
+// The options select baseline or progressive coding and optimized Huffman tables.
+func writeCoefficients(w io.Writer, coeffs *Coefficients, options *EncodeOptions) {
+	if err := coeffs.validate(); err != nil {
+		fmt.Printf("Error! Invalid coefficients: %s\n", err.Error())
+		os.Exit(1)
+	}
+	if options.progressive {
+		writeProgressive(w, coeffs, options)
+		return
+	}
+	writeBaseline(w, coeffs, options)
+}
+
+func (coeffs *Coefficients) toJSON() *CoefficientsJSON {
+	res := &CoefficientsJSON{Width: coeffs.width, Height: coeffs.height}
+	for t := range coeffs.qTables {
+		res.QuantizationTables = append(res.QuantizationTables, QuantizationTableJSON{Id: coeffs.qTables[t].Id, Table: coeffs.qTables[t].table})
+	}
+	for p := range coeffs.planes {
+		plane := &coeffs.planes[p]
+		res.Components = append(res.Components, ComponentJSON{
+			Id:                plane.Id,
+			HSamplingFactor:   plane.hSamplingFactor,
+			VSamplingFactor:   plane.vSamplingFactor,
+			QuantizationTable: plane.qTableId,
+			BlocksWide:        plane.blocksWide,
+			BlocksHigh:        plane.blocksHigh,
+			Blocks:            plane.blocks,
+		})
+	}
+	return res
+}
+
+func (data *CoefficientsJSON) coefficients() *Coefficients {
+	coeffs := &Coefficients{width: data.Width, height: data.Height}
+	for _, table := range data.QuantizationTables {
+		coeffs.qTables = append(coeffs.qTables, QuantizationTable{Id: table.Id, table: table.Table})
+	}
+	for _, comp := range data.Components {
+		coeffs.planes = append(coeffs.planes, CoefficientPlane{
+			Id:              comp.Id,
+			hSamplingFactor: comp.HSamplingFactor,
+			vSamplingFactor: comp.VSamplingFactor,
+			qTableId:        comp.QuantizationTable,
+			blocksWide:      comp.BlocksWide,
+			blocksHigh:      comp.BlocksHigh,
+			blocks:          comp.Blocks,
+		})
+	}
+	return coeffs
+}
+
+func printCoefficients(coeffs *Coefficients) {
+	fmt.Printf("%dx%d, %d components\n", coeffs.width, coeffs.height, len(coeffs.planes))
+	for p := range coeffs.planes {
+		plane := &coeffs.planes[p]
+		nonZero := 0
+		for b := range plane.blocks {
+			for a := 0; a < 64; a++ {
+				if plane.blocks[b][a] != 0 {
+					nonZero++
+				}
+			}
+		}
+		fmt.Printf("  Component %d: sampling %dx%d, quantization table %d, %dx%d blocks, %d non-zero coefficients\n",
+			plane.Id, plane.hSamplingFactor, plane.vSamplingFactor, plane.qTableId, plane.blocksWide, plane.blocksHigh, nonZero)
+	}
+	for t := range coeffs.qTables {
+		fmt.Printf("  Quantization table %d:\n", coeffs.qTables[t].Id)
+		for y := 0; y < 8; y++ {
+			fmt.Printf("   ")
+			for x := 0; x < 8; x++ {
+				fmt.Printf(" %3d", coeffs.qTables[t].table[x+y*8])
+			}
+			fmt.Printf("\n")
+		}
+	}
+}
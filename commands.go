@@ -0,0 +1,520 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// dec info [--json] image.jpg ...
+func infoCommand(args []string) {
+	flags := flag.NewFlagSet("info", flag.ExitOnError)
+	asJSON := flags.Bool("json", false, "print the metadata as JSON")
+	verbose := flags.Bool("v", false, "print the progress of the parser")
+	flags.Parse(args)
+	if flags.NArg() < 1 {
+		fmt.Printf("Error! No file given\n")
+		os.Exit(1)
+	}
+	if !*verbose {
+		logOutput = io.Discard
+	}
+	options := &Options{metadataOnly: true}
+	all := []*Metadata{}
+	for _, filename := range flags.Args() {
+		header := decodeJPEG(filename, options)
+		meta := collectMetadata(header)
+		meta.Filename = filename
+		all = append(all, meta)
+	}
+	if !*asJSON {
+		for m := range all {
+			printMetadata(all[m])
+		}
+		return
+	}
+	encoder := json.NewEncoder(os.Stdout)
+	encoder.SetIndent("", "  ")
+	var err error
+	if len(all) == 1 {
+		err = encoder.Encode(all[0])
+	} else {
+		err = encoder.Encode(all)
+	}
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// dec mpf [-index n [-raw]] image.jpg
+func mpfCommand(args []string) {
+	flags := flag.NewFlagSet("mpf", flag.ExitOnError)
+	index := flags.Int("index", -1, "decode the image with this index")
+	raw := flags.Bool("raw", false, "write the embedded JPEG as is instead of decoding it")
+	format := flags.String("format", "bmp", "output format: bmp, png, ppm or tiff")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Printf("Error! Expected a single file\n")
+		os.Exit(1)
+	}
+	logOutput = io.Discard
+	header := decodeJPEG(flags.Arg(0), &Options{metadataOnly: true})
+	if header.mpf == nil {
+		fmt.Printf("Error! %s has no MPF index\n", flags.Arg(0))
+		os.Exit(1)
+	}
+	if *index < 0 {
+		fmt.Printf("MPF version %s, %d images\n", header.mpf.version, len(header.mpf.entries))
+		for e := range header.mpf.entries {
+			entry := &header.mpf.entries[e]
+			fmt.Printf("  %d: %-28s %9d bytes at offset %d\n", e, entry.typeName(), entry.size, header.mpf.imageOffset(e))
+		}
+		return
+	}
+	suffix := fmt.Sprintf("-mpf%d", *index)
+	if *raw {
+		filename := outputFilename(header, suffix, "jpg")
+		f, err := os.Create(filename)
+		if err != nil {
+			fmt.Printf("Error! %s\n", err.Error())
+			os.Exit(1)
+		}
+		extractMPFImage(header, *index, f)
+		f.Close()
+		fmt.Printf("Wrote %s\n", filename)
+		return
+	}
+	logOutput = os.Stdout
+	image := decodeMPFImage(header, *index, &Options{format: *format})
+	writeImage(image, image.image, suffix)
+}
+
+// dec encode [-quality q] [-sampling 444|422|440|420] [-o out.jpg] image.jpg
+func encodeCommand(args []string) {
+	flags := flag.NewFlagSet("encode", flag.ExitOnError)
+	encodeOptions := &EncodeOptions{}
+	flags.IntVar(&encodeOptions.quality, "quality", 75, "quality (1-100) used to scale the standard quantization tables")
+	flags.StringVar(&encodeOptions.sampling, "sampling", "420", "chroma subsampling: 444, 422, 440 or 420")
+	output := flags.String("o", "", "the output file, defaults to <name>-encoded.jpg")
+	orient := flags.Bool("orient", false, "apply the EXIF orientation before encoding")
+	flags.BoolVar(&encodeOptions.progressive, "progressive", false, "write a progressive JPEG")
+	flags.BoolVar(&encodeOptions.optimize, "optimize", false, "build optimal Huffman tables instead of using the standard tables")
+	scans := flags.String("scans", "", "a file with the scan script of a progressive JPEG")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Printf("Error! Expected a single file\n")
+		os.Exit(1)
+	}
+	if *scans != "" {
+		script, err := os.ReadFile(*scans)
+		if err != nil {
+			fmt.Printf("Error! %s\n", err.Error())
+			os.Exit(1)
+		}
+		encodeOptions.scans, err = parseScanScript(string(script))
+		if err != nil {
+			fmt.Printf("Error! Invalid scan script: %s\n", err.Error())
+			os.Exit(1)
+		}
+		encodeOptions.progressive = true
+	}
+	logOutput = io.Discard
+	header := decodeJPEG(flags.Arg(0), &Options{autoOrient: *orient})
+	encodeOptions.density = imageDensity(header)
+	filename := *output
+	if filename == "" {
+		filename = outputFilename(header, "-encoded", "jpg")
+	}
+	logOutput = os.Stdout
+	writeJPEG(filename, header.image, encodeOptions)
+}
+
+// Writes coefficients read from a file together with the metadata segments of the file.
+// Progressive files stay progressive. Returns the size of the written file.
+func writeLossless(filename string, header *Header, coeffs *Coefficients, encodeOptions *EncodeOptions) int64 {
+	encodeOptions.progressive = encodeOptions.progressive || header.frameType == SOF2
+	encodeOptions.density = imageDensity(header)
+	for _, segment := range header.segments {
+		// The MP index points at images after the end of the file which are not copied
+		if segment.marker == APP2 && bytes.HasPrefix(segment.data, mpfIdentifier) {
+			continue
+		}
+		encodeOptions.segments = append(encodeOptions.segments, segment)
+	}
+	f, err := os.Create(filename)
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	logf("Writing jpeg to %s ... \n", filename)
+	writeCoefficients(f, coeffs, encodeOptions)
+	stat, err := f.Stat()
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	f.Close()
+	return stat.Size()
+}
+
+// dec optimize [-progressive] [-o out.jpg] image.jpg
+// Losslessly re-codes a JPEG with Huffman tables built for its coefficients
+func optimizeCommand(args []string) {
+	flags := flag.NewFlagSet("optimize", flag.ExitOnError)
+	output := flags.String("o", "", "the output file, defaults to <name>-optimized.jpg")
+	progressive := flags.Bool("progressive", false, "write a progressive JPEG even if the input is baseline")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Printf("Error! Expected a single file\n")
+		os.Exit(1)
+	}
+	logOutput = io.Discard
+	header, coeffs := decodeCoefficients(flags.Arg(0))
+	filename := *output
+	if filename == "" {
+		filename = outputFilename(header, "-optimized", "jpg")
+	}
+	logOutput = os.Stdout
+	size := writeLossless(filename, header, coeffs, &EncodeOptions{optimize: true, progressive: *progressive})
+	logf("%d -> %d bytes\n", header.filesize, size)
+}
+
+// dec coeffs [-json out.json] image.jpg
+// dec coeffs -load in.json [-progressive] [-optimize] -o out.jpg
+func coeffsCommand(args []string) {
+	flags := flag.NewFlagSet("coeffs", flag.ExitOnError)
+	dump := flags.String("json", "", "write the quantized coefficients and quantization tables as JSON")
+	load := flags.String("load", "", "write a JPEG from coefficients in JSON")
+	output := flags.String("o", "", "the JPEG written with -load")
+	encodeOptions := &EncodeOptions{}
+	flags.BoolVar(&encodeOptions.progressive, "progressive", false, "write a progressive JPEG with -load")
+	flags.BoolVar(&encodeOptions.optimize, "optimize", false, "build optimal Huffman tables with -load")
+	flags.Parse(args)
+	if *load != "" {
+		if *output == "" {
+			fmt.Printf("Error! -load needs an output file (-o)\n")
+			os.Exit(1)
+		}
+		data, err := os.ReadFile(*load)
+		if err != nil {
+			fmt.Printf("Error! %s\n", err.Error())
+			os.Exit(1)
+		}
+		coeffsJSON := &CoefficientsJSON{}
+		if err := json.Unmarshal(data, coeffsJSON); err != nil {
+			fmt.Printf("Error! %s\n", err.Error())
+			os.Exit(1)
+		}
+		f, err := os.Create(*output)
+		if err != nil {
+			fmt.Printf("Error! %s\n", err.Error())
+			os.Exit(1)
+		}
+		writeCoefficients(f, coeffsJSON.coefficients(), encodeOptions)
+		f.Close()
+		fmt.Printf("Wrote %s\n", *output)
+		return
+	}
+	if flags.NArg() != 1 {
+		fmt.Printf("Error! Expected a single file\n")
+		os.Exit(1)
+	}
+	logOutput = io.Discard
+	_, coeffs := decodeCoefficients(flags.Arg(0))
+	if *dump == "" {
+		printCoefficients(coeffs)
+		return
+	}
+	f, err := os.Create(*dump)
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	w := bufio.NewWriter(f)
+	if err := json.NewEncoder(w).Encode(coeffs.toJSON()); err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	f.Close()
+	fmt.Printf("Wrote %s\n", *dump)
+}
+
+// dec transform -op rot90 [-trim] [-o out.jpg] image.jpg
+func transformCommand(args []string) {
+	flags := flag.NewFlagSet("transform", flag.ExitOnError)
+	op := flags.String("op", "", "the transform: "+strings.Join(transformNames(), ", ")+" or auto to undo the EXIF orientation")
+	trim := flags.Bool("trim", false, "drop the partial iMCUs at the edges instead of leaving them untransformed")
+	output := flags.String("o", "", "the output file, defaults to <name>-<op>.jpg")
+	encodeOptions := &EncodeOptions{}
+	flags.BoolVar(&encodeOptions.progressive, "progressive", false, "write a progressive JPEG even if the input is baseline")
+	flags.BoolVar(&encodeOptions.optimize, "optimize", false, "build optimal Huffman tables")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Printf("Error! Expected a single file\n")
+		os.Exit(1)
+	}
+	logOutput = io.Discard
+	header, coeffs := decodeCoefficients(flags.Arg(0))
+	name := *op
+	if name == "auto" {
+		name = ""
+		if header.exif != nil {
+			name = orientationTransforms[header.exif.orientation()]
+			// The copied EXIF segment must not rotate the image a second time
+			header.exif.resetOrientation()
+		}
+	}
+	if name != "" {
+		var err error
+		coeffs, err = transformCoefficients(coeffs, name, *trim)
+		if err != nil {
+			fmt.Printf("Error! %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	filename := *output
+	if filename == "" {
+		filename = outputFilename(header, "-"+*op, "jpg")
+	}
+	logOutput = os.Stdout
+	writeLossless(filename, header, coeffs, encodeOptions)
+}
+
+// dec crop -region WxH+X+Y [-o out.jpg] image.jpg
+func cropCommand(args []string) {
+	flags := flag.NewFlagSet("crop", flag.ExitOnError)
+	region := flags.String("region", "", "the region to keep as WxH+X+Y, the origin is moved up and left to the iMCU grid")
+	output := flags.String("o", "", "the output file, defaults to <name>-crop.jpg")
+	encodeOptions := &EncodeOptions{}
+	flags.BoolVar(&encodeOptions.progressive, "progressive", false, "write a progressive JPEG even if the input is baseline")
+	flags.BoolVar(&encodeOptions.optimize, "optimize", false, "build optimal Huffman tables")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Printf("Error! Expected a single file\n")
+		os.Exit(1)
+	}
+	var width, height, x, y int
+	if _, err := fmt.Sscanf(*region, "%dx%d+%d+%d", &width, &height, &x, &y); err != nil {
+		fmt.Printf("Error! Invalid region (%s), expected WxH+X+Y\n", *region)
+		os.Exit(1)
+	}
+	logOutput = io.Discard
+	header, coeffs := decodeCoefficients(flags.Arg(0))
+	coeffs, err := cropImage(coeffs, x, y, width, height)
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	filename := *output
+	if filename == "" {
+		filename = outputFilename(header, "-crop", "jpg")
+	}
+	logOutput = os.Stdout
+	logf("Cropped to %dx%d\n", coeffs.width, coeffs.height)
+	writeLossless(filename, header, coeffs, encodeOptions)
+}
+
+// dec edit [-list] [-strip exif,xmp,...] [-strip-gps] [-comment text] [-insert app1=file] [-replace app2=file] [-order jfif,exif] [-o out.jpg] image.jpg
+func editCommand(args []string) {
+	flags := flag.NewFlagSet("edit", flag.ExitOnError)
+	list := flags.Bool("list", false, "list the marker segments")
+	strip := flags.String("strip", "", "comma separated segments to drop: all, app, appN, com, jfif, jfxx, exif, xmp, icc, mpf or photoshop")
+	order := flags.String("order", "", "comma separated segments to move to the front, in this order")
+	output := flags.String("o", "", "the output file, defaults to <name>-edited.jpg")
+	editor := &Editor{}
+	flags.BoolVar(&editor.stripGPS, "strip-gps", false, "remove the GPS tags from the EXIF data")
+	flags.Func("comment", "add a COM segment with the text", func(text string) error {
+		editor.insert = append(editor.insert, Segment{marker: COM, data: []byte(text)})
+		return nil
+	})
+	// MARKER=FILE, the payload of the segment is read from the file
+	segmentFromFile := func(value string) (Segment, error) {
+		parts := strings.SplitN(value, "=", 2)
+		if len(parts) != 2 {
+			return Segment{}, fmt.Errorf("expected MARKER=FILE")
+		}
+		marker, err := parseSegmentMarker(parts[0])
+		if err != nil {
+			return Segment{}, err
+		}
+		data, err := os.ReadFile(parts[1])
+		return Segment{marker: marker, data: data}, err
+	}
+	flags.Func("insert", "add a segment as MARKER=FILE, like app1=exif.bin", func(value string) error {
+		segment, err := segmentFromFile(value)
+		editor.insert = append(editor.insert, segment)
+		return err
+	})
+	flags.Func("replace", "replace the segments with the same marker and identifier as MARKER=FILE", func(value string) error {
+		segment, err := segmentFromFile(value)
+		editor.replace = append(editor.replace, segment)
+		return err
+	})
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Printf("Error! Expected a single file\n")
+		os.Exit(1)
+	}
+	if *strip != "" {
+		editor.strip = strings.Split(strings.ToLower(*strip), ",")
+	}
+	if *order != "" {
+		editor.order = strings.Split(strings.ToLower(*order), ",")
+	}
+	in, err := os.Open(flags.Arg(0))
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer in.Close()
+	if *list {
+		if err := listSegments(in); err != nil {
+			fmt.Printf("Error! %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	}
+	filename := *output
+	if filename == "" {
+		filename = outputFilename(&Header{filename: flags.Arg(0)}, "-edited", "jpg")
+	}
+	// The output may be the input, it is written to a temporary file in the same directory
+	// that only replaces it once the edit succeeded
+	out, err := os.CreateTemp(filepath.Dir(filename), "."+filepath.Base(filename)+".*")
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	// A temporary file is only readable by its owner, the output gets the mode of the input
+	if stat, err := in.Stat(); err == nil {
+		out.Chmod(stat.Mode().Perm())
+	}
+	logf("Writing jpeg to %s ... \n", filename)
+	err = editJPEG(in, out, editor)
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err == nil {
+		err = os.Rename(out.Name(), filename)
+	}
+	if err != nil {
+		os.Remove(out.Name())
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// dec stream [-chunk n] [-format f] [-tolerant] image.jpg
+// Decodes an image (or stdin with -) in chunks as if it arrived over a socket
+func streamCommand(args []string) {
+	flags := flag.NewFlagSet("stream", flag.ExitOnError)
+	chunkSize := flags.Int("chunk", 4096, "the number of bytes written to the decoder at a time")
+	format := flags.String("format", "bmp", "output format: bmp, png, ppm, tiff or jpg")
+	tolerant := flags.Bool("tolerant", false, "decode truncated and corrupt data as far as possible")
+	limits := Limits{}
+	limitFlags(flags, &limits)
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Printf("Error! Expected a single file\n")
+		os.Exit(1)
+	}
+	if *chunkSize <= 0 {
+		fmt.Printf("Error! Invalid chunk size (%d)\n", *chunkSize)
+		os.Exit(1)
+	}
+	var r io.Reader = os.Stdin
+	filename := "stdin.jpg"
+	if flags.Arg(0) != "-" {
+		f, err := os.Open(flags.Arg(0))
+		if err != nil {
+			fmt.Printf("Error! %s\n", err.Error())
+			os.Exit(1)
+		}
+		defer f.Close()
+		r = f
+		filename = flags.Arg(0)
+	}
+	logOutput = io.Discard
+	decoder := newStreamDecoder(filename, &Options{format: *format, tolerant: *tolerant, limits: limits})
+	chunk := make([]byte, *chunkSize)
+	total := 0
+	for {
+		n, err := r.Read(chunk)
+		if n > 0 {
+			if _, err := decoder.Write(chunk[:n]); err != nil {
+				fmt.Printf("Error! %s\n", err.Error())
+				os.Exit(1)
+			}
+			total += n
+			fmt.Printf("%d bytes: %d rows\n", total, decoder.Rows())
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Printf("Error! %s\n", err.Error())
+			os.Exit(1)
+		}
+	}
+	if err := decoder.Flush(); err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	for _, warning := range decoder.Header().warnings {
+		fmt.Printf("Warning! %s\n", warning)
+	}
+	logOutput = os.Stdout
+	writeImage(decoder.Header(), decoder.Image(), "-stream")
+}
+
+// dec index [-o image.jpg.idx] image.jpg
+// Writes the restart index of a baseline image to a sidecar file for -index
+func indexCommand(args []string) {
+	flags := flag.NewFlagSet("index", flag.ExitOnError)
+	output := flags.String("o", "", "the output file, defaults to <name>.idx")
+	flags.Parse(args)
+	if flags.NArg() != 1 {
+		fmt.Printf("Error! Expected a single file\n")
+		os.Exit(1)
+	}
+	filename := flags.Arg(0)
+	if *output == "" {
+		*output = filename + ".idx"
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer file.Close()
+	stat, _ := file.Stat()
+	logOutput = io.Discard
+	index, err := buildIndex(file, stat.Size(), filename, &Options{})
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	out, err := os.Create(*output)
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	if err := writeIndex(out, index); err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	out.Close()
+	logOutput = os.Stdout
+	logf("Wrote %d entries (restart interval %d) to %s\n", len(index.entries), index.interval, *output)
+}
@@ -0,0 +1,101 @@
+package main
+
+import (
+	"bytes"
+	"image"
+	"image/jpeg"
+	"io"
+	"math"
+	"os"
+	"testing"
+)
+
+// The files in test/ with the PSNR (dB) the decoded image must at least have and the largest
+// difference of a channel it may have compared to image/jpeg. The decoders differ in the IDCT
+// and in rounding (the color conversion truncates), so the images are not identical.
+var conformanceFiles = []struct {
+	name     string
+	minPSNR  float64
+	maxError int
+}{
+	// baseline, 1x1, 2x1, 1x2 and 2x2 luma sampling
+	{"test/cat0.jpg", 42, 24},
+	{"test/cat0-h.jpg", 42, 16},
+	{"test/cat0-v.jpg", 42, 16},
+	{"test/cat0-q.jpg", 42, 18},
+	{"test/cat1.jpg", 42, 14},
+	// progressive
+	{"test/p/cat0-h.jpg", 42, 12},
+	{"test/p/cat0-v.jpg", 42, 12},
+	{"test/p/cat0-q.jpg", 42, 12},
+	{"test/p/huey.jpg", 43, 14},
+	// camera photos
+	{"test/cam/20220301_124135.jpg", 43, 12},
+	{"test/cam/20220301_124141.jpg", 43, 12},
+	{"test/cam/20220301_124144.jpg", 42, 12},
+	{"test/cam/IMG-20210925-WA0001.jpg", 43, 10},
+}
+
+// Compares an image to the one image/jpeg decodes, gives the PSNR over the r, g and b
+// channels and the largest difference of a channel
+func compareImage(img *Image, want image.Image) (float64, int) {
+	maxError := 0
+	sum := 0.0
+	bounds := want.Bounds()
+	for y := 0; y < img.height; y++ {
+		for x := 0; x < img.width; x++ {
+			r, g, b, _ := want.At(bounds.Min.X+x, bounds.Min.Y+y).RGBA()
+			i := (x + y*img.width) * 3
+			for c, v := range []uint32{r >> 8, g >> 8, b >> 8} {
+				diff := int(img.pix[i+c]) - int(v)
+				if diff < 0 {
+					diff = -diff
+				}
+				if diff > maxError {
+					maxError = diff
+				}
+				sum += float64(diff * diff)
+			}
+		}
+	}
+	mse := sum / float64(img.width*img.height*3)
+	if mse == 0 {
+		return math.Inf(1), 0
+	}
+	return 10 * math.Log10(255*255/mse), maxError
+}
+
+func TestConformance(t *testing.T) {
+	logOutput = io.Discard
+	defer func() { logOutput = os.Stdout }()
+	for _, file := range conformanceFiles {
+		file := file
+		t.Run(file.name, func(t *testing.T) {
+			data, err := os.ReadFile(file.name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			want, err := jpeg.Decode(bytes.NewReader(data))
+			if err != nil {
+				t.Fatalf("image/jpeg: %v", err)
+			}
+			header, err := decodeJPEGSafe(bytes.NewReader(data), file.name, &Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			img := header.image
+			if img.width != want.Bounds().Dx() || img.height != want.Bounds().Dy() {
+				t.Fatalf("the image is %dx%d, image/jpeg decodes %dx%d",
+					img.width, img.height, want.Bounds().Dx(), want.Bounds().Dy())
+			}
+			psnr, maxError := compareImage(img, want)
+			t.Logf("PSNR %.2f dB, max error %d", psnr, maxError)
+			if psnr < file.minPSNR {
+				t.Errorf("PSNR %.2f dB, expected at least %.2f dB", psnr, file.minPSNR)
+			}
+			if maxError > file.maxError {
+				t.Errorf("max error %d, expected at most %d", maxError, file.maxError)
+			}
+		})
+	}
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+)
+
+// Decodes files one after another and reuses the memory of the blocks and the image of the
+// last decode, so decoding many files doesn't allocate for each of them. The blocks and the
+// image of a header are only valid until the next decode.
+type Decoder struct {
+	options *Options
+	blocks  [][64]int16
+	pix     []byte
+}
+
+func newDecoder(options *Options) *Decoder {
+	return &Decoder{options: options}
+}
+
+// Decodes a JPEG, returns an error instead of exiting like decodeJPEGSafe
+func (d *Decoder) decode(r io.ByteReader, filename string) (header *Header, err error) {
+	header = newHeader(r, filename, d.options)
+	header.decoder = d
+	header.buffer.panics = true
+	defer recoverDecodeError(&err)
+	decodeMarkers(header)
+	return header, nil
+}
+
+// Decodes a JPEG file, errors are printed and exit like in decodeJPEG
+func (d *Decoder) decodeFile(filename string) *Header {
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	stat, _ := file.Stat()
+	_filename, err := filepath.Abs(filename)
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	header := newHeader(bufio.NewReader(file), _filename, d.options)
+	header.decoder = d
+	decodeMarkers(header)
+	header.filesize = uint(stat.Size())
+	file.Close()
+	return header
+}
+
+// Returns n blocks set to 0, they are the blocks of the last decode when it had enough.
+// A nil Decoder allocates them.
+func (d *Decoder) allocBlocks(n int) [][64]int16 {
+	if d == nil {
+		return make([][64]int16, n)
+	}
+	if cap(d.blocks) < n {
+		d.blocks = make([][64]int16, n)
+		return d.blocks
+	}
+	blocks := d.blocks[:n]
+	for a := range blocks {
+		blocks[a] = [64]int16{}
+	}
+	return blocks
+}
+
+// Returns an image that uses the pixels of the image of the last decode when they are enough
+func (d *Decoder) allocImage(width int, height int) *Image {
+	if d == nil {
+		return newImage(width, height)
+	}
+	if cap(d.pix) < width*height*3 {
+		d.pix = make([]byte, width*height*3)
+	}
+	return &Image{width: width, height: height, pix: d.pix[:width*height*3]}
+}
@@ -0,0 +1,451 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"strconv"
+	"strings"
+)
+
+// Changes made to the marker segments of a file without decoding it
+type Editor struct {
+	strip    []string  // Selectors of the APPn and COM segments to drop
+	stripGPS bool      // Remove the GPS tags from the EXIF segment
+	insert   []Segment // Added after the metadata segments at the start of the file
+	replace  []Segment // Replace the segments with the same marker and identifier
+	order    []string  // Selectors of the segments to move to the front, in this order
+}
+
+// Returns the name of a marker
+func markerName(marker byte) string {
+	switch {
+	case marker >= APP0 && marker <= APP15:
+		return fmt.Sprintf("APP%d", marker-APP0)
+	case marker >= RST0 && marker <= RST7:
+		return fmt.Sprintf("RST%d", marker-RST0)
+	case marker == SOF0 || marker == SOF1 || marker == SOF2 || marker == SOF3:
+		return fmt.Sprintf("SOF%d", marker-SOF0)
+	}
+	names := map[byte]string{SOI: "SOI", EOI: "EOI", SOS: "SOS", DQT: "DQT", DHT: "DHT", DRI: "DRI", COM: "COM", DNL: "DNL", DAC: "DAC", TEM: "TEM"}
+	if name, ok := names[marker]; ok {
+		return name
+	}
+	return fmt.Sprintf("0x%02X", marker)
+}
+
+// Returns what a metadata segment holds: jfif, jfxx, exif, xmp, xmp-extension, icc, mpf, photoshop, com or appN
+func segmentKind(segment *Segment) string {
+	kinds := []struct {
+		marker     byte
+		identifier []byte
+		kind       string
+	}{
+		{APP0, jfifIdentifier, "jfif"},
+		{APP0, jfxxIdentifier, "jfxx"},
+		{APP1, exifIdentifier, "exif"},
+		{APP1, xmpIdentifier, "xmp"},
+		{APP1, xmpExtensionIdentifier, "xmp-extension"},
+		{APP2, iccIdentifier, "icc"},
+		{APP2, mpfIdentifier, "mpf"},
+		{APP13, photoshopIdentifier, "photoshop"},
+	}
+	for _, k := range kinds {
+		if segment.marker == k.marker && bytes.HasPrefix(segment.data, k.identifier) {
+			return k.kind
+		}
+	}
+	if segment.marker == COM {
+		return "com"
+	}
+	return strings.ToLower(markerName(segment.marker))
+}
+
+// Checks if a selector matches a segment. Selectors are the kinds of segmentKind,
+// appN for any APPn segment, app for all APPn segments and all for APPn and COM.
+func (segment *Segment) matches(selector string) bool {
+	kind := segmentKind(segment)
+	switch selector {
+	case "all":
+		return true
+	case "app":
+		return segment.marker != COM
+	case "xmp":
+		return kind == "xmp" || kind == "xmp-extension"
+	case strings.ToLower(markerName(segment.marker)):
+		return true
+	}
+	return selector == kind
+}
+
+// Returns the identifier at the start of an APPn payload including the terminating 0
+func segmentIdentifier(data []byte) []byte {
+	i := bytes.IndexByte(data, 0)
+	if i < 0 || i > 64 {
+		return nil
+	}
+	return data[:i+1]
+}
+
+// Parses a MARKER=VALUE argument of the edit command, MARKER is appN or com
+func parseSegmentMarker(name string) (byte, error) {
+	name = strings.ToLower(name)
+	if name == "com" {
+		return COM, nil
+	}
+	if strings.HasPrefix(name, "app") {
+		n, err := strconv.Atoi(name[3:])
+		if err == nil && n >= 0 && n <= 15 {
+			return APP0 + byte(n), nil
+		}
+	}
+	return 0, fmt.Errorf("invalid marker (%s), expected app0-app15 or com", name)
+}
+
+// Removes the GPS tags by emptying the GPS IFD of an EXIF payload in place
+func stripGPS(data []byte) error {
+	order, offset, err := readTiffHeader(data)
+	if err != nil {
+		return err
+	}
+	ifd0, _, err := readIFD(data, order, offset)
+	if err != nil {
+		return err
+	}
+	pointer := findTag(ifd0, tagGPSIFDPointer)
+	if pointer == nil {
+		return nil
+	}
+	gpsOffset := pointer.intValue(0)
+	tags, _, err := readIFD(data, order, uint32(gpsOffset))
+	if err != nil {
+		return err
+	}
+	// Clear the values stored outside of the entries
+	for t := range tags {
+		for a := range tags[t].value {
+			tags[t].value[a] = 0
+		}
+	}
+	// An IFD without entries, the next IFD offset that follows is 0 as well
+	count := int(order.Uint16(data[gpsOffset:]))
+	for a := 0; a < 2+count*12+4; a++ {
+		data[int(gpsOffset)+a] = 0
+	}
+	return nil
+}
+
+// Adds delta to the offsets of the images in an MPF payload and sizeDelta to the size of the first image
+func shiftMPF(data []byte, delta int64, sizeDelta int64) error {
+	order, offset, err := readTiffHeader(data)
+	if err != nil {
+		return err
+	}
+	tags, _, err := readIFD(data, order, offset)
+	if err != nil {
+		return err
+	}
+	entries := findTag(tags, tagMPEntry)
+	if entries == nil {
+		return nil
+	}
+	for e := 0; e+16 <= len(entries.value); e += 16 {
+		// The first image has the offset 0
+		if value := order.Uint32(entries.value[e+8:]); value != 0 {
+			order.PutUint32(entries.value[e+8:], uint32(int64(value)+delta))
+		} else {
+			size := order.Uint32(entries.value[e+4:])
+			order.PutUint32(entries.value[e+4:], uint32(int64(size)+sizeDelta))
+		}
+	}
+	return nil
+}
+
+// Returns the number of bytes of the segments
+func segmentsSize(segments []Segment) int64 {
+	size := int64(0)
+	for s := range segments {
+		size += int64(len(segments[s].data)) + 4
+	}
+	return size
+}
+
+// Returns the number of bytes that follow the MPF segment, -1 if there is none
+func bytesAfterMPF(segments []Segment) int64 {
+	size := int64(-1)
+	for s := range segments {
+		if size >= 0 {
+			size += int64(len(segments[s].data)) + 4
+		}
+		if segmentKind(&segments[s]) == "mpf" {
+			size = 0
+		}
+	}
+	return size
+}
+
+// Applies the changes to the metadata segments at the start of the file
+func (editor *Editor) apply(segments []Segment) ([]Segment, error) {
+	after := bytesAfterMPF(segments)
+	res := []Segment{}
+	for s := range segments {
+		if !editor.drops(&segments[s]) {
+			res = append(res, segments[s])
+		}
+	}
+	for _, replacement := range editor.replace {
+		identifier := segmentIdentifier(replacement.data)
+		replaced := false
+		kept := []Segment{}
+		for s := range res {
+			if res[s].marker == replacement.marker && (replacement.marker == COM || bytes.Equal(segmentIdentifier(res[s].data), identifier)) {
+				// The first matching segment is replaced, the others (like the chunks of an ICC profile) are dropped
+				if !replaced {
+					kept = append(kept, replacement)
+					replaced = true
+				}
+				continue
+			}
+			kept = append(kept, res[s])
+		}
+		if !replaced {
+			kept = append(kept, replacement)
+		}
+		res = kept
+	}
+	res = append(res, editor.insert...)
+	if len(editor.order) > 0 {
+		ordered := []Segment{}
+		used := make([]bool, len(res))
+		for _, selector := range editor.order {
+			for s := range res {
+				if !used[s] && res[s].matches(selector) {
+					ordered = append(ordered, res[s])
+					used[s] = true
+				}
+			}
+		}
+		for s := range res {
+			if !used[s] {
+				ordered = append(ordered, res[s])
+			}
+		}
+		res = ordered
+	}
+	for s := range res {
+		if err := editor.scrub(&res[s]); err != nil {
+			return nil, err
+		}
+	}
+	// The images listed in the MPF index move with the bytes that follow the MPF segment
+	if after >= 0 && bytesAfterMPF(res) >= 0 {
+		delta := bytesAfterMPF(res) - after
+		sizeDelta := segmentsSize(res) - segmentsSize(segments)
+		if delta != 0 || sizeDelta != 0 {
+			for s := range res {
+				if segmentKind(&res[s]) == "mpf" {
+					res[s].data = append([]byte{}, res[s].data...)
+					if err := shiftMPF(res[s].data[len(mpfIdentifier):], delta, sizeDelta); err != nil {
+						return nil, fmt.Errorf("invalid MPF data: %s", err.Error())
+					}
+				}
+			}
+		}
+	}
+	return res, nil
+}
+
+// Applies the changes to the payload of a segment that is kept
+func (editor *Editor) scrub(segment *Segment) error {
+	if len(segment.data)+2 > 0xFFFF {
+		return fmt.Errorf("the %s segment has %d bytes, a segment can have at most 65533", markerName(segment.marker), len(segment.data))
+	}
+	if editor.stripGPS && segmentKind(segment) == "exif" {
+		// Work on a copy, replaced and inserted segments may share their data
+		segment.data = append([]byte{}, segment.data...)
+		if err := stripGPS(segment.data[len(exifIdentifier):]); err != nil {
+			return fmt.Errorf("invalid EXIF data: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+func (editor *Editor) drops(segment *Segment) bool {
+	for _, selector := range editor.strip {
+		if segment.matches(selector) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads the next marker, skipping the fill bytes before it
+func readMarker(r *bufio.Reader) (byte, error) {
+	b, err := r.ReadByte()
+	if err != nil {
+		return 0, err
+	}
+	if b != 0xFF {
+		return 0, fmt.Errorf("expected a marker but found byte (%x)", b)
+	}
+	for b == 0xFF {
+		if b, err = r.ReadByte(); err != nil {
+			return 0, err
+		}
+	}
+	return b, nil
+}
+
+// Reads the payload of a marker segment
+func readSegmentData(r *bufio.Reader, marker byte) ([]byte, error) {
+	length := [2]byte{}
+	if _, err := io.ReadFull(r, length[:]); err != nil {
+		return nil, err
+	}
+	size := int(length[0])<<8 | int(length[1])
+	if size < 2 {
+		return nil, fmt.Errorf("invalid length (%d) of the %s segment", size, markerName(marker))
+	}
+	data := make([]byte, size-2)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// Copies entropy-coded data until the next marker that is not RSTn and returns that marker
+func copyEntropyData(r *bufio.Reader, w *bufio.Writer) (byte, error) {
+	for {
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, err
+		}
+		if b != 0xFF {
+			w.WriteByte(b)
+			continue
+		}
+		next, err := r.ReadByte()
+		for err == nil && next == 0xFF {
+			next, err = r.ReadByte()
+		}
+		if err != nil {
+			return 0, err
+		}
+		// Stuffed zero bytes and restart markers belong to the entropy-coded data
+		if next == 0x00 || (next >= RST0 && next <= RST7) {
+			w.Write([]byte{0xFF, next})
+			continue
+		}
+		return next, nil
+	}
+}
+
+// Copies a JPEG segment by segment applying the changes of the editor to its APPn and COM segments.
+// The entropy-coded data and everything after the end-of-image marker are copied byte for byte.
+func editJPEG(r io.Reader, w io.Writer, editor *Editor) error {
+	br := bufio.NewReader(r)
+	bw := bufio.NewWriter(w)
+	soi := [2]byte{}
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi[0] != 0xFF || soi[1] != SOI {
+		return errors.New("the file is not a valid JPEG")
+	}
+	bw.Write(soi[:])
+	// The APPn and COM segments before the first other segment are collected so they can be reordered
+	metadata := []Segment{}
+	inMetadata := true
+	marker, err := readMarker(br)
+	for {
+		if err != nil {
+			if err == io.EOF {
+				return errors.New("the file ends before the end-of-image marker")
+			}
+			return err
+		}
+		metadataSegment := (marker >= APP0 && marker <= APP15) || marker == COM
+		if inMetadata && !metadataSegment {
+			segments, err := editor.apply(metadata)
+			if err != nil {
+				return err
+			}
+			for s := range segments {
+				writeSegment(bw, segments[s].marker, segments[s].data)
+			}
+			inMetadata = false
+		}
+		if marker == EOI {
+			bw.Write([]byte{0xFF, EOI})
+			// Data after EOI (like the images of an MPF file) is kept
+			if _, err := io.Copy(bw, br); err != nil {
+				return err
+			}
+			return bw.Flush()
+		}
+		// Markers without a payload
+		if marker == TEM || (marker >= RST0 && marker <= RST7) {
+			bw.Write([]byte{0xFF, marker})
+			marker, err = readMarker(br)
+			continue
+		}
+		data, err := readSegmentData(br, marker)
+		if err != nil {
+			return err
+		}
+		segment := Segment{marker: marker, data: data}
+		switch {
+		case inMetadata:
+			metadata = append(metadata, segment)
+		case metadataSegment:
+			if editor.drops(&segment) {
+				break
+			}
+			if err := editor.scrub(&segment); err != nil {
+				return err
+			}
+			writeSegment(bw, marker, segment.data)
+		default:
+			writeSegment(bw, marker, data)
+		}
+		if marker == SOS {
+			marker, err = copyEntropyData(br, bw)
+			continue
+		}
+		marker, err = readMarker(br)
+	}
+}
+
+// Prints the marker segments of a file up to the first Start Of Scan
+func listSegments(r io.Reader) error {
+	br := bufio.NewReader(r)
+	soi := [2]byte{}
+	if _, err := io.ReadFull(br, soi[:]); err != nil || soi[0] != 0xFF || soi[1] != SOI {
+		return errors.New("the file is not a valid JPEG")
+	}
+	offset := int64(2)
+	for {
+		marker, err := readMarker(br)
+		if err != nil {
+			return err
+		}
+		if marker == TEM || (marker >= RST0 && marker <= RST7) || marker == EOI {
+			fmt.Printf("%10d  %-6s\n", offset, markerName(marker))
+			offset += 2
+			continue
+		}
+		data, err := readSegmentData(br, marker)
+		if err != nil {
+			return err
+		}
+		segment := Segment{marker: marker, data: data}
+		kind := ""
+		if (marker >= APP0 && marker <= APP15) || marker == COM {
+			kind = segmentKind(&segment)
+		}
+		fmt.Printf("%10d  %-6s %6d bytes  %s\n", offset, markerName(marker), len(data), kind)
+		offset += int64(len(data)) + 4
+		if marker == SOS {
+			return nil
+		}
+	}
+}
@@ -0,0 +1,597 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"math"
+	"os"
+)
+
+// Options that change how an image is encoded
+type EncodeOptions struct {
+	quality  int     // 1-100, scales the standard quantization tables
+	sampling string  // Chroma subsampling: 444, 422, 440 or 420
+	density  Density // Written to the JFIF segment when known
+	// Writes a progressive JPEG using the scan script, or the default script when it is nil
+	progressive bool
+	scans       []ScanSpec
+	optimize    bool      // Build the Huffman tables from the symbol statistics instead of using the standard tables
+	segments    []Segment // Marker segments copied after the JFIF segment
+}
+
+// The quantized DCT coefficients of a single component
+type CoefficientPlane struct {
+	Id              int
+	hSamplingFactor int
+	vSamplingFactor int
+	qTableId        int
+	blocksWide      int // The number of blocks in a row, padded to whole MCUs
+	blocksHigh      int
+	blocks          [][64]int // The coefficients of each block in natural (not zigzag) order
+}
+
+// The quantized DCT coefficients of an image together with its quantization tables
+type Coefficients struct {
+	width   int
+	height  int
+	planes  []CoefficientPlane
+	qTables []QuantizationTable
+}
+
+// Standard luminance quantization table (ITU T.81 Annex K.1) in natural order
+var stdLuminanceQuantTable = [64]uint16{
+	16, 11, 10, 16, 24, 40, 51, 61,
+	12, 12, 14, 19, 26, 58, 60, 55,
+	14, 13, 16, 24, 40, 57, 69, 56,
+	14, 17, 22, 29, 51, 87, 80, 62,
+	18, 22, 37, 56, 68, 109, 103, 77,
+	24, 35, 55, 64, 81, 104, 113, 92,
+	49, 64, 78, 87, 103, 121, 120, 101,
+	72, 92, 95, 98, 112, 100, 103, 99,
+}
+
+// Standard chrominance quantization table (ITU T.81 Annex K.2) in natural order
+var stdChrominanceQuantTable = [64]uint16{
+	17, 18, 24, 47, 99, 99, 99, 99,
+	18, 21, 26, 66, 99, 99, 99, 99,
+	24, 26, 56, 99, 99, 99, 99, 99,
+	47, 66, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+	99, 99, 99, 99, 99, 99, 99, 99,
+}
+
+// Standard Huffman tables (ITU T.81 Annex K.3)
+var stdDCLuminanceTable = HuffmanTable{
+	Id:         0,
+	dc:         true,
+	codesOfLen: [16]int{0, 1, 5, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0, 0, 0},
+	symbols:    []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+}
+
+var stdDCChrominanceTable = HuffmanTable{
+	Id:         1,
+	dc:         true,
+	codesOfLen: [16]int{0, 3, 1, 1, 1, 1, 1, 1, 1, 1, 1, 0, 0, 0, 0, 0},
+	symbols:    []byte{0, 1, 2, 3, 4, 5, 6, 7, 8, 9, 10, 11},
+}
+
+var stdACLuminanceTable = HuffmanTable{
+	Id:         0,
+	dc:         false,
+	codesOfLen: [16]int{0, 2, 1, 3, 3, 2, 4, 3, 5, 5, 4, 4, 0, 0, 1, 0x7d},
+	symbols: []byte{
+		0x01, 0x02, 0x03, 0x00, 0x04, 0x11, 0x05, 0x12,
+		0x21, 0x31, 0x41, 0x06, 0x13, 0x51, 0x61, 0x07,
+		0x22, 0x71, 0x14, 0x32, 0x81, 0x91, 0xa1, 0x08,
+		0x23, 0x42, 0xb1, 0xc1, 0x15, 0x52, 0xd1, 0xf0,
+		0x24, 0x33, 0x62, 0x72, 0x82, 0x09, 0x0a, 0x16,
+		0x17, 0x18, 0x19, 0x1a, 0x25, 0x26, 0x27, 0x28,
+		0x29, 0x2a, 0x34, 0x35, 0x36, 0x37, 0x38, 0x39,
+		0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48, 0x49,
+		0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58, 0x59,
+		0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68, 0x69,
+		0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78, 0x79,
+		0x7a, 0x83, 0x84, 0x85, 0x86, 0x87, 0x88, 0x89,
+		0x8a, 0x92, 0x93, 0x94, 0x95, 0x96, 0x97, 0x98,
+		0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5, 0xa6, 0xa7,
+		0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4, 0xb5, 0xb6,
+		0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3, 0xc4, 0xc5,
+		0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2, 0xd3, 0xd4,
+		0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda, 0xe1, 0xe2,
+		0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9, 0xea,
+		0xf1, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+		0xf9, 0xfa,
+	},
+}
+
+var stdACChrominanceTable = HuffmanTable{
+	Id:         1,
+	dc:         false,
+	codesOfLen: [16]int{0, 2, 1, 2, 4, 4, 3, 4, 7, 5, 4, 4, 0, 1, 2, 0x77},
+	symbols: []byte{
+		0x00, 0x01, 0x02, 0x03, 0x11, 0x04, 0x05, 0x21,
+		0x31, 0x06, 0x12, 0x41, 0x51, 0x07, 0x61, 0x71,
+		0x13, 0x22, 0x32, 0x81, 0x08, 0x14, 0x42, 0x91,
+		0xa1, 0xb1, 0xc1, 0x09, 0x23, 0x33, 0x52, 0xf0,
+		0x15, 0x62, 0x72, 0xd1, 0x0a, 0x16, 0x24, 0x34,
+		0xe1, 0x25, 0xf1, 0x17, 0x18, 0x19, 0x1a, 0x26,
+		0x27, 0x28, 0x29, 0x2a, 0x35, 0x36, 0x37, 0x38,
+		0x39, 0x3a, 0x43, 0x44, 0x45, 0x46, 0x47, 0x48,
+		0x49, 0x4a, 0x53, 0x54, 0x55, 0x56, 0x57, 0x58,
+		0x59, 0x5a, 0x63, 0x64, 0x65, 0x66, 0x67, 0x68,
+		0x69, 0x6a, 0x73, 0x74, 0x75, 0x76, 0x77, 0x78,
+		0x79, 0x7a, 0x82, 0x83, 0x84, 0x85, 0x86, 0x87,
+		0x88, 0x89, 0x8a, 0x92, 0x93, 0x94, 0x95, 0x96,
+		0x97, 0x98, 0x99, 0x9a, 0xa2, 0xa3, 0xa4, 0xa5,
+		0xa6, 0xa7, 0xa8, 0xa9, 0xaa, 0xb2, 0xb3, 0xb4,
+		0xb5, 0xb6, 0xb7, 0xb8, 0xb9, 0xba, 0xc2, 0xc3,
+		0xc4, 0xc5, 0xc6, 0xc7, 0xc8, 0xc9, 0xca, 0xd2,
+		0xd3, 0xd4, 0xd5, 0xd6, 0xd7, 0xd8, 0xd9, 0xda,
+		0xe2, 0xe3, 0xe4, 0xe5, 0xe6, 0xe7, 0xe8, 0xe9,
+		0xea, 0xf2, 0xf3, 0xf4, 0xf5, 0xf6, 0xf7, 0xf8,
+		0xf9, 0xfa,
+	},
+}
+
+// Writes bits MSB first and stuffs a 0x00 after every 0xFF byte
+type BitWriter struct {
+	w     *bufio.Writer
+	acc   uint32
+	nBits int
+}
+
+func (bw *BitWriter) writeBits(bits int, length int) {
+	for a := length - 1; a >= 0; a-- {
+		bw.acc = (bw.acc << 1) | uint32((bits>>a)&1)
+		bw.nBits++
+		if bw.nBits == 8 {
+			b := byte(bw.acc)
+			bw.w.WriteByte(b)
+			if b == 0xFF {
+				bw.w.WriteByte(0x00)
+			}
+			bw.acc = 0
+			bw.nBits = 0
+		}
+	}
+}
+
+// Pads the last byte with 1 bits
+func (bw *BitWriter) flush() {
+	for bw.nBits != 0 {
+		bw.writeBits(1, 1)
+	}
+}
+
+// The code and the code length of every symbol of a Huffman table
+type HuffmanEncoder struct {
+	code   [256]int
+	length [256]int
+}
+
+func newHuffmanEncoder(tb *HuffmanTable) *HuffmanEncoder {
+	if len(tb.codes) == 0 {
+		generateCodes(tb)
+	}
+	enc := &HuffmanEncoder{}
+	k := 0
+	for a := 0; a < 16; a++ {
+		for c := 0; c < tb.codesOfLen[a]; c++ {
+			enc.code[tb.symbols[k]] = tb.codes[k]
+			enc.length[tb.symbols[k]] = a + 1
+			k++
+		}
+	}
+	return enc
+}
+
+func (enc *HuffmanEncoder) writeSymbol(bw *BitWriter, sym byte) {
+	if enc.length[sym] == 0 {
+		fmt.Printf("Error! Symbol (0x%X) is not in the Huffman table\n", sym)
+		os.Exit(1)
+	}
+	bw.writeBits(enc.code[sym], enc.length[sym])
+}
+
+// Returns the number of bits needed for the magnitude of a coefficient
+func bitLength(coeff int) int {
+	if coeff < 0 {
+		coeff = -coeff
+	}
+	length := 0
+	for coeff > 0 {
+		length++
+		coeff >>= 1
+	}
+	return length
+}
+
+// Returns the bits that are written after the symbol of a coefficient,
+// negative coefficients are written as coeff - 1 (one's complement)
+func coeffBits(coeff int, length int) int {
+	if coeff < 0 {
+		coeff += (1 << length) - 1
+	}
+	return coeff
+}
+
+// Scales a standard quantization table by the quality as done by the IJG
+func scaleQuantTable(table *[64]uint16, quality int) [64]uint16 {
+	if quality < 1 {
+		quality = 1
+	}
+	if quality > 100 {
+		quality = 100
+	}
+	scale := 200 - quality*2
+	if quality < 50 {
+		scale = 5000 / quality
+	}
+	res := [64]uint16{}
+	for a := 0; a < 64; a++ {
+		v := (int(table[a])*scale + 50) / 100
+		if v < 1 {
+			v = 1
+		}
+		if v > 255 {
+			v = 255
+		}
+		res[a] = uint16(v)
+	}
+	return res
+}
+
+// cos((2x+1)u*pi/16) * C(u) / 2
+var dctTable = func() [8][8]float64 {
+	table := [8][8]float64{}
+	for u := 0; u < 8; u++ {
+		c := 0.5
+		if u == 0 {
+			c = 0.5 / math.Sqrt2
+		}
+		for x := 0; x < 8; x++ {
+			table[u][x] = c * math.Cos(float64(2*x+1)*float64(u)*math.Pi/16)
+		}
+	}
+	return table
+}()
+
+// Forward DCT of level shifted samples, the result is in natural order
+func forwardDCT(samples *[64]float64, res *[64]float64) {
+	tmp := [64]float64{}
+	// 1D DCT on rows
+	for y := 0; y < 8; y++ {
+		for u := 0; u < 8; u++ {
+			sum := 0.0
+			for x := 0; x < 8; x++ {
+				sum += dctTable[u][x] * samples[y*8+x]
+			}
+			tmp[y*8+u] = sum
+		}
+	}
+	// 1D DCT on columns
+	for u := 0; u < 8; u++ {
+		for v := 0; v < 8; v++ {
+			sum := 0.0
+			for y := 0; y < 8; y++ {
+				sum += dctTable[v][y] * tmp[y*8+u]
+			}
+			res[v*8+u] = sum
+		}
+	}
+}
+
+// Returns the luminance sampling factors for a subsampling mode
+func samplingFactors(sampling string) (int, int) {
+	switch sampling {
+	case "", "444":
+		return 1, 1
+	case "422":
+		return 2, 1
+	case "440":
+		return 1, 2
+	case "420":
+		return 2, 2
+	}
+	fmt.Printf("Error! Unsupported subsampling (%s), expected 444, 422, 440 or 420\n", sampling)
+	os.Exit(1)
+	return 0, 0
+}
+
+// Converts an image to YCbCr, downsamples the chroma and returns the quantized DCT coefficients
+func computeCoefficients(img *Image, options *EncodeOptions) *Coefficients {
+	hMax, vMax := samplingFactors(options.sampling)
+	coeffs := &Coefficients{
+		width:  img.width,
+		height: img.height,
+		qTables: []QuantizationTable{
+			{Id: 0, table: scaleQuantTable(&stdLuminanceQuantTable, options.quality)},
+			{Id: 1, table: scaleQuantTable(&stdChrominanceQuantTable, options.quality)},
+		},
+	}
+	mcusX := (img.width + 8*hMax - 1) / (8 * hMax)
+	mcusY := (img.height + 8*vMax - 1) / (8 * vMax)
+	// YCbCr planes of the full image
+	ycc := [3][]float64{}
+	for c := range ycc {
+		ycc[c] = make([]float64, img.width*img.height)
+	}
+	for p := 0; p < img.width*img.height; p++ {
+		r := float64(img.pix[p*3])
+		g := float64(img.pix[p*3+1])
+		b := float64(img.pix[p*3+2])
+		ycc[0][p] = 0.299*r + 0.587*g + 0.114*b - 128
+		ycc[1][p] = -0.168736*r - 0.331264*g + 0.5*b
+		ycc[2][p] = 0.5*r - 0.418688*g - 0.081312*b
+	}
+	for c := 0; c < 3; c++ {
+		h, v := 1, 1
+		if c == 0 {
+			h, v = hMax, vMax
+		}
+		plane := CoefficientPlane{
+			Id:              c + 1,
+			hSamplingFactor: h,
+			vSamplingFactor: v,
+			qTableId:        0,
+			blocksWide:      mcusX * h,
+			blocksHigh:      mcusY * v,
+		}
+		if c != 0 {
+			plane.qTableId = 1
+		}
+		// The number of pixels that are averaged into one sample
+		xScale := hMax / h
+		yScale := vMax / v
+		qt := &coeffs.qTables[plane.qTableId].table
+		plane.blocks = make([][64]int, plane.blocksWide*plane.blocksHigh)
+		samples := [64]float64{}
+		dct := [64]float64{}
+		for by := 0; by < plane.blocksHigh; by++ {
+			for bx := 0; bx < plane.blocksWide; bx++ {
+				for y := 0; y < 8; y++ {
+					for x := 0; x < 8; x++ {
+						sum := 0.0
+						for sy := 0; sy < yScale; sy++ {
+							for sx := 0; sx < xScale; sx++ {
+								// Replicate the edge pixels into the padding
+								px := ((bx*8+x)*xScale + sx)
+								py := ((by*8+y)*yScale + sy)
+								if px >= img.width {
+									px = img.width - 1
+								}
+								if py >= img.height {
+									py = img.height - 1
+								}
+								sum += ycc[c][px+py*img.width]
+							}
+						}
+						samples[y*8+x] = sum / float64(xScale*yScale)
+					}
+				}
+				forwardDCT(&samples, &dct)
+				block := &plane.blocks[bx+by*plane.blocksWide]
+				for a := 0; a < 64; a++ {
+					block[a] = int(math.Round(dct[a] / float64(qt[a])))
+				}
+			}
+		}
+		coeffs.planes = append(coeffs.planes, plane)
+	}
+	return coeffs
+}
+
+// Helper function to write a marker segment
+func writeSegment(w *bufio.Writer, marker byte, data []byte) {
+	w.Write([]byte{0xFF, marker, byte((len(data) + 2) >> 8), byte(len(data) + 2)})
+	w.Write(data)
+}
+
+func writeJFIFSegment(w *bufio.Writer, density Density) {
+	data := append([]byte{}, jfifIdentifier...)
+	if density.known() {
+		x := int(math.Round(density.x))
+		y := int(math.Round(density.y))
+		data = append(data, 1, 1, densityInch, byte(x>>8), byte(x), byte(y>>8), byte(y), 0, 0)
+	} else {
+		data = append(data, 1, 1, densityAspect, 0, 1, 0, 1, 0, 0)
+	}
+	writeSegment(w, APP0, data)
+}
+
+// Returns a quantization table as stored in a DQT segment, in zigzag order
+func quantizationTableData(table *QuantizationTable) []byte {
+	data := []byte{byte(table.Id)}
+	for a := 0; a < 64; a++ {
+		data = append(data, byte(table.table[zigzag[a]]))
+	}
+	return data
+}
+
+// Writes the quantization tables, each in its own segment
+func writeQuantizationTables(w *bufio.Writer, tables []QuantizationTable) {
+	for t := range tables {
+		writeSegment(w, DQT, quantizationTableData(&tables[t]))
+	}
+}
+
+func writeStartOfFrame(w *bufio.Writer, marker byte, coeffs *Coefficients) {
+	data := []byte{8, byte(coeffs.height >> 8), byte(coeffs.height), byte(coeffs.width >> 8), byte(coeffs.width), byte(len(coeffs.planes))}
+	for p := range coeffs.planes {
+		plane := &coeffs.planes[p]
+		data = append(data, byte(plane.Id), byte(plane.hSamplingFactor<<4|plane.vSamplingFactor), byte(plane.qTableId))
+	}
+	writeSegment(w, marker, data)
+}
+
+// Returns a Huffman table as stored in a DHT segment
+func huffmanTableData(tb *HuffmanTable) []byte {
+	class := byte(1)
+	if tb.dc {
+		class = 0
+	}
+	data := []byte{class<<4 | byte(tb.Id)}
+	for a := 0; a < 16; a++ {
+		data = append(data, byte(tb.codesOfLen[a]))
+	}
+	return append(data, tb.symbols...)
+}
+
+func writeHuffmanTable(w *bufio.Writer, tb *HuffmanTable) {
+	writeSegment(w, DHT, huffmanTableData(tb))
+}
+
+// Writes a Start Of Scan marker, tables holds the (dc, ac) table ids of each plane in the scan
+func writeStartOfScan(w *bufio.Writer, coeffs *Coefficients, planes []int, tables [][2]int, ss int, se int, ah int, al int) {
+	data := []byte{byte(len(planes))}
+	for p := range planes {
+		data = append(data, byte(coeffs.planes[planes[p]].Id), byte(tables[p][0]<<4|tables[p][1]))
+	}
+	data = append(data, byte(ss), byte(se), byte(ah<<4|al))
+	writeSegment(w, SOS, data)
+}
+
+// Returns the number of blocks of a plane that hold image data.
+// Non-interleaved scans only cover these blocks and not the MCU padding.
+func (coeffs *Coefficients) planeSize(p int) (int, int) {
+	plane := &coeffs.planes[p]
+	hMax, vMax := 1, 1
+	for c := range coeffs.planes {
+		if coeffs.planes[c].hSamplingFactor > hMax {
+			hMax = coeffs.planes[c].hSamplingFactor
+		}
+		if coeffs.planes[c].vSamplingFactor > vMax {
+			vMax = coeffs.planes[c].vSamplingFactor
+		}
+	}
+	width := (coeffs.width*plane.hSamplingFactor + hMax - 1) / hMax
+	height := (coeffs.height*plane.vSamplingFactor + vMax - 1) / vMax
+	return (width + 7) / 8, (height + 7) / 8
+}
+
+// Calls fn for every block of a scan in the order they are coded
+func forEachScanBlock(coeffs *Coefficients, planes []int, fn func(scanPlane int, block *[64]int)) {
+	if len(planes) == 1 {
+		plane := &coeffs.planes[planes[0]]
+		blocksWide, blocksHigh := coeffs.planeSize(planes[0])
+		for y := 0; y < blocksHigh; y++ {
+			for x := 0; x < blocksWide; x++ {
+				fn(0, &plane.blocks[x+y*plane.blocksWide])
+			}
+		}
+		return
+	}
+	// Interleaved scans are coded MCU by MCU
+	first := &coeffs.planes[planes[0]]
+	mcusX := first.blocksWide / first.hSamplingFactor
+	mcusY := first.blocksHigh / first.vSamplingFactor
+	for my := 0; my < mcusY; my++ {
+		for mx := 0; mx < mcusX; mx++ {
+			for p := range planes {
+				plane := &coeffs.planes[planes[p]]
+				for v := 0; v < plane.vSamplingFactor; v++ {
+					for h := 0; h < plane.hSamplingFactor; h++ {
+						x := mx*plane.hSamplingFactor + h
+						y := my*plane.vSamplingFactor + v
+						fn(p, &plane.blocks[x+y*plane.blocksWide])
+					}
+				}
+			}
+		}
+	}
+}
+
+// Writes the JFIF segment followed by the segments copied from another file.
+// The JFIF segment is left out when the copied segments have one.
+func writeHeaderSegments(w *bufio.Writer, options *EncodeOptions) {
+	jfif := false
+	for s := range options.segments {
+		if options.segments[s].marker == APP0 && bytes.HasPrefix(options.segments[s].data, jfifIdentifier) {
+			jfif = true
+		}
+	}
+	if !jfif {
+		writeJFIFSegment(w, options.density)
+	}
+	for s := range options.segments {
+		writeSegment(w, options.segments[s].marker, options.segments[s].data)
+	}
+}
+
+// Writes a baseline (SOF0) JPEG from quantized coefficients.
+// Uses the standard Huffman tables or, when optimizing, tables built from the symbol statistics.
+func writeBaseline(w io.Writer, coeffs *Coefficients, options *EncodeOptions) {
+	bw := bufio.NewWriter(w)
+	bw.Write([]byte{0xFF, SOI})
+	writeHeaderSegments(bw, options)
+	writeQuantizationTables(bw, coeffs.qTables)
+	writeStartOfFrame(bw, SOF0, coeffs)
+	planes := []int{}
+	tables := [][2]int{}
+	for p := range coeffs.planes {
+		// The first component uses the luminance tables and the others the chrominance tables
+		t := 0
+		if p > 0 {
+			t = 1
+		}
+		planes = append(planes, p)
+		tables = append(tables, [2]int{t, t})
+	}
+	dcTables := []HuffmanTable{stdDCLuminanceTable, stdDCChrominanceTable}
+	acTables := []HuffmanTable{stdACLuminanceTable, stdACChrominanceTable}
+	if options.optimize {
+		counter := &scanEncoder{counting: true, freq: make([][256]int, 4)}
+		counter.encodeSequentialScan(coeffs, planes, tables)
+		for t := range dcTables {
+			dcTables[t] = buildHuffmanTable(&counter.freq[t], t, true)
+			acTables[t] = buildHuffmanTable(&counter.freq[2+t], t, false)
+		}
+	}
+	encoder := &scanEncoder{}
+	for t := range dcTables {
+		// A grayscale image only uses the luminance tables
+		if t >= len(planes) {
+			break
+		}
+		writeHuffmanTable(bw, &dcTables[t])
+		writeHuffmanTable(bw, &acTables[t])
+	}
+	encoder.encoders = []*HuffmanEncoder{
+		newHuffmanEncoder(&dcTables[0]), newHuffmanEncoder(&dcTables[1]),
+		newHuffmanEncoder(&acTables[0]), newHuffmanEncoder(&acTables[1]),
+	}
+	writeStartOfScan(bw, coeffs, planes, tables, 0, 63, 0, 0)
+	encoder.bw = &BitWriter{w: bw}
+	encoder.encodeSequentialScan(coeffs, planes, tables)
+	encoder.bw.flush()
+	bw.Write([]byte{0xFF, EOI})
+	if err := bw.Flush(); err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+}
+
+// Encodes an image as a baseline or progressive JPEG
+func encodeJPEG(w io.Writer, img *Image, options *EncodeOptions) {
+	coeffs := computeCoefficients(img, options)
+	if options.progressive {
+		writeProgressive(w, coeffs, options)
+		return
+	}
+	writeBaseline(w, coeffs, options)
+}
+
+func writeJPEG(filename string, img *Image, options *EncodeOptions) {
+	f, err := os.Create(filename)
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	logf("Writing jpeg to %s ... \n", filename)
+	encodeJPEG(f, img, options)
+	f.Close()
+}
@@ -0,0 +1,446 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+)
+
+// The identifier at the start of an APP1 EXIF payload
+var exifIdentifier = []byte("Exif\x00\x00")
+
+// TIFF field types
+const (
+	tiffByte      = 1
+	tiffAscii     = 2
+	tiffShort     = 3
+	tiffLong      = 4
+	tiffRational  = 5
+	tiffSByte     = 6
+	tiffUndefined = 7
+	tiffSShort    = 8
+	tiffSLong     = 9
+	tiffSRational = 10
+	tiffFloat     = 11
+	tiffDouble    = 12
+)
+
+// The size in bytes of a single value of each TIFF field type
+var tiffTypeSize = map[uint16]int{
+	tiffByte:      1,
+	tiffAscii:     1,
+	tiffShort:     2,
+	tiffLong:      4,
+	tiffRational:  8,
+	tiffSByte:     1,
+	tiffUndefined: 1,
+	tiffSShort:    2,
+	tiffSLong:     4,
+	tiffSRational: 8,
+	tiffFloat:     4,
+	tiffDouble:    8,
+}
+
+// EXIF tags that are used by the decoder
+const (
+	tagImageWidth                  = 0x0100
+	tagImageHeight                 = 0x0101
+	tagImageDescription            = 0x010E
+	tagMake                        = 0x010F
+	tagModel                       = 0x0110
+	tagOrientation                 = 0x0112
+	tagXResolution                 = 0x011A
+	tagYResolution                 = 0x011B
+	tagResolutionUnit              = 0x0128
+	tagSoftware                    = 0x0131
+	tagDateTime                    = 0x0132
+	tagArtist                      = 0x013B
+	tagJPEGInterchangeFormat       = 0x0201
+	tagJPEGInterchangeFormatLength = 0x0202
+	tagRating                      = 0x4746
+	tagCopyright                   = 0x8298
+	tagExifIFDPointer              = 0x8769
+	tagGPSIFDPointer               = 0x8825
+	tagExposureTime                = 0x829A
+	tagFNumber                     = 0x829D
+	tagISOSpeedRatings             = 0x8827
+	tagDateTimeOriginal            = 0x9003
+	tagFocalLength                 = 0x920A
+	tagPixelXDimension             = 0xA002
+	tagPixelYDimension             = 0xA003
+	tagGPSLatitudeRef              = 0x0001
+	tagGPSLatitude                 = 0x0002
+	tagGPSLongitudeRef             = 0x0003
+	tagGPSLongitude                = 0x0004
+	tagGPSAltitude                 = 0x0006
+)
+
+// Human readable names of the common tags, used when printing
+var exifTagNames = map[uint16]string{
+	tagImageWidth:                  "ImageWidth",
+	tagImageHeight:                 "ImageHeight",
+	tagImageDescription:            "ImageDescription",
+	tagMake:                        "Make",
+	tagModel:                       "Model",
+	tagOrientation:                 "Orientation",
+	tagXResolution:                 "XResolution",
+	tagYResolution:                 "YResolution",
+	tagResolutionUnit:              "ResolutionUnit",
+	tagSoftware:                    "Software",
+	tagDateTime:                    "DateTime",
+	tagArtist:                      "Artist",
+	tagJPEGInterchangeFormat:       "JPEGInterchangeFormat",
+	tagJPEGInterchangeFormatLength: "JPEGInterchangeFormatLength",
+	tagRating:                      "Rating",
+	tagCopyright:                   "Copyright",
+	tagExifIFDPointer:              "ExifIFDPointer",
+	tagGPSIFDPointer:               "GPSIFDPointer",
+	tagExposureTime:                "ExposureTime",
+	tagFNumber:                     "FNumber",
+	tagISOSpeedRatings:             "ISOSpeedRatings",
+	tagDateTimeOriginal:            "DateTimeOriginal",
+	tagFocalLength:                 "FocalLength",
+	tagPixelXDimension:             "PixelXDimension",
+	tagPixelYDimension:             "PixelYDimension",
+}
+
+// GPS tag ids overlap with the IFD0 ids so they get their own names
+var gpsTagNames = map[uint16]string{
+	0x0000:             "GPSVersionID",
+	tagGPSLatitudeRef:  "GPSLatitudeRef",
+	tagGPSLatitude:     "GPSLatitude",
+	tagGPSLongitudeRef: "GPSLongitudeRef",
+	tagGPSLongitude:    "GPSLongitude",
+	0x0005:             "GPSAltitudeRef",
+	tagGPSAltitude:     "GPSAltitude",
+	0x0007:             "GPSTimeStamp",
+	0x001D:             "GPSDateStamp",
+}
+
+// A single entry of a TIFF image file directory
+type ExifTag struct {
+	Id    uint16
+	typ   uint16
+	count uint32
+	value []byte // The raw value bytes in the byte order of the TIFF data
+	order binary.ByteOrder
+}
+
+// The EXIF data of an image split into its image file directories
+type Exif struct {
+	order   binary.ByteOrder
+	data    []byte // The TIFF data starting at the byte order mark
+	ifd0    []ExifTag
+	exifIFD []ExifTag
+	gpsIFD  []ExifTag
+	ifd1    []ExifTag
+}
+
+// Returns the number of values in the tag
+func (t *ExifTag) len() int {
+	return int(t.count)
+}
+
+// Returns the i-th value of an integer tag
+func (t *ExifTag) intValue(i int) int64 {
+	size := tiffTypeSize[t.typ]
+	if i < 0 || (i+1)*size > len(t.value) {
+		return 0
+	}
+	v := t.value[i*size:]
+	switch t.typ {
+	case tiffByte, tiffUndefined:
+		return int64(v[0])
+	case tiffSByte:
+		return int64(int8(v[0]))
+	case tiffShort:
+		return int64(t.order.Uint16(v))
+	case tiffSShort:
+		return int64(int16(t.order.Uint16(v)))
+	case tiffLong:
+		return int64(t.order.Uint32(v))
+	case tiffSLong:
+		return int64(int32(t.order.Uint32(v)))
+	case tiffRational, tiffSRational, tiffFloat, tiffDouble:
+		return int64(t.floatValue(i))
+	}
+	return 0
+}
+
+// Returns the i-th value of a rational tag as numerator and denominator
+func (t *ExifTag) ratValue(i int) (int64, int64) {
+	if t.typ != tiffRational && t.typ != tiffSRational {
+		return t.intValue(i), 1
+	}
+	if i < 0 || (i+1)*8 > len(t.value) {
+		return 0, 1
+	}
+	v := t.value[i*8:]
+	if t.typ == tiffSRational {
+		return int64(int32(t.order.Uint32(v))), int64(int32(t.order.Uint32(v[4:])))
+	}
+	return int64(t.order.Uint32(v)), int64(t.order.Uint32(v[4:]))
+}
+
+// Returns the i-th value of any numeric tag as a float
+func (t *ExifTag) floatValue(i int) float64 {
+	switch t.typ {
+	case tiffRational, tiffSRational:
+		num, den := t.ratValue(i)
+		if den == 0 {
+			return 0
+		}
+		return float64(num) / float64(den)
+	case tiffFloat:
+		if i < 0 || (i+1)*4 > len(t.value) {
+			return 0
+		}
+		return float64(math.Float32frombits(t.order.Uint32(t.value[i*4:])))
+	case tiffDouble:
+		if i < 0 || (i+1)*8 > len(t.value) {
+			return 0
+		}
+		return math.Float64frombits(t.order.Uint64(t.value[i*8:]))
+	}
+	return float64(t.intValue(i))
+}
+
+// Returns the value of an ASCII tag without the trailing NUL bytes
+func (t *ExifTag) stringValue() string {
+	return strings.TrimRight(string(t.value), "\x00 ")
+}
+
+// Formats the value of the tag for printing
+func (t *ExifTag) String() string {
+	switch t.typ {
+	case tiffAscii:
+		return t.stringValue()
+	case tiffUndefined:
+		if len(t.value) > 16 {
+			return fmt.Sprintf("(%d bytes)", len(t.value))
+		}
+		return fmt.Sprintf("%x", t.value)
+	}
+	values := []string{}
+	for a := 0; a < t.len() && a < 8; a++ {
+		switch t.typ {
+		case tiffRational, tiffSRational:
+			num, den := t.ratValue(a)
+			values = append(values, fmt.Sprintf("%d/%d", num, den))
+		case tiffFloat, tiffDouble:
+			values = append(values, fmt.Sprintf("%g", t.floatValue(a)))
+		default:
+			values = append(values, fmt.Sprintf("%d", t.intValue(a)))
+		}
+	}
+	if t.len() > 8 {
+		values = append(values, "...")
+	}
+	return strings.Join(values, " ")
+}
+
+// Parses the TIFF header of the data and returns the byte order and the offset of IFD0
+func readTiffHeader(data []byte) (binary.ByteOrder, uint32, error) {
+	if len(data) < 8 {
+		return nil, 0, errors.New("TIFF header too short")
+	}
+	var order binary.ByteOrder
+	switch string(data[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return nil, 0, fmt.Errorf("invalid byte order mark %q", data[:2])
+	}
+	if order.Uint16(data[2:]) != 42 {
+		return nil, 0, errors.New("invalid TIFF magic number")
+	}
+	return order, order.Uint32(data[4:]), nil
+}
+
+// Reads the image file directory at offset and returns its tags and the offset of the next IFD
+func readIFD(data []byte, order binary.ByteOrder, offset uint32) ([]ExifTag, uint32, error) {
+	if int64(offset)+2 > int64(len(data)) {
+		return nil, 0, fmt.Errorf("IFD offset %d out of range", offset)
+	}
+	count := int(order.Uint16(data[offset:]))
+	pos := int(offset) + 2
+	if pos+count*12+4 > len(data) {
+		return nil, 0, fmt.Errorf("IFD at offset %d with %d entries is truncated", offset, count)
+	}
+	tags := []ExifTag{}
+	for a := 0; a < count; a++ {
+		entry := data[pos+a*12:]
+		tag := ExifTag{
+			Id:    order.Uint16(entry),
+			typ:   order.Uint16(entry[2:]),
+			count: order.Uint32(entry[4:]),
+			order: order,
+		}
+		size, ok := tiffTypeSize[tag.typ]
+		if !ok {
+			// Unknown types must be skipped
+			continue
+		}
+		total := int64(size) * int64(tag.count)
+		if total <= 4 {
+			tag.value = entry[8 : 8+total]
+		} else {
+			valueOffset := int64(order.Uint32(entry[8:]))
+			if valueOffset+total > int64(len(data)) {
+				return nil, 0, fmt.Errorf("value of tag 0x%04X out of range", tag.Id)
+			}
+			tag.value = data[valueOffset : valueOffset+total]
+		}
+		tags = append(tags, tag)
+	}
+	next := order.Uint32(data[pos+count*12:])
+	return tags, next, nil
+}
+
+// Parses the TIFF structure of an APP1 EXIF payload (without the 'Exif\0\0' identifier)
+func parseExif(header *Header, data []byte) (*Exif, error) {
+	order, offset, err := readTiffHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	exif := &Exif{order: order, data: data}
+	next := uint32(0)
+	exif.ifd0, next, err = readIFD(data, order, offset)
+	if err != nil {
+		return nil, err
+	}
+	// IFD1 holds the thumbnail, a broken one should not discard IFD0
+	if next != 0 && next != offset {
+		exif.ifd1, _, err = readIFD(data, order, next)
+		if err != nil {
+			warn(header, "Invalid EXIF IFD1: %s", err.Error())
+		}
+	}
+	if ptr := findTag(exif.ifd0, tagExifIFDPointer); ptr != nil {
+		exif.exifIFD, _, err = readIFD(data, order, uint32(ptr.intValue(0)))
+		if err != nil {
+			warn(header, "Invalid EXIF SubIFD: %s", err.Error())
+		}
+	}
+	if ptr := findTag(exif.ifd0, tagGPSIFDPointer); ptr != nil {
+		exif.gpsIFD, _, err = readIFD(data, order, uint32(ptr.intValue(0)))
+		if err != nil {
+			warn(header, "Invalid EXIF GPS IFD: %s", err.Error())
+		}
+	}
+	return exif, nil
+}
+
+// Helper function to find a tag by its id
+func findTag(tags []ExifTag, id uint16) *ExifTag {
+	for t := range tags {
+		if tags[t].Id == id {
+			return &tags[t]
+		}
+	}
+	return nil
+}
+
+// Looks up a tag in IFD0 and then in the Exif SubIFD
+func (e *Exif) tag(id uint16) *ExifTag {
+	if t := findTag(e.ifd0, id); t != nil {
+		return t
+	}
+	return findTag(e.exifIFD, id)
+}
+
+// Returns the orientation (1-8) of the image, 1 if the tag is missing or invalid
+func (e *Exif) orientation() int {
+	t := findTag(e.ifd0, tagOrientation)
+	if t == nil {
+		return 1
+	}
+	o := int(t.intValue(0))
+	if o < 1 || o > 8 {
+		return 1
+	}
+	return o
+}
+
+// Sets the orientation to normal (1) in the EXIF data the tags were read from
+func (e *Exif) resetOrientation() {
+	t := findTag(e.ifd0, tagOrientation)
+	if t == nil || t.typ != tiffShort || len(t.value) < 2 {
+		return
+	}
+	e.order.PutUint16(t.value, 1)
+}
+
+// Returns the GPS position in decimal degrees, ok is false if there is no GPS data
+func (e *Exif) gpsPosition() (lat float64, lon float64, ok bool) {
+	latTag := findTag(e.gpsIFD, tagGPSLatitude)
+	lonTag := findTag(e.gpsIFD, tagGPSLongitude)
+	if latTag == nil || lonTag == nil || latTag.len() < 3 || lonTag.len() < 3 {
+		return 0, 0, false
+	}
+	lat = latTag.floatValue(0) + latTag.floatValue(1)/60 + latTag.floatValue(2)/3600
+	lon = lonTag.floatValue(0) + lonTag.floatValue(1)/60 + lonTag.floatValue(2)/3600
+	if ref := findTag(e.gpsIFD, tagGPSLatitudeRef); ref != nil && ref.stringValue() == "S" {
+		lat = -lat
+	}
+	if ref := findTag(e.gpsIFD, tagGPSLongitudeRef); ref != nil && ref.stringValue() == "W" {
+		lon = -lon
+	}
+	return lat, lon, true
+}
+
+// Returns the JPEG thumbnail referenced from IFD1 or nil
+func (e *Exif) thumbnail() []byte {
+	offset := findTag(e.ifd1, tagJPEGInterchangeFormat)
+	length := findTag(e.ifd1, tagJPEGInterchangeFormatLength)
+	if offset == nil || length == nil {
+		return nil
+	}
+	start := offset.intValue(0)
+	end := start + length.intValue(0)
+	if start < 0 || end > int64(len(e.data)) || start >= end {
+		return nil
+	}
+	return e.data[start:end]
+}
+
+func decodeExif(header *Header, data []byte) {
+	exif, err := parseExif(header, data)
+	if err != nil {
+		warn(header, "Invalid EXIF data: %s", err.Error())
+		return
+	}
+	header.exif = exif
+	printExifInfo(exif)
+}
+
+// Helper function to print the EXIF information
+func printExifInfo(exif *Exif) {
+	logf("*** EXIF ***\n")
+	ifds := []struct {
+		name  string
+		tags  []ExifTag
+		names map[uint16]string
+	}{
+		{"IFD0", exif.ifd0, exifTagNames},
+		{"ExifIFD", exif.exifIFD, exifTagNames},
+		{"GPS", exif.gpsIFD, gpsTagNames},
+		{"IFD1", exif.ifd1, exifTagNames},
+	}
+	for i := range ifds {
+		ifd := ifds[i]
+		logf("** %s (%d tags) **\n", ifd.name, len(ifd.tags))
+		for t := range ifd.tags {
+			tag := &ifd.tags[t]
+			name, ok := ifd.names[tag.Id]
+			if !ok {
+				continue
+			}
+			logf("%-28s : %s\n", name, tag.String())
+		}
+	}
+}
@@ -0,0 +1,464 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"flag"
+	"fmt"
+	"image/jpeg"
+	"io"
+	"math"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+)
+
+var updateFixtures = flag.Bool("update", false, "rewrite the fixtures in testdata/fixtures and their hashes")
+
+const fixtureDir = "testdata/fixtures"
+
+// A synthetic JPEG covering one combination of the modes of the decoder
+type fixture struct {
+	width       int
+	height      int
+	sampling    string // 444, 422, 440, 420 or gray
+	restart     int    // The restart interval in MCUs, 0 for none
+	interleaved bool   // All components in one scan, otherwise a scan per component with its tables before it
+	zeroBased   bool   // Component ids 0, 1, 2 instead of 1, 2, 3
+	combined    bool   // All tables in one DQT and one DHT segment instead of a segment per table
+	script      string // The name of a progressive scan script, empty for baseline
+	// A DQT before each scan of a non-interleaved file, the last component redefines the table of the one before it
+	scanTables bool
+}
+
+// Progressive scan scripts for 3 and for 1 components
+var fixtureScripts = map[string][2]string{
+	// libjpeg's simple progression
+	"default": {"", ""},
+	// Spectral selection only
+	"spectral": {
+		"0,1,2: 0-0, 0, 0; 0: 1-9, 0, 0; 0: 10-63, 0, 0; 1: 1-63, 0, 0; 2: 1-63, 0, 0;",
+		"0: 0-0, 0, 0; 0: 1-9, 0, 0; 0: 10-63, 0, 0;",
+	},
+	// Non-interleaved DC scans and two successive approximation steps
+	"refine": {
+		"0: 0-0, 0, 2; 1: 0-0, 0, 1; 2: 0-0, 0, 1; 0: 0-0, 2, 1; 0,1,2: 0-0, 1, 0;" +
+			"0: 1-63, 0, 2; 1: 1-63, 0, 1; 2: 1-63, 0, 0; 0: 1-63, 2, 1; 0: 1-63, 1, 0; 1: 1-63, 1, 0;",
+		"0: 0-0, 0, 2; 0: 0-0, 2, 1; 0: 0-0, 1, 0; 0: 1-63, 0, 2; 0: 1-63, 2, 1; 0: 1-63, 1, 0;",
+	},
+}
+
+func (f *fixture) name() string {
+	parts := []string{"b"}
+	if f.script != "" {
+		parts[0] = "p-" + f.script
+	}
+	parts = append(parts, f.sampling, fmt.Sprintf("%dx%d", f.width, f.height))
+	if f.restart > 0 {
+		parts = append(parts, fmt.Sprintf("rst%d", f.restart))
+	}
+	if !f.interleaved {
+		parts = append(parts, "ni")
+	}
+	if f.zeroBased {
+		parts = append(parts, "id0")
+	}
+	if f.combined {
+		parts = append(parts, "comb")
+	}
+	if f.scanTables {
+		parts = append(parts, "dqt")
+	}
+	return strings.Join(parts, "-") + ".jpg"
+}
+
+// Every combination of the modes, the table layout only applies to baseline files
+func fixtures() []fixture {
+	list := []fixture{}
+	sizes := [][2]int{{32, 32}, {37, 21}}
+	for _, sampling := range []string{"444", "422", "440", "420", "gray"} {
+		for _, size := range sizes {
+			for _, restart := range []int{0, 1, 5} {
+				for _, interleaved := range []bool{true, false} {
+					// A grayscale scan is always non-interleaved
+					if sampling == "gray" && !interleaved {
+						continue
+					}
+					for _, zeroBased := range []bool{false, true} {
+						for _, combined := range []bool{false, true} {
+							list = append(list, fixture{size[0], size[1], sampling, restart, interleaved, zeroBased, combined, "", false})
+						}
+					}
+					if !interleaved {
+						list = append(list, fixture{size[0], size[1], sampling, restart, false, false, false, "", true})
+					}
+				}
+			}
+			for _, script := range []string{"default", "spectral", "refine"} {
+				for _, restart := range []int{0, 1, 5} {
+					for _, zeroBased := range []bool{false, true} {
+						list = append(list, fixture{size[0], size[1], sampling, restart, true, zeroBased, false, script, false})
+					}
+				}
+			}
+		}
+	}
+	return list
+}
+
+// A test image with gradients, edges and a checkerboard, so every coefficient gets used
+func fixtureImage(width int, height int) *Image {
+	img := newImage(width, height)
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			i := (x + y*width) * 3
+			img.pix[i] = byte(x * 255 / width)
+			img.pix[i+1] = byte(y * 255 / height)
+			img.pix[i+2] = byte(((x/3 + y/3) % 2) * 200)
+			if x > width/2 && y > height/2 {
+				img.pix[i], img.pix[i+1] = img.pix[i+1], 255-img.pix[i]
+			}
+		}
+	}
+	return img
+}
+
+// Writes the segments of the tables, in one segment or in a segment each
+func writeFixtureTables(w *bufio.Writer, marker byte, tables [][]byte, combined bool) {
+	if combined {
+		writeSegment(w, marker, bytes.Join(tables, nil))
+		return
+	}
+	for _, data := range tables {
+		writeSegment(w, marker, data)
+	}
+}
+
+// Calls code for every block of a scan. After every restart MCUs the restart interval ends: the EOB
+// run and the bits are flushed, an RSTn marker is written and the DC predictions start again from 0.
+func forEachFixtureBlock(encoder *scanEncoder, coeffs *Coefficients, planes []int, restart int, code func(p int, block *[64]int, prevDC *int)) {
+	blocksPerMCU := 1
+	if len(planes) > 1 {
+		blocksPerMCU = 0
+		for _, p := range planes {
+			blocksPerMCU += coeffs.planes[p].hSamplingFactor * coeffs.planes[p].vSamplingFactor
+		}
+	}
+	prevDC := make([]int, len(planes))
+	blocks := 0
+	forEachScanBlock(coeffs, planes, func(p int, block *[64]int) {
+		if restart > 0 && blocks > 0 && blocks%(restart*blocksPerMCU) == 0 {
+			encoder.flushEOBRun()
+			if !encoder.counting {
+				encoder.bw.flush()
+				encoder.bw.w.Write([]byte{0xFF, RST0 + byte((blocks/(restart*blocksPerMCU)-1)%8)})
+			}
+			for c := range prevDC {
+				prevDC[c] = 0
+			}
+		}
+		code(p, block, &prevDC[p])
+		blocks++
+	})
+	encoder.flushEOBRun()
+	if !encoder.counting {
+		encoder.bw.flush()
+	}
+}
+
+// Codes a sequential scan with an RSTn marker after every restart MCUs
+func encodeFixtureScan(w *bufio.Writer, coeffs *Coefficients, planes []int, tables [][2]int, encoders []*HuffmanEncoder, restart int) {
+	encoder := &scanEncoder{bw: &BitWriter{w: w}, encoders: encoders}
+	forEachFixtureBlock(encoder, coeffs, planes, restart, func(p int, block *[64]int, prevDC *int) {
+		encoder.encodeBlock(block, prevDC, tables[p][0], 2+tables[p][1])
+	})
+}
+
+// Codes a progressive scan like scanEncoder.encodeScan with an RSTn marker after every restart MCUs
+func encodeProgressiveFixtureScan(encoder *scanEncoder, coeffs *Coefficients, scan *ScanSpec, tables []int, restart int) {
+	forEachFixtureBlock(encoder, coeffs, scan.components, restart, func(p int, block *[64]int, prevDC *int) {
+		switch {
+		case scan.ss == 0 && scan.ah == 0:
+			encoder.encodeDCFirst(block, prevDC, tables[p], scan.al)
+		case scan.ss == 0:
+			encoder.encodeDCRefine(block, scan.al)
+		case scan.ah == 0:
+			encoder.encodeACFirst(block, tables[p], scan.ss, scan.se, scan.al)
+		default:
+			encoder.encodeACRefine(block, tables[p], scan.ss, scan.se, scan.al)
+		}
+	})
+}
+
+// Writes a progressive fixture with a restart interval, which writeProgressive doesn't write.
+// Every scan gets Huffman tables built from its own symbol statistics.
+func writeProgressiveFixture(w io.Writer, coeffs *Coefficients, scans []ScanSpec, restart int) {
+	bw := bufio.NewWriter(w)
+	bw.Write([]byte{0xFF, SOI})
+	writeJFIFSegment(bw, Density{})
+	writeQuantizationTables(bw, coeffs.qTables)
+	writeSegment(bw, DRI, []byte{byte(restart >> 8), byte(restart)})
+	writeStartOfFrame(bw, SOF2, coeffs)
+	for s := range scans {
+		scan := &scans[s]
+		// The first component uses table 0 and the others table 1
+		tables := make([]int, len(scan.components))
+		ids := [][2]int{}
+		for p, c := range scan.components {
+			if c > 0 {
+				tables[p] = 1
+			}
+			ids = append(ids, [2]int{tables[p], tables[p]})
+		}
+		encoder := &scanEncoder{encoders: make([]*HuffmanEncoder, 2)}
+		// DC refinement scans are not Huffman coded
+		if scan.ss != 0 || scan.ah == 0 {
+			counter := &scanEncoder{counting: true, freq: make([][256]int, 2)}
+			encodeProgressiveFixtureScan(counter, coeffs, scan, tables, restart)
+			for t := range counter.freq {
+				used := false
+				for p := range tables {
+					used = used || tables[p] == t
+				}
+				if !used {
+					continue
+				}
+				table := buildHuffmanTable(&counter.freq[t], t, scan.ss == 0)
+				writeHuffmanTable(bw, &table)
+				encoder.encoders[t] = newHuffmanEncoder(&table)
+			}
+		}
+		writeStartOfScan(bw, coeffs, scan.components, ids, scan.ss, scan.se, scan.ah, scan.al)
+		encoder.bw = &BitWriter{w: bw}
+		encodeProgressiveFixtureScan(encoder, coeffs, scan, tables, restart)
+	}
+	bw.Write([]byte{0xFF, EOI})
+	bw.Flush()
+}
+
+// Writes a baseline fixture with the standard Huffman tables. With per-scan tables coeffs has the
+// quantization table of each plane at its index.
+func writeBaselineFixture(w io.Writer, coeffs *Coefficients, f *fixture) {
+	bw := bufio.NewWriter(w)
+	bw.Write([]byte{0xFF, SOI})
+	writeJFIFSegment(bw, Density{})
+	if !f.scanTables {
+		qTables := [][]byte{}
+		for t := range coeffs.qTables {
+			qTables = append(qTables, quantizationTableData(&coeffs.qTables[t]))
+		}
+		writeFixtureTables(bw, DQT, qTables, f.combined)
+	}
+	if f.restart > 0 {
+		writeSegment(bw, DRI, []byte{byte(f.restart >> 8), byte(f.restart)})
+	}
+	writeStartOfFrame(bw, SOF0, coeffs)
+	dcTables := []HuffmanTable{stdDCLuminanceTable, stdDCChrominanceTable}
+	acTables := []HuffmanTable{stdACLuminanceTable, stdACChrominanceTable}
+	encoders := []*HuffmanEncoder{
+		newHuffmanEncoder(&dcTables[0]), newHuffmanEncoder(&dcTables[1]),
+		newHuffmanEncoder(&acTables[0]), newHuffmanEncoder(&acTables[1]),
+	}
+	// The first component uses the luminance tables and the others the chrominance tables
+	scans := [][]int{}
+	if f.interleaved {
+		scans = append(scans, []int{})
+		for p := range coeffs.planes {
+			scans[0] = append(scans[0], p)
+		}
+	} else {
+		for p := range coeffs.planes {
+			scans = append(scans, []int{p})
+		}
+	}
+	written := [2]bool{}
+	for _, planes := range scans {
+		tables := [][2]int{}
+		data := [][]byte{}
+		for _, p := range planes {
+			t := 0
+			if p > 0 {
+				t = 1
+			}
+			tables = append(tables, [2]int{t, t})
+			if !written[t] {
+				data = append(data, huffmanTableData(&dcTables[t]), huffmanTableData(&acTables[t]))
+				written[t] = true
+			}
+		}
+		if f.scanTables {
+			writeSegment(bw, DQT, quantizationTableData(&coeffs.qTables[planes[0]]))
+		}
+		writeFixtureTables(bw, DHT, data, f.combined)
+		writeStartOfScan(bw, coeffs, planes, tables, 0, 63, 0, 0)
+		encodeFixtureScan(bw, coeffs, planes, tables, encoders, f.restart)
+	}
+	bw.Write([]byte{0xFF, EOI})
+	bw.Flush()
+}
+
+// Gives the last plane a coarser table with the id of the table of the plane before it, so its DQT
+// replaces a table that the earlier scan has to keep. The coefficients are quantized again with it.
+func redefineFixtureTable(coeffs *Coefficients) {
+	last := &coeffs.planes[len(coeffs.planes)-1]
+	table := QuantizationTable{Id: last.qTableId}
+	old := &coeffs.qTables[last.qTableId].table
+	for k := range table.table {
+		table.table[k] = old[k] * 2
+		if table.table[k] > 255 {
+			table.table[k] = 255
+		}
+	}
+	for b := range last.blocks {
+		for k := range last.blocks[b] {
+			last.blocks[b][k] = int(math.Round(float64(last.blocks[b][k]) * float64(old[k]) / float64(table.table[k])))
+		}
+	}
+	coeffs.qTables = append(coeffs.qTables, table)
+}
+
+// Generates the JPEG of a fixture
+func (f *fixture) generate(t *testing.T) []byte {
+	options := &EncodeOptions{quality: 75, sampling: f.sampling}
+	if f.sampling == "gray" {
+		options.sampling = "444"
+	}
+	coeffs := computeCoefficients(fixtureImage(f.width, f.height), options)
+	if f.sampling == "gray" {
+		coeffs.planes = coeffs.planes[:1]
+		coeffs.qTables = coeffs.qTables[:1]
+	}
+	if f.zeroBased {
+		for p := range coeffs.planes {
+			coeffs.planes[p].Id = p
+		}
+	}
+	if f.scanTables {
+		redefineFixtureTable(coeffs)
+	}
+	buf := &bytes.Buffer{}
+	if f.script == "" {
+		writeBaselineFixture(buf, coeffs, f)
+		return buf.Bytes()
+	}
+	options.progressive = true
+	script := fixtureScripts[f.script][0]
+	if f.sampling == "gray" {
+		script = fixtureScripts[f.script][1]
+	}
+	if script != "" {
+		scans, err := parseScanScript(script)
+		if err != nil {
+			t.Fatal(err)
+		}
+		options.scans = scans
+	}
+	if f.restart > 0 {
+		if options.scans == nil {
+			options.scans = defaultScanScript(len(coeffs.planes))
+		}
+		writeProgressiveFixture(buf, coeffs, options.scans, f.restart)
+		return buf.Bytes()
+	}
+	writeProgressive(buf, coeffs, options)
+	return buf.Bytes()
+}
+
+// Reads the file with the hashes of the decoded fixtures, a line is 'name sha256'
+func readFixtureHashes(t *testing.T) map[string]string {
+	hashes := map[string]string{}
+	data, err := os.ReadFile(filepath.Join(fixtureDir, "hashes.txt"))
+	if err != nil {
+		if *updateFixtures {
+			return hashes
+		}
+		t.Fatal(err)
+	}
+	for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) == 2 {
+			hashes[fields[0]] = fields[1]
+		}
+	}
+	return hashes
+}
+
+func writeFixtureHashes(t *testing.T, hashes map[string]string) {
+	names := []string{}
+	for name := range hashes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	out := &strings.Builder{}
+	for _, name := range names {
+		fmt.Fprintf(out, "%s %s\n", name, hashes[name])
+	}
+	if err := os.WriteFile(filepath.Join(fixtureDir, "hashes.txt"), []byte(out.String()), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// Decodes the fixtures in testdata/fixtures and compares the images to their hashes and to image/jpeg.
+// The fixtures have to be what the generator writes, -update writes them again with the hashes.
+func TestFixtures(t *testing.T) {
+	logOutput = io.Discard
+	defer func() { logOutput = os.Stdout }()
+	if *updateFixtures {
+		if err := os.MkdirAll(fixtureDir, 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	hashes := readFixtureHashes(t)
+	for _, f := range fixtures() {
+		f := f
+		name := f.name()
+		t.Run(name, func(t *testing.T) {
+			path := filepath.Join(fixtureDir, name)
+			data := f.generate(t)
+			if *updateFixtures {
+				if err := os.WriteFile(path, data, 0644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			stored, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(stored, data) {
+				t.Fatalf("the generator writes a different file, run go test -run TestFixtures -update")
+			}
+			header, err := decodeJPEGSafe(bytes.NewReader(data), name, &Options{strict: true})
+			if err != nil {
+				t.Fatal(err)
+			}
+			// image/jpeg counts the restart intervals of a non-interleaved scan in MCUs of the interleaved
+			// scans instead of in blocks (A.2.2), the AC scans of a progressive file are non-interleaved too.
+			// Restart markers don't change the image, so these are compared to the file without them.
+			reference := data
+			if f.restart > 0 && (!f.interleaved || f.script != "") && f.sampling != "444" && f.sampling != "gray" {
+				plain := f
+				plain.restart = 0
+				reference = plain.generate(t)
+			}
+			want, err := jpeg.Decode(bytes.NewReader(reference))
+			if err != nil {
+				t.Fatalf("image/jpeg: %v", err)
+			}
+			if psnr, maxError := compareImage(header.image, want); psnr < 38 {
+				t.Errorf("PSNR %.2f dB (max error %d) compared to image/jpeg", psnr, maxError)
+			}
+			hash := fmt.Sprintf("%x", sha256.Sum256(header.image.pix))
+			if *updateFixtures {
+				hashes[name] = hash
+			} else if hashes[name] != hash {
+				t.Errorf("the decoded image has the hash %s, expected %s", hash, hashes[name])
+			}
+		})
+	}
+	if *updateFixtures {
+		writeFixtureHashes(t, hashes)
+	}
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+)
+
+// Limits that keep a single fuzz input from allocating much
+var fuzzLimits = Limits{
+	maxPixels:   1 << 20,
+	maxMemory:   64 << 20,
+	maxScans:    64,
+	maxMetadata: 1 << 20,
+}
+
+// Adds the files in test/ and the synthetic fixtures to the seed corpus
+func addSeedFiles(f *testing.F) [][]byte {
+	files := [][]byte{}
+	for _, pattern := range []string{"test/*.jpg", "test/*/*.jpg", fixtureDir + "/*.jpg"} {
+		names, err := filepath.Glob(pattern)
+		if err != nil {
+			f.Fatal(err)
+		}
+		for _, name := range names {
+			data, err := os.ReadFile(name)
+			if err != nil {
+				f.Fatal(err)
+			}
+			files = append(files, data)
+		}
+	}
+	if len(files) == 0 {
+		f.Fatal("no seed files in test/")
+	}
+	return files
+}
+
+// Splits a file into the segments up to and including the first scan header and the rest
+func splitAtScan(data []byte) ([]byte, []byte) {
+	for a := 2; a+3 < len(data); {
+		if data[a] != 0xFF {
+			return nil, nil
+		}
+		length := int(data[a+2])<<8 | int(data[a+3])
+		end := a + 2 + length
+		if end > len(data) {
+			return nil, nil
+		}
+		if data[a+1] == SOS {
+			return data[:end], data[end:]
+		}
+		a = end
+	}
+	return nil, nil
+}
+
+// Makes the frame of a file at most size x size pixels, so the decoder doesn't spend its time on the
+// large images of the seeds when the data of their scans is replaced anyway
+func shrinkFrame(head []byte, size int) []byte {
+	head = append([]byte{}, head...)
+	for a := 2; a+8 < len(head) && head[a] == 0xFF; a += 2 + (int(head[a+2])<<8 | int(head[a+3])) {
+		if head[a+1] == SOF0 || head[a+1] == SOF2 {
+			for _, b := range []int{a + 5, a + 7} {
+				if int(head[b])<<8|int(head[b+1]) > size {
+					head[b], head[b+1] = byte(size>>8), byte(size)
+				}
+			}
+		}
+	}
+	return head
+}
+
+func fuzzDecode(t *testing.T, data []byte, options *Options) {
+	logOutput = io.Discard
+	defer func() { logOutput = os.Stdout }()
+	decodeJPEGSafe(bytes.NewReader(data), "fuzz.jpg", options)
+}
+
+// The marker parser, the decoding stops at the first scan
+func FuzzMarkers(f *testing.F) {
+	for _, data := range addSeedFiles(f) {
+		head, _ := splitAtScan(data)
+		f.Add(head)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		fuzzDecode(t, data, &Options{metadataOnly: true, limits: fuzzLimits})
+	})
+}
+
+// The Huffman decoder, the data of the scan is replaced with the fuzzed bytes
+func FuzzHuffman(f *testing.F) {
+	heads := [][]byte{}
+	for _, data := range addSeedFiles(f) {
+		head, scan := splitAtScan(data)
+		if head == nil || len(head) > 1<<16 {
+			continue
+		}
+		heads = append(heads, shrinkFrame(head, 64))
+		if len(scan) > 4096 {
+			scan = scan[:4096]
+		}
+		f.Add(uint8(len(heads)-1), scan, false)
+	}
+	f.Fuzz(func(t *testing.T, head uint8, scan []byte, tolerant bool) {
+		data := append(append([]byte{}, heads[int(head)%len(heads)]...), scan...)
+		data = append(data, 0xFF, EOI)
+		fuzzDecode(t, data, &Options{tolerant: tolerant, limits: fuzzLimits})
+	})
+}
+
+// The whole decoder, and decoding a region
+func FuzzDecode(f *testing.F) {
+	for _, data := range addSeedFiles(f) {
+		// The large files are over the pixel limit anyway and only slow down the mutator
+		if len(data) > 1<<18 {
+			continue
+		}
+		f.Add(data, false, false)
+	}
+	f.Fuzz(func(t *testing.T, data []byte, tolerant bool, strict bool) {
+		fuzzDecode(t, data, &Options{tolerant: tolerant, strict: strict, limits: fuzzLimits})
+		// A region goes through other paths of the entropy decoder and the pipeline
+		fuzzDecode(t, data, &Options{tolerant: tolerant, strict: strict, limits: fuzzLimits, region: &Region{5, 3, 20, 11}})
+	})
+}
+
+// The full length of an extended XMP packet is only a claim of the file, eight packets of
+// 4 GiB mustn't be allocated before their chunks arrive
+func TestExtendedXMPLength(t *testing.T) {
+	data := []byte{0xFF, SOI}
+	for a := 0; a < 8; a++ {
+		payload := append([]byte{}, xmpExtensionIdentifier...)
+		payload = append(payload, bytes.Repeat([]byte{'0' + byte(a)}, 32)...)
+		payload = append(payload, 0xFF, 0xFF, 0xFF, 0xFF, 0, 0, 0, 0, 'x', 'x', 'x', 'x')
+		data = append(data, 0xFF, APP1, byte((len(payload)+2)>>8), byte(len(payload)+2))
+		data = append(data, payload...)
+	}
+	data = append(data, 0xFF, EOI)
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	fuzzDecode(t, data, &Options{metadataOnly: true, limits: fuzzLimits})
+	runtime.ReadMemStats(&after)
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("allocated %d bytes for a %d byte file", allocated, len(data))
+	}
+}
+
+// The files in testdata/invalid aren't JPEGs the decoder can work around, they fail in every mode
+func TestInvalidFiles(t *testing.T) {
+	logOutput = io.Discard
+	defer func() { logOutput = os.Stdout }()
+	names, err := filepath.Glob("testdata/invalid/*.jpg")
+	if err != nil || len(names) == 0 {
+		t.Fatalf("no files in testdata/invalid: %v", err)
+	}
+	for _, name := range names {
+		data, err := os.ReadFile(name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for _, options := range []Options{{}, {strict: true}, {tolerant: true}} {
+			if _, err := decodeJPEGSafe(bytes.NewReader(data), name, &options); err == nil {
+				t.Errorf("%s: decoded with strict %v and tolerant %v", name, options.strict, options.tolerant)
+			}
+		}
+	}
+}
+
+// Broken ICC, extended XMP and MPF segments are warnings of the header like the EXIF ones
+func TestMetadataWarnings(t *testing.T) {
+	logOutput = io.Discard
+	defer func() { logOutput = os.Stdout }()
+	data := []byte{0xFF, SOI}
+	for _, segment := range []struct {
+		marker  byte
+		payload []byte
+	}{
+		{APP2, iccIdentifier},
+		{APP1, append(append([]byte{}, xmpExtensionIdentifier...), "too short"...)},
+		{APP2, append(append([]byte{}, mpfIdentifier...), "MM"...)},
+	} {
+		data = append(data, 0xFF, segment.marker, byte((len(segment.payload)+2)>>8), byte(len(segment.payload)+2))
+		data = append(data, segment.payload...)
+	}
+	// The metadata is complete at the first scan
+	data = append(data, 0xFF, SOS)
+	header, err := decodeJPEGSafe(bytes.NewReader(data), "warnings.jpg", &Options{metadataOnly: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(header.warnings) != 3 {
+		t.Errorf("the warnings are %q, expected one for each segment", header.warnings)
+	}
+}
+
+// Builds an RGB matrix/TRC ICC profile with the same XYZ column and the same 'para' curve
+// for the three channels
+func iccProfileData(column [3]float64, function int, params []float64) []byte {
+	s15Fixed16 := func(data []byte, v float64) []byte {
+		b := make([]byte, 4)
+		binary.BigEndian.PutUint32(b, uint32(int32(v*65536)))
+		return append(data, b...)
+	}
+	xyz := []byte("XYZ \x00\x00\x00\x00")
+	for _, v := range column {
+		xyz = s15Fixed16(xyz, v)
+	}
+	para := []byte("para\x00\x00\x00\x00\x00\x00\x00\x00")
+	para[9] = byte(function)
+	for _, v := range params {
+		para = s15Fixed16(para, v)
+	}
+	names := []string{"rXYZ", "gXYZ", "bXYZ", "rTRC", "gTRC", "bTRC"}
+	data := make([]byte, 132+len(names)*12)
+	copy(data[12:], "mntrRGB XYZ ")
+	copy(data[36:], "acsp")
+	data[131] = byte(len(names))
+	for a, name := range names {
+		tag := para
+		if a < 3 {
+			tag = xyz
+		}
+		entry := data[132+a*12:]
+		copy(entry, name)
+		binary.BigEndian.PutUint32(entry[4:], uint32(len(data)))
+		binary.BigEndian.PutUint32(entry[8:], uint32(len(tag)))
+		data = append(data, tag...)
+	}
+	return data
+}
+
+// The parameters of a profile come from the file: a curve that gives NaN mustn't index the
+// tables of the conversion out of range, and a matrix without an inverse isn't used
+func TestHostileICCProfile(t *testing.T) {
+	profile, err := parseICCProfile(iccProfileData([3]float64{0.4, 0.3, 0.2}, 3, []float64{2.4, 1, -0.5, 0, 0}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The same column three times is singular, the curves are converted with another matrix
+	profile.matrix = [3][3]float64{{1, 0, 0}, {0, 1, 0}, {0, 0, 1}}
+	img := newImage(16, 16)
+	for a := range img.pix {
+		img.pix[a] = byte(a)
+	}
+	convertToSRGB(img, profile)
+	profile, err = parseICCProfile(iccProfileData([3]float64{0, 0, 0}, 0, []float64{2.2}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if profile.hasMatrix {
+		t.Errorf("a singular matrix is used for the conversion")
+	}
+}
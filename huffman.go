@@ -0,0 +1,160 @@
+package main
+
+// Builds a Huffman table from symbol frequencies (ITU T.81 Annex K.2).
+// The code lengths are limited to 16 bits and the all-ones code is never used.
+func buildHuffmanTable(frequencies *[256]int, id int, dc bool) HuffmanTable {
+	// freq[256] reserves one code point so that no symbol gets the all-ones code
+	freq := [257]int{}
+	copy(freq[:], frequencies[:])
+	freq[256] = 1
+	// A table needs at least one symbol
+	empty := true
+	for a := 0; a < 256; a++ {
+		if freq[a] != 0 {
+			empty = false
+		}
+	}
+	if empty {
+		freq[0] = 1
+	}
+	codeSize := [257]int{}
+	others := [257]int{}
+	for a := range others {
+		others[a] = -1
+	}
+	for {
+		// Find the two least frequent symbols, ties go to the larger symbol
+		c1 := -1
+		c2 := -1
+		for a := 0; a < 257; a++ {
+			if freq[a] != 0 && (c1 < 0 || freq[a] <= freq[c1]) {
+				c1 = a
+			}
+		}
+		for a := 0; a < 257; a++ {
+			if freq[a] != 0 && a != c1 && (c2 < 0 || freq[a] <= freq[c2]) {
+				c2 = a
+			}
+		}
+		if c2 < 0 {
+			break
+		}
+		// Merge the two branches of the tree
+		freq[c1] += freq[c2]
+		freq[c2] = 0
+		codeSize[c1]++
+		for others[c1] >= 0 {
+			c1 = others[c1]
+			codeSize[c1]++
+		}
+		others[c1] = c2
+		codeSize[c2]++
+		for others[c2] >= 0 {
+			c2 = others[c2]
+			codeSize[c2]++
+		}
+	}
+	// The number of codes of each length, lengths can go up to 32 before limiting
+	bits := [33]int{}
+	for a := 0; a < 257; a++ {
+		if codeSize[a] > 0 {
+			bits[codeSize[a]]++
+		}
+	}
+	// Limit the code lengths to 16 bits (Figure K.3)
+	for i := 32; i > 16; i-- {
+		for bits[i] > 0 {
+			j := i - 2
+			for bits[j] == 0 {
+				j--
+			}
+			bits[i] -= 2
+			bits[i-1]++
+			bits[j+1] += 2
+			bits[j]--
+		}
+	}
+	// Remove the reserved code point from the longest codes
+	i := 16
+	for bits[i] == 0 {
+		i--
+	}
+	bits[i]--
+	table := HuffmanTable{Id: id, dc: dc}
+	for a := 0; a < 16; a++ {
+		table.codesOfLen[a] = bits[a+1]
+	}
+	// The symbols are sorted by their code length (Figure K.4)
+	for length := 1; length <= 32; length++ {
+		for a := 0; a < 256; a++ {
+			if codeSize[a] == length {
+				table.symbols = append(table.symbols, byte(a))
+			}
+		}
+	}
+	generateCodes(&table)
+	return table
+}
+
+// Huffman codes the symbols of a scan, when counting only the symbol frequencies are gathered
+type scanEncoder struct {
+	bw         *BitWriter
+	counting   bool
+	freq       [][256]int
+	encoders   []*HuffmanEncoder
+	eobrun     int
+	eobTable   int    // The table of the component the EOB run is coded with
+	correction []byte // Correction bits of the blocks in the EOB run
+}
+
+func (s *scanEncoder) symbol(table int, sym byte) {
+	if s.counting {
+		s.freq[table][sym]++
+		return
+	}
+	s.encoders[table].writeSymbol(s.bw, sym)
+}
+
+func (s *scanEncoder) bits(bits int, length int) {
+	if !s.counting {
+		s.bw.writeBits(bits, length)
+	}
+}
+
+// Codes a block of a sequential scan, the DC tables are 0 and 1 and the AC tables 2 and 3
+func (s *scanEncoder) encodeBlock(block *[64]int, prevDC *int, dcTable int, acTable int) {
+	diff := block[0] - *prevDC
+	*prevDC = block[0]
+	length := bitLength(diff)
+	s.symbol(dcTable, byte(length))
+	s.bits(coeffBits(diff, length), length)
+	zeroes := 0
+	for k := 1; k < 64; k++ {
+		coeff := block[zigzag[k]]
+		if coeff == 0 {
+			zeroes++
+			continue
+		}
+		// 0xF0 means the next 16 coeffecients are 0
+		for zeroes > 15 {
+			s.symbol(acTable, 0xF0)
+			zeroes -= 16
+		}
+		length := bitLength(coeff)
+		s.symbol(acTable, byte(zeroes<<4|length))
+		s.bits(coeffBits(coeff, length), length)
+		zeroes = 0
+	}
+	// End of block
+	if zeroes > 0 {
+		s.symbol(acTable, 0x00)
+	}
+}
+
+// Codes all blocks of a sequential scan, tables holds the (dc, ac) table ids of each plane in the scan
+func (s *scanEncoder) encodeSequentialScan(coeffs *Coefficients, planes []int, tables [][2]int) {
+	prevDC := make([]int, len(planes))
+	forEachScanBlock(coeffs, planes, func(p int, block *[64]int) {
+		s.encodeBlock(block, &prevDC[p], tables[p][0], 2+tables[p][1])
+	})
+}
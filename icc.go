@@ -0,0 +1,397 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"unicode/utf16"
+)
+
+// The identifier at the start of an APP2 ICC payload
+var iccIdentifier = []byte("ICC_PROFILE\x00")
+
+// A single APP2 chunk of an ICC profile
+type ICCChunk struct {
+	seq   int
+	count int
+	data  []byte
+}
+
+// A tone reproduction curve of a matrix/TRC profile
+type ICCCurve struct {
+	gamma    float64   // Used when table and params are empty
+	table    []float64 // Sampled curve ('curv' with more than one entry)
+	function int       // The 'para' function type
+	params   []float64 // The 'para' parameters
+}
+
+// The parts of an ICC profile needed for color management
+type ICCProfile struct {
+	data        []byte
+	version     uint32
+	class       string
+	colorSpace  string
+	pcs         string
+	description string
+	hasMatrix   bool          // The profile has rXYZ/gXYZ/bXYZ and rTRC/gTRC/bTRC
+	matrix      [3][3]float64 // Linear RGB -> XYZ (D50), the columns are rXYZ, gXYZ, bXYZ
+	trc         [3]ICCCurve
+}
+
+// Linear sRGB -> XYZ (D50), the columns are the Bradford adapted sRGB primaries
+var srgbMatrixD50 = [3][3]float64{
+	{0.4360747, 0.3850649, 0.1430804},
+	{0.2225045, 0.7168786, 0.0606169},
+	{0.0139322, 0.0971045, 0.7141733},
+}
+
+func decodeICCChunk(header *Header, data []byte) {
+	if len(data) < 2 {
+		warn(header, "ICC chunk too short")
+		return
+	}
+	chunk := ICCChunk{seq: int(data[0]), count: int(data[1]), data: data[2:]}
+	logf("ICC Chunk                    : %d/%d (%d bytes)\n", chunk.seq, chunk.count, len(chunk.data))
+	header.iccChunks = append(header.iccChunks, chunk)
+}
+
+// Reassembles the ICC profile from its chunks, checking that the sequence is complete
+func assembleICC(chunks []ICCChunk) ([]byte, error) {
+	if len(chunks) == 0 {
+		return nil, errors.New("no ICC chunks")
+	}
+	count := chunks[0].count
+	if count == 0 {
+		return nil, errors.New("ICC chunk count is 0")
+	}
+	ordered := make([]*ICCChunk, count)
+	for c := range chunks {
+		chunk := &chunks[c]
+		if chunk.count != count {
+			return nil, fmt.Errorf("ICC chunk %d gives a chunk count of %d, expected %d", chunk.seq, chunk.count, count)
+		}
+		if chunk.seq < 1 || chunk.seq > count {
+			return nil, fmt.Errorf("ICC chunk sequence number %d out of range 1-%d", chunk.seq, count)
+		}
+		if ordered[chunk.seq-1] != nil {
+			return nil, fmt.Errorf("duplicate ICC chunk %d", chunk.seq)
+		}
+		ordered[chunk.seq-1] = chunk
+	}
+	data := []byte{}
+	for c := range ordered {
+		if ordered[c] == nil {
+			return nil, fmt.Errorf("missing ICC chunk %d of %d", c+1, count)
+		}
+		data = append(data, ordered[c].data...)
+	}
+	return data, nil
+}
+
+// Helper function to read a s15Fixed16Number
+func s15Fixed16(data []byte) float64 {
+	return float64(int32(binary.BigEndian.Uint32(data))) / 65536
+}
+
+// Returns the data of a tag from the tag table or nil
+func iccTag(data []byte, sig string) []byte {
+	count := int(binary.BigEndian.Uint32(data[128:]))
+	for t := 0; t < count; t++ {
+		entry := 132 + t*12
+		if entry+12 > len(data) {
+			return nil
+		}
+		if string(data[entry:entry+4]) != sig {
+			continue
+		}
+		offset := int64(binary.BigEndian.Uint32(data[entry+4:]))
+		size := int64(binary.BigEndian.Uint32(data[entry+8:]))
+		if offset+size > int64(len(data)) || size < 8 {
+			return nil
+		}
+		return data[offset : offset+size]
+	}
+	return nil
+}
+
+// Reads the text of a 'desc' (v2) or 'mluc' (v4) tag
+func iccText(tag []byte) string {
+	if len(tag) < 12 {
+		return ""
+	}
+	switch string(tag[:4]) {
+	case "desc":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if 12+n > len(tag) || n == 0 {
+			return ""
+		}
+		return string(tag[12 : 12+n-1])
+	case "mluc":
+		if len(tag) < 28 {
+			return ""
+		}
+		// Use the first record
+		n := int(binary.BigEndian.Uint32(tag[20:]))
+		offset := int(binary.BigEndian.Uint32(tag[24:]))
+		if offset+n > len(tag) {
+			return ""
+		}
+		units := []uint16{}
+		for a := 0; a+1 < n; a += 2 {
+			units = append(units, binary.BigEndian.Uint16(tag[offset+a:]))
+		}
+		return string(utf16.Decode(units))
+	case "text":
+		return string(tag[8:])
+	}
+	return ""
+}
+
+func parseICCCurve(tag []byte) (ICCCurve, error) {
+	if tag == nil || len(tag) < 12 {
+		return ICCCurve{}, errors.New("missing TRC tag")
+	}
+	switch string(tag[:4]) {
+	case "curv":
+		n := int(binary.BigEndian.Uint32(tag[8:]))
+		if 12+n*2 > len(tag) {
+			return ICCCurve{}, errors.New("curv tag truncated")
+		}
+		if n == 0 {
+			return ICCCurve{gamma: 1}, nil
+		}
+		if n == 1 {
+			return ICCCurve{gamma: float64(binary.BigEndian.Uint16(tag[12:])) / 256}, nil
+		}
+		curve := ICCCurve{table: make([]float64, n)}
+		for a := 0; a < n; a++ {
+			curve.table[a] = float64(binary.BigEndian.Uint16(tag[12+a*2:])) / 65535
+		}
+		return curve, nil
+	case "para":
+		function := int(binary.BigEndian.Uint16(tag[8:]))
+		counts := []int{1, 3, 4, 5, 7}
+		if function >= len(counts) {
+			return ICCCurve{}, fmt.Errorf("unknown para function type (%d)", function)
+		}
+		if 12+counts[function]*4 > len(tag) {
+			return ICCCurve{}, errors.New("para tag truncated")
+		}
+		curve := ICCCurve{function: function, params: make([]float64, counts[function])}
+		for a := range curve.params {
+			curve.params[a] = s15Fixed16(tag[12+a*4:])
+		}
+		return curve, nil
+	}
+	return ICCCurve{}, fmt.Errorf("unsupported TRC type (%s)", tag[:4])
+}
+
+// Evaluates the curve for x in [0, 1], the parameters of the file may take it out of [0, 1]
+// or make it NaN, so it is clamped
+func (c *ICCCurve) eval(x float64) float64 {
+	y := c.value(x)
+	if !(y > 0) {
+		return 0
+	}
+	if y > 1 {
+		return 1
+	}
+	return y
+}
+
+func (c *ICCCurve) value(x float64) float64 {
+	if c.table != nil {
+		pos := x * float64(len(c.table)-1)
+		i := int(pos)
+		if i >= len(c.table)-1 {
+			return c.table[len(c.table)-1]
+		}
+		frac := pos - float64(i)
+		return c.table[i]*(1-frac) + c.table[i+1]*frac
+	}
+	if c.params == nil {
+		return math.Pow(x, c.gamma)
+	}
+	p := c.params
+	g := p[0]
+	switch c.function {
+	case 0:
+		return math.Pow(x, g)
+	case 1:
+		if x >= -p[2]/p[1] {
+			return math.Pow(p[1]*x+p[2], g)
+		}
+		return 0
+	case 2:
+		if x >= -p[2]/p[1] {
+			return math.Pow(p[1]*x+p[2], g) + p[3]
+		}
+		return p[3]
+	case 3:
+		if x >= p[4] {
+			return math.Pow(p[1]*x+p[2], g)
+		}
+		return p[3] * x
+	case 4:
+		if x >= p[4] {
+			return math.Pow(p[1]*x+p[2], g) + p[5]
+		}
+		return p[3]*x + p[6]
+	}
+	return x
+}
+
+func parseICCProfile(data []byte) (*ICCProfile, error) {
+	if len(data) < 132 {
+		return nil, errors.New("ICC profile too short")
+	}
+	if string(data[36:40]) != "acsp" {
+		return nil, errors.New("invalid ICC profile signature")
+	}
+	profile := &ICCProfile{
+		data:       data,
+		version:    binary.BigEndian.Uint32(data[8:]),
+		class:      string(data[12:16]),
+		colorSpace: string(data[16:20]),
+		pcs:        string(data[20:24]),
+	}
+	profile.description = iccText(iccTag(data, "desc"))
+	if profile.colorSpace != "RGB " || profile.pcs != "XYZ " {
+		return profile, nil
+	}
+	columns := []string{"rXYZ", "gXYZ", "bXYZ"}
+	curves := []string{"rTRC", "gTRC", "bTRC"}
+	for c := 0; c < 3; c++ {
+		tag := iccTag(data, columns[c])
+		if tag == nil || len(tag) < 20 || string(tag[:4]) != "XYZ " {
+			return profile, nil
+		}
+		for r := 0; r < 3; r++ {
+			profile.matrix[r][c] = s15Fixed16(tag[8+r*4:])
+		}
+		curve, err := parseICCCurve(iccTag(data, curves[c]))
+		if err != nil {
+			return profile, nil
+		}
+		profile.trc[c] = curve
+	}
+	// The conversion needs the inverse of the matrix
+	if det := determinant3x3(profile.matrix); det == 0 || math.IsNaN(det) {
+		return profile, nil
+	}
+	profile.hasMatrix = true
+	return profile, nil
+}
+
+// Assembles and parses the ICC profile once all the APPN markers have been read
+func decodeICCProfile(header *Header) {
+	if len(header.iccChunks) == 0 {
+		return
+	}
+	data, err := assembleICC(header.iccChunks)
+	if err != nil {
+		warn(header, "Invalid ICC profile: %s", err.Error())
+		return
+	}
+	profile, err := parseICCProfile(data)
+	if err != nil {
+		warn(header, "Invalid ICC profile: %s", err.Error())
+		return
+	}
+	header.icc = profile
+	logf("*** ICC Profile ***\n")
+	logf("Description                  : %s\n", profile.description)
+	logf("Version                      : %d.%d\n", profile.version>>24, (profile.version>>20)&0x0F)
+	logf("Class / Color Space / PCS    : %s / %s / %s\n", profile.class, profile.colorSpace, profile.pcs)
+	logf("Matrix/TRC                   : %t\n", profile.hasMatrix)
+}
+
+func determinant3x3(m [3][3]float64) float64 {
+	return m[0][0]*(m[1][1]*m[2][2]-m[1][2]*m[2][1]) -
+		m[0][1]*(m[1][0]*m[2][2]-m[1][2]*m[2][0]) +
+		m[0][2]*(m[1][0]*m[2][1]-m[1][1]*m[2][0])
+}
+
+// Helper function to invert a 3x3 matrix
+func invert3x3(m [3][3]float64) [3][3]float64 {
+	det := determinant3x3(m)
+	inv := [3][3]float64{}
+	inv[0][0] = (m[1][1]*m[2][2] - m[1][2]*m[2][1]) / det
+	inv[0][1] = (m[0][2]*m[2][1] - m[0][1]*m[2][2]) / det
+	inv[0][2] = (m[0][1]*m[1][2] - m[0][2]*m[1][1]) / det
+	inv[1][0] = (m[1][2]*m[2][0] - m[1][0]*m[2][2]) / det
+	inv[1][1] = (m[0][0]*m[2][2] - m[0][2]*m[2][0]) / det
+	inv[1][2] = (m[0][2]*m[1][0] - m[0][0]*m[1][2]) / det
+	inv[2][0] = (m[1][0]*m[2][1] - m[1][1]*m[2][0]) / det
+	inv[2][1] = (m[0][1]*m[2][0] - m[0][0]*m[2][1]) / det
+	inv[2][2] = (m[0][0]*m[1][1] - m[0][1]*m[1][0]) / det
+	return inv
+}
+
+// Helper function to multiply two 3x3 matrices
+func multiply3x3(a [3][3]float64, b [3][3]float64) [3][3]float64 {
+	res := [3][3]float64{}
+	for r := 0; r < 3; r++ {
+		for c := 0; c < 3; c++ {
+			for k := 0; k < 3; k++ {
+				res[r][c] += a[r][k] * b[k][c]
+			}
+		}
+	}
+	return res
+}
+
+// Tells if the image is converted from its ICC profile to sRGB, only matrix/TRC RGB profiles
+// can be converted and the others are a warning
+func convertsToSRGB(header *Header) bool {
+	if !header.options.toSRGB || header.icc == nil {
+		return false
+	}
+	if !header.icc.hasMatrix {
+		warn(header, "ICC profile is not a matrix/TRC RGB profile, not converting to sRGB")
+		return false
+	}
+	logf("Converting from ICC profile (%s) to sRGB\n", header.icc.description)
+	return true
+}
+
+// Converts the image in place from the profile's color space to sRGB
+func convertToSRGB(img *Image, profile *ICCProfile) {
+	// Linear profile RGB -> XYZ (D50) -> linear sRGB
+	m := multiply3x3(invert3x3(srgbMatrixD50), profile.matrix)
+	// Lookup tables for decoding the input and encoding the output
+	linear := [3][256]float64{}
+	for c := 0; c < 3; c++ {
+		for a := 0; a < 256; a++ {
+			linear[c][a] = profile.trc[c].eval(float64(a) / 255)
+		}
+	}
+	const encodeSize = 4096
+	encode := [encodeSize + 1]byte{}
+	for a := 0; a <= encodeSize; a++ {
+		v := float64(a) / encodeSize
+		if v <= 0.0031308 {
+			v *= 12.92
+		} else {
+			v = 1.055*math.Pow(v, 1/2.4) - 0.055
+		}
+		encode[a] = byte(math.Round(v * 255))
+	}
+	for p := 0; p < len(img.pix); p += 3 {
+		r := linear[0][img.pix[p]]
+		g := linear[1][img.pix[p+1]]
+		b := linear[2][img.pix[p+2]]
+		for c := 0; c < 3; c++ {
+			v := m[c][0]*r + m[c][1]*g + m[c][2]*b
+			// NaN is not less than 0 either
+			if !(v > 0) {
+				v = 0
+			}
+			if v > 1 {
+				v = 1
+			}
+			img.pix[p+c] = encode[int(v*encodeSize+0.5)]
+		}
+	}
+}
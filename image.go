@@ -0,0 +1,57 @@
+package main
+
+// A decoded image with 3 bytes (r, g, b) per pixel stored top-down
+type Image struct {
+	width  int
+	height int
+	pix    []byte
+}
+
+func newImage(width int, height int) *Image {
+	return &Image{
+		width:  width,
+		height: height,
+		pix:    make([]byte, width*height*3),
+	}
+}
+
+// Applies an EXIF orientation (1-8) so the image is displayed upright
+func orientImage(img *Image, orientation int) *Image {
+	if orientation <= 1 || orientation > 8 {
+		return img
+	}
+	w := img.width
+	h := img.height
+	var res *Image
+	// Orientations 5-8 swap the width and the height
+	if orientation >= 5 {
+		res = newImage(h, w)
+	} else {
+		res = newImage(w, h)
+	}
+	for y := 0; y < h; y++ {
+		for x := 0; x < w; x++ {
+			var dx, dy int
+			switch orientation {
+			case 2: // flip horizontal
+				dx, dy = w-1-x, y
+			case 3: // rotate 180
+				dx, dy = w-1-x, h-1-y
+			case 4: // flip vertical
+				dx, dy = x, h-1-y
+			case 5: // transpose
+				dx, dy = y, x
+			case 6: // rotate 90 clockwise
+				dx, dy = h-1-y, x
+			case 7: // transverse
+				dx, dy = h-1-y, w-1-x
+			case 8: // rotate 270 clockwise
+				dx, dy = y, w-1-x
+			}
+			src := (x + y*w) * 3
+			dst := (dx + dy*res.width) * 3
+			copy(res.pix[dst:dst+3], img.pix[src:src+3])
+		}
+	}
+	return res
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Where the decoder can start in the scan of a baseline image
+type IndexEntry struct {
+	mcu    int    // The first MCU after the entry
+	offset int64  // The offset in the file of the byte that holds the first bit of the MCU
+	bit    int    // The bits of that byte that belong to the MCU before
+	dc     [3]int // The DC predictors of the components before the MCU
+}
+
+// The restart intervals of the only scan of a baseline image. With a restart interval there
+// is an entry after every RSTn marker, where the predictors are 0; without one there is an
+// entry at the start of every MCU row with the predictors decoded so far.
+type RestartIndex struct {
+	size     int64 // The size of the file the index was built from
+	mcusWide int
+	mcusHigh int
+	interval int   // The restart interval, 0 without DRI
+	end      int64 // The offset of the marker after the scan
+	entries  []IndexEntry
+}
+
+// Scans a baseline file with a single scan once and returns its restart index. With a
+// restart interval the data is only searched for the RSTn markers, without one the MCUs
+// are entropy decoded but not kept.
+func buildIndex(r io.ReaderAt, size int64, filename string, options *Options) (*RestartIndex, error) {
+	indexOptions := *options
+	indexOptions.buildIndex = true
+	indexOptions.coefficientsOnly = true
+	indexOptions.tolerant = false
+	indexOptions.region = nil
+	indexOptions.rows = nil
+	indexOptions.index = nil
+	header, err := newDecoder(&indexOptions).decodeAt(r, size, filename)
+	if err != nil {
+		return nil, err
+	}
+	if header.index == nil {
+		return nil, fmt.Errorf("The file has no scan")
+	}
+	return header.index, nil
+}
+
+// Decodes a file the decoder can seek in with the help of its restart index: the region of
+// the options starts at the restart intervals before its MCU rows instead of reading the
+// scan up to them, and with more than one worker the restart intervals are decoded in
+// parallel. Otherwise (and in tolerant mode) the index isn't used.
+func decodeJPEGIndexed(r io.ReaderAt, size int64, filename string, index *RestartIndex, options *Options) (*Header, error) {
+	indexOptions := *options
+	indexOptions.index = index
+	return newDecoder(&indexOptions).decodeAt(r, size, filename)
+}
+
+// Decodes a JPEG from a file it can seek in, returns an error instead of exiting
+func (d *Decoder) decodeAt(r io.ReaderAt, size int64, filename string) (header *Header, err error) {
+	header = newHeader(bufio.NewReader(io.NewSectionReader(r, 0, size)), filename, d.options)
+	header.decoder = d
+	header.buffer.panics = true
+	header.buffer.file = r
+	header.buffer.size = size
+	defer recoverDecodeError(&err)
+	decodeMarkers(header)
+	return header, nil
+}
+
+// Records the entries of header.index while the first scan is read
+func indexScan(header *Header, scan *scanReader, mcusWide int, mcusHigh int) {
+	if header.frameType != SOF0 || header.scanCount > 0 || header.componentsInScan != len(header.cComponents) {
+		fail(header, "Only baseline images with a single scan can be indexed")
+	}
+	interval := header.restartInterval
+	index := &RestartIndex{size: header.buffer.size, mcusWide: mcusWide, mcusHigh: mcusHigh, interval: interval}
+	header.index = index
+	br := &BitReader{data: &scan.data, fill: scan.fill}
+	prevDC := [3]int{0, 0, 0}
+	skips := 0
+	add := func(mcu int) {
+		offset, bit := scan.position(br)
+		index.entries = append(index.entries, IndexEntry{mcu: mcu, offset: offset, bit: bit, dc: prevDC})
+	}
+	if interval > 0 {
+		for mcu := 0; mcu < mcusWide*mcusHigh; mcu += interval {
+			if mcu > 0 {
+				marker := scan.skipToMarker(br)
+				expected := RST0 + byte((mcu/interval-1)%8)
+				if marker != expected {
+					fail(header, "Expected a restart marker (0xFF%X) but found (0xFF%X)", expected, marker)
+				}
+				scan.resume()
+			}
+			add(mcu)
+		}
+		return
+	}
+	for my := 0; my < mcusHigh; my++ {
+		add(my * mcusWide)
+		for mx := 0; mx < mcusWide; mx++ {
+			decodeMCU(header, br, mx, my, &prevDC, &skips)
+		}
+	}
+}
+
+// Returns the last entry at or before the MCU
+func (index *RestartIndex) find(mcu int) IndexEntry {
+	a := sort.Search(len(index.entries), func(a int) bool { return index.entries[a].mcu > mcu })
+	return index.entries[a-1]
+}
+
+// Fails if the index was built from another file
+func checkIndex(header *Header, mcusWide int, mcusHigh int) {
+	index := header.options.index
+	if header.buffer.file == nil {
+		fail(header, "The restart index needs a file the decoder can seek in")
+	}
+	if index.size != header.buffer.size || index.mcusWide != mcusWide || index.mcusHigh != mcusHigh ||
+		index.interval != header.restartInterval || header.scanCount > 0 || header.componentsInScan != len(header.cComponents) {
+		fail(header, "The index doesn't match the file")
+	}
+}
+
+// Decodes the first scan of a baseline image with the help of the index: the MCU rows of the
+// region, or the restart intervals in parallel
+func decodeIndexed(header *Header, scan *scanReader, mcusWide int, mcusHigh int, windowed bool, win window) {
+	checkIndex(header, mcusWide, mcusHigh)
+	if windowed {
+		part := newIndexedScan(header, scan)
+		for my := win.y0; my < win.y1; my++ {
+			part.decode(my*mcusWide+win.x0, my*mcusWide+win.x1)
+		}
+		return
+	}
+	entries := header.options.index.entries
+	workers := header.options.workers
+	if workers > len(entries) {
+		workers = len(entries)
+	}
+	// Every worker reads the file with its own buffer, the panics of the failed ones are passed on
+	failures := make([]interface{}, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		first := entries[w*len(entries)/workers].mcu
+		end := mcusWide * mcusHigh
+		if w+1 < workers {
+			end = entries[(w+1)*len(entries)/workers].mcu
+		}
+		wg.Add(1)
+		go func(w int, first int, end int) {
+			defer wg.Done()
+			defer func() { failures[w] = recover() }()
+			buf := &Buffer{panics: header.buffer.panics, file: header.buffer.file, size: header.buffer.size}
+			newIndexedScan(header, &scanReader{header: header, buffer: buf}).decode(first, end)
+		}(w, first, end)
+	}
+	wg.Wait()
+	for _, failure := range failures {
+		if failure != nil {
+			panic(failure)
+		}
+	}
+	// The markers after the scan are read from the end of its data
+	header.buffer.seek(header.options.index.end)
+	*scan = scanReader{header: header, buffer: header.buffer}
+}
+
+// Decodes runs of MCUs of the scan, starting at the entries of the index
+type indexedScan struct {
+	header    *Header
+	index     *RestartIndex
+	scan      *scanReader
+	br        *BitReader
+	mcu       int  // The next MCU of the data, -1 before the first entry
+	restarted bool // Is the data after the RSTn marker before mcu
+	prevDC    [3]int
+	skips     int
+}
+
+func newIndexedScan(header *Header, scan *scanReader) *indexedScan {
+	return &indexedScan{
+		header: header,
+		index:  header.options.index,
+		scan:   scan,
+		br:     &BitReader{data: &scan.data, fill: scan.fill},
+		mcu:    -1,
+	}
+}
+
+// Decodes the MCUs [first, end). The data continues where the last run ended when that is
+// between the entry before first and first, else it starts at the entry.
+func (is *indexedScan) decode(first int, end int) {
+	e := is.index.find(first)
+	if is.mcu < e.mcu || is.mcu > first {
+		is.scan.seek(is.br, e)
+		is.mcu = e.mcu
+		is.restarted = true
+		is.prevDC = e.dc
+		is.skips = 0
+	}
+	interval := is.index.interval
+	for ; is.mcu < end; is.mcu++ {
+		mcu := is.mcu
+		if interval > 0 && mcu%interval == 0 && !is.restarted {
+			marker := is.scan.skipToMarker(is.br)
+			expected := RST0 + byte((mcu/interval-1)%8)
+			if marker != expected {
+				fail(is.header, "Expected a restart marker (0xFF%X) but found (0xFF%X)", expected, marker)
+			}
+			is.scan.resume()
+			is.br.exhausted = false
+			is.prevDC = [3]int{0, 0, 0}
+			is.skips = 0
+		}
+		is.restarted = false
+		decodeMCU(is.header, is.br, mcu%is.index.mcusWide, mcu/is.index.mcusWide, &is.prevDC, &is.skips)
+	}
+}
+
+// The sidecar file of an index starts with the magic and its version
+var indexMagic = []byte("JRSTIDX\x01")
+
+const (
+	indexHeaderSize = 8 + 8 + 4 + 4 + 4 + 8 + 4
+	indexEntrySize  = 4 + 8 + 1 + 3*4
+)
+
+// Writes the index as big endian integers: the size of the file, the MCUs across and down,
+// the restart interval, the end of the scan and the entries
+func writeIndex(w io.Writer, index *RestartIndex) error {
+	data := make([]byte, indexHeaderSize, indexHeaderSize+len(index.entries)*indexEntrySize)
+	copy(data, indexMagic)
+	binary.BigEndian.PutUint64(data[8:], uint64(index.size))
+	binary.BigEndian.PutUint32(data[16:], uint32(index.mcusWide))
+	binary.BigEndian.PutUint32(data[20:], uint32(index.mcusHigh))
+	binary.BigEndian.PutUint32(data[24:], uint32(index.interval))
+	binary.BigEndian.PutUint64(data[28:], uint64(index.end))
+	binary.BigEndian.PutUint32(data[36:], uint32(len(index.entries)))
+	entry := make([]byte, indexEntrySize)
+	for _, e := range index.entries {
+		binary.BigEndian.PutUint32(entry[0:], uint32(e.mcu))
+		binary.BigEndian.PutUint64(entry[4:], uint64(e.offset))
+		entry[12] = byte(e.bit)
+		for c := range e.dc {
+			binary.BigEndian.PutUint32(entry[13+c*4:], uint32(int32(e.dc[c])))
+		}
+		data = append(data, entry...)
+	}
+	_, err := w.Write(data)
+	return err
+}
+
+// Reads an index written by writeIndex, the entries have to be in order inside the file
+func readIndex(r io.Reader) (*RestartIndex, error) {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < indexHeaderSize || !bytes.Equal(data[:8], indexMagic) {
+		return nil, fmt.Errorf("Not a restart index")
+	}
+	index := &RestartIndex{
+		size:     int64(binary.BigEndian.Uint64(data[8:])),
+		mcusWide: int(binary.BigEndian.Uint32(data[16:])),
+		mcusHigh: int(binary.BigEndian.Uint32(data[20:])),
+		interval: int(binary.BigEndian.Uint32(data[24:])),
+		end:      int64(binary.BigEndian.Uint64(data[28:])),
+	}
+	count := int(binary.BigEndian.Uint32(data[36:]))
+	if len(data)-indexHeaderSize != count*indexEntrySize || count == 0 {
+		return nil, fmt.Errorf("The restart index has %d bytes of entries, expected %d", len(data)-indexHeaderSize, count*indexEntrySize)
+	}
+	if index.size < 0 || index.end < 0 || index.end >= index.size {
+		return nil, fmt.Errorf("Invalid end of the scan (%d) in the restart index", index.end)
+	}
+	index.entries = make([]IndexEntry, count)
+	for a := range index.entries {
+		entry := data[indexHeaderSize+a*indexEntrySize:]
+		e := &index.entries[a]
+		e.mcu = int(binary.BigEndian.Uint32(entry[0:]))
+		e.offset = int64(binary.BigEndian.Uint64(entry[4:]))
+		e.bit = int(entry[12])
+		for c := range e.dc {
+			e.dc[c] = int(int32(binary.BigEndian.Uint32(entry[13+c*4:])))
+		}
+		if (a == 0 && e.mcu != 0) || (a > 0 && e.mcu <= index.entries[a-1].mcu) || e.mcu >= index.mcusWide*index.mcusHigh ||
+			e.offset < 0 || e.offset > index.end || e.bit > 7 {
+			return nil, fmt.Errorf("Invalid entry %d in the restart index", a)
+		}
+	}
+	return index, nil
+}
+
+// Decodes a file with the index in its sidecar file
+func decodeIndexedFile(decoder *Decoder, filename string) *Header {
+	sidecar, err := os.Open(filename + ".idx")
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	index, err := readIndex(bufio.NewReader(sidecar))
+	sidecar.Close()
+	if err != nil {
+		fmt.Printf("Error! %s: %s\n", filename+".idx", err.Error())
+		os.Exit(1)
+	}
+	file, err := os.Open(filename)
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer file.Close()
+	stat, _ := file.Stat()
+	_filename, err := filepath.Abs(filename)
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	decoder.options.index = index
+	header, err := decoder.decodeAt(file, stat.Size(), _filename)
+	decoder.options.index = nil
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	header.filesize = uint(stat.Size())
+	return header
+}
@@ -0,0 +1,155 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// The index survives its sidecar file, the regions and the parallel decodes that jump to its
+// entries give the pixels of the whole image
+func checkIndexedDecodes(t *testing.T, data []byte) {
+	index, err := buildIndex(bytes.NewReader(data), int64(len(data)), "index.jpg", &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var sidecar bytes.Buffer
+	if err := writeIndex(&sidecar, index); err != nil {
+		t.Fatal(err)
+	}
+	read, err := readIndex(&sidecar)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, index) {
+		t.Fatalf("the index read back differs")
+	}
+	checkRegionsWith(t, data, func(r Region) (*Header, error) {
+		return decodeJPEGIndexed(bytes.NewReader(data), int64(len(data)), "region.jpg", index, &Options{region: &r})
+	})
+	whole, err := decodeJPEGSafe(bytes.NewReader(data), "whole.jpg", &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, workers := range []int{2, 3, 64} {
+		header, err := decodeJPEGIndexed(bytes.NewReader(data), int64(len(data)), "parallel.jpg", index, &Options{workers: workers})
+		if err != nil {
+			t.Fatalf("%d workers: %v", workers, err)
+		}
+		if !bytes.Equal(header.image.pix, whole.image.pix) {
+			t.Errorf("%d workers: the image differs from the one decoded in order", workers)
+		}
+	}
+}
+
+func TestIndex(t *testing.T) {
+	logOutput = io.Discard
+	defer func() { logOutput = os.Stdout }()
+	names := []string{"testdata/rows/gray-22.jpg"}
+	for _, pattern := range []string{"test/*.jpg", fixtureDir + "/*.jpg"} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, matches...)
+	}
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if _, err := buildIndex(bytes.NewReader(data), int64(len(data)), name, &Options{}); err != nil {
+				// Progressive files and files with more than one scan
+				t.Skip(err)
+			}
+			checkIndexedDecodes(t, data)
+		})
+	}
+	data, err := os.ReadFile("test/cat0.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sampling := range []string{"444", "422", "440", "420"} {
+		for _, restart := range []int{0, 1, 7} {
+			checkIndexedDecodes(t, restartJPEG(t, data, restart, true, sampling))
+		}
+	}
+}
+
+// Counts the bytes read from a file
+type countingReaderAt struct {
+	r     io.ReaderAt
+	bytes int
+}
+
+func (c *countingReaderAt) ReadAt(p []byte, offset int64) (int, error) {
+	n, err := c.r.ReadAt(p, offset)
+	c.bytes += n
+	return n, err
+}
+
+// A region at the end of the image starts at the restart interval before it instead of
+// reading the scan up to it
+func TestIndexRegionJumps(t *testing.T) {
+	logOutput = io.Discard
+	defer func() { logOutput = os.Stdout }()
+	data, err := os.ReadFile("test/cat0.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, restart := range []int{0, 2} {
+		data := restartJPEG(t, data, restart, true, "420")
+		index, err := buildIndex(bytes.NewReader(data), int64(len(data)), "index.jpg", &Options{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		header, err := decodeJPEGSafe(bytes.NewReader(data), "index.jpg", &Options{metadataOnly: true})
+		if err != nil {
+			t.Fatal(err)
+		}
+		r := Region{header.width - 16, header.height - 16, 16, 16}
+		file := &countingReaderAt{r: bytes.NewReader(data)}
+		if _, err := decodeJPEGIndexed(file, int64(len(data)), "region.jpg", index, &Options{region: &r}); err != nil {
+			t.Fatal(err)
+		}
+		if file.bytes > len(data)/2 {
+			t.Errorf("restart interval %d: read %d of %d bytes for the last MCUs", restart, file.bytes, len(data))
+		}
+	}
+}
+
+func TestIndexErrors(t *testing.T) {
+	logOutput = io.Discard
+	defer func() { logOutput = os.Stdout }()
+	data, err := os.ReadFile("test/cat0.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	restarts := restartJPEG(t, data, 4, true, "420")
+	index, err := buildIndex(bytes.NewReader(restarts), int64(len(restarts)), "index.jpg", &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	other := restartJPEG(t, data, 5, true, "420")
+	if _, err := decodeJPEGIndexed(bytes.NewReader(other), int64(len(other)), "other.jpg", index, &Options{workers: 2}); err == nil {
+		t.Errorf("expected an error for the index of another file")
+	}
+	progressive, err := os.ReadFile("test/p/huey.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := buildIndex(bytes.NewReader(progressive), int64(len(progressive)), "p.jpg", &Options{}); err == nil {
+		t.Errorf("expected an error for a progressive file")
+	}
+	var sidecar bytes.Buffer
+	if err := writeIndex(&sidecar, index); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := readIndex(bytes.NewReader(sidecar.Bytes()[:sidecar.Len()-1])); err == nil {
+		t.Errorf("expected an error for a truncated index")
+	}
+}
@@ -0,0 +1,204 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+)
+
+// The identifiers at the start of an APP0 payload
+var jfifIdentifier = []byte("JFIF\x00")
+var jfxxIdentifier = []byte("JFXX\x00")
+
+// JFIF density units
+const (
+	densityAspect = 0 // No units, the densities only give the pixel aspect ratio
+	densityInch   = 1 // Dots per inch
+	densityCm     = 2 // Dots per centimeter
+)
+
+// JFXX thumbnail formats
+const (
+	jfxxJPEG    = 0x10
+	jfxxPalette = 0x11
+	jfxxRGB     = 0x13
+)
+
+// The contents of an APP0 JFIF segment
+type JFIF struct {
+	versionMajor int
+	versionMinor int
+	units        int
+	xDensity     int
+	yDensity     int
+	thumbnail    *Image // The uncompressed thumbnail, nil if there is none
+}
+
+// The contents of an APP0 JFXX extension segment
+type JFXX struct {
+	extension byte
+	thumbnail *Image // Set for palette and RGB thumbnails
+	jpeg      []byte // Set for JPEG thumbnails
+}
+
+// The pixel density of an image in dots per inch, zero if unknown
+type Density struct {
+	x float64
+	y float64
+}
+
+func (d Density) known() bool {
+	return d.x > 0 && d.y > 0
+}
+
+func parseJFIF(data []byte) (*JFIF, error) {
+	if len(data) < 9 {
+		return nil, errors.New("JFIF segment too short")
+	}
+	jfif := &JFIF{
+		versionMajor: int(data[0]),
+		versionMinor: int(data[1]),
+		units:        int(data[2]),
+		xDensity:     (int(data[3]) << 8) + int(data[4]),
+		yDensity:     (int(data[5]) << 8) + int(data[6]),
+	}
+	tw := int(data[7])
+	th := int(data[8])
+	if tw > 0 && th > 0 {
+		pixels := data[9:]
+		if len(pixels) < tw*th*3 {
+			return nil, fmt.Errorf("JFIF thumbnail (%dx%d) truncated", tw, th)
+		}
+		jfif.thumbnail = newImage(tw, th)
+		copy(jfif.thumbnail.pix, pixels)
+	}
+	return jfif, nil
+}
+
+func parseJFXX(data []byte) (*JFXX, error) {
+	if len(data) < 1 {
+		return nil, errors.New("JFXX segment too short")
+	}
+	jfxx := &JFXX{extension: data[0]}
+	data = data[1:]
+	switch jfxx.extension {
+	case jfxxJPEG:
+		if len(data) < 2 || data[0] != 0xFF || data[1] != SOI {
+			return nil, errors.New("JFXX JPEG thumbnail does not start with SOI")
+		}
+		jfxx.jpeg = data
+	case jfxxPalette, jfxxRGB:
+		if len(data) < 2 {
+			return nil, errors.New("JFXX thumbnail dimensions missing")
+		}
+		tw := int(data[0])
+		th := int(data[1])
+		data = data[2:]
+		img := newImage(tw, th)
+		if jfxx.extension == jfxxRGB {
+			if len(data) < tw*th*3 {
+				return nil, fmt.Errorf("JFXX RGB thumbnail (%dx%d) truncated", tw, th)
+			}
+			copy(img.pix, data)
+		} else {
+			if len(data) < 768+tw*th {
+				return nil, fmt.Errorf("JFXX palette thumbnail (%dx%d) truncated", tw, th)
+			}
+			palette := data[:768]
+			for a := 0; a < tw*th; a++ {
+				index := int(data[768+a]) * 3
+				copy(img.pix[a*3:a*3+3], palette[index:index+3])
+			}
+		}
+		jfxx.thumbnail = img
+	default:
+		return nil, fmt.Errorf("unknown JFXX extension code (0x%X)", jfxx.extension)
+	}
+	return jfxx, nil
+}
+
+func decodeAPP0(header *Header, data []byte) {
+	if bytes.HasPrefix(data, jfifIdentifier) {
+		jfif, err := parseJFIF(data[len(jfifIdentifier):])
+		if err != nil {
+			warn(header, "Invalid JFIF segment: %s", err.Error())
+			return
+		}
+		header.jfif = jfif
+		logf("JFIF Version                 : %d.%02d\n", jfif.versionMajor, jfif.versionMinor)
+		logf("Density                      : %dx%d (units %d)\n", jfif.xDensity, jfif.yDensity, jfif.units)
+		if jfif.thumbnail != nil {
+			logf("Thumbnail                    : %dx%d RGB\n", jfif.thumbnail.width, jfif.thumbnail.height)
+		}
+	} else if bytes.HasPrefix(data, jfxxIdentifier) {
+		jfxx, err := parseJFXX(data[len(jfxxIdentifier):])
+		if err != nil {
+			warn(header, "Invalid JFXX segment: %s", err.Error())
+			return
+		}
+		// Only the first extension segment is used
+		if header.jfxx == nil {
+			header.jfxx = jfxx
+		}
+		logf("JFXX Thumbnail               : 0x%X\n", jfxx.extension)
+	}
+}
+
+// Returns the pixel density of the image, from the JFIF segment or else from the EXIF resolution tags
+func imageDensity(header *Header) Density {
+	if jfif := header.jfif; jfif != nil && jfif.xDensity > 0 && jfif.yDensity > 0 {
+		switch jfif.units {
+		case densityInch:
+			return Density{x: float64(jfif.xDensity), y: float64(jfif.yDensity)}
+		case densityCm:
+			return Density{x: float64(jfif.xDensity) * 2.54, y: float64(jfif.yDensity) * 2.54}
+		}
+	}
+	if exif := header.exif; exif != nil {
+		xRes := findTag(exif.ifd0, tagXResolution)
+		yRes := findTag(exif.ifd0, tagYResolution)
+		if xRes != nil && yRes != nil {
+			// The resolution unit defaults to inches
+			scale := 1.0
+			if unit := findTag(exif.ifd0, tagResolutionUnit); unit != nil {
+				switch unit.intValue(0) {
+				case 2:
+					scale = 1.0
+				case 3:
+					scale = 2.54
+				default:
+					return Density{}
+				}
+			}
+			return Density{x: xRes.floatValue(0) * scale, y: yRes.floatValue(0) * scale}
+		}
+	}
+	return Density{}
+}
+
+// Returns the embedded thumbnail of the image decoded into an Image.
+// The JFIF thumbnail is preferred, then the JFXX thumbnail and then the EXIF thumbnail.
+func thumbnailImage(header *Header) *Image {
+	var thumb *Image
+	var data []byte
+	if header.jfif != nil && header.jfif.thumbnail != nil {
+		thumb = header.jfif.thumbnail
+	} else if header.jfxx != nil && header.jfxx.thumbnail != nil {
+		thumb = header.jfxx.thumbnail
+	} else if header.jfxx != nil {
+		data = header.jfxx.jpeg
+	} else if header.exif != nil {
+		data = header.exif.thumbnail()
+	}
+	if data != nil {
+		logf("*** Decoding embedded JPEG thumbnail ***\n")
+		options := *header.options
+		options.autoOrient = false
+		thumb = decodeJPEGReader(bytes.NewReader(data), header.filename, &options).image
+	}
+	// The thumbnail shares the orientation of the main image
+	if thumb != nil && header.options.autoOrient && header.exif != nil {
+		thumb = orientImage(thumb, header.exif.orientation())
+	}
+	return thumb
+}
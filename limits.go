@@ -0,0 +1,96 @@
+package main
+
+import (
+	"flag"
+	"unsafe"
+)
+
+// Limits on the resources a decode may use, hostile files fail with an error before
+// anything is allocated for them. A zero field means no limit.
+type Limits struct {
+	maxPixels      int64 // The width * height of the frame
+	maxMemory      int64 // The bytes allocated for the blocks and the decoded image
+	maxScans       int   // The number of scans
+	maxSegmentSize int   // The payload of a single APPn, COM or skipped segment
+	maxMetadata    int64 // The total payload of the APPn and COM segments
+}
+
+// The limits of the command line, enough for a 100 megapixel photo
+var defaultLimits = Limits{
+	maxPixels:   100000000,
+	maxMemory:   4 << 30,
+	maxScans:    256,
+	maxMetadata: 64 << 20,
+}
+
+// Adds the flags that set the limits, they default to defaultLimits
+func limitFlags(flags *flag.FlagSet, limits *Limits) {
+	*limits = defaultLimits
+	flags.Int64Var(&limits.maxPixels, "max-pixels", limits.maxPixels, "the largest width * height that is decoded, 0 for no limit")
+	flags.Int64Var(&limits.maxMemory, "max-memory", limits.maxMemory, "the most bytes a decode may allocate, 0 for no limit")
+	flags.IntVar(&limits.maxScans, "max-scans", limits.maxScans, "the most scans a file may have, 0 for no limit")
+	flags.IntVar(&limits.maxSegmentSize, "max-segment", limits.maxSegmentSize, "the largest APPn or COM segment, 0 for no limit")
+	flags.Int64Var(&limits.maxMetadata, "max-metadata", limits.maxMetadata, "the most bytes of APPn and COM segments, 0 for no limit")
+}
+
+// Estimates the bytes that decoding the frame allocates: the blocks, a copy of the
+// blocks for previews, the image (or the region, or an MCU row of a streamed image) and a
+// copy of the image to orient it
+func decodeMemory(header *Header) int64 {
+	blocks := int64(header.blockCount) * int64(unsafe.Sizeof([64]int16{}))
+	if header.options.preview != nil {
+		blocks *= 2
+	}
+	if header.options.coefficientsOnly {
+		return blocks
+	}
+	image := int64(header.width) * int64(header.height) * 3
+	if header.region != nil {
+		image = int64(header.region.width) * int64(header.region.height) * 3
+	} else if header.streaming {
+		// The rows of one MCU row
+		image = int64(header.width) * int64(header.cComponents[0].vSamplingFactor*8) * 3
+	}
+	if header.options.autoOrient {
+		image *= 2
+	}
+	return blocks + image
+}
+
+// Fails if the frame is larger than the limits allow, called before the blocks are allocated
+func checkFrameLimits(header *Header) {
+	limits := &header.options.limits
+	pixels := int64(header.width) * int64(header.height)
+	if limits.maxPixels > 0 && pixels > limits.maxPixels {
+		fail(header, "The image is %dx%d (%d pixels), the limit is %d pixels",
+			header.width, header.height, pixels, limits.maxPixels)
+	}
+	memory := decodeMemory(header)
+	if limits.maxMemory > 0 && memory > limits.maxMemory {
+		fail(header, "Decoding the %dx%d image needs %d bytes, the limit is %d bytes",
+			header.width, header.height, memory, limits.maxMemory)
+	}
+}
+
+// Fails if a segment is larger than the limits allow, called before the payload is read
+func checkSegmentLimits(header *Header, marker byte, length int) {
+	limits := &header.options.limits
+	if limits.maxSegmentSize > 0 && length > limits.maxSegmentSize {
+		fail(header, "The segment (0xFF%X) is %d bytes, the limit is %d bytes", marker, length, limits.maxSegmentSize)
+	}
+	if (marker < APP0 || marker > APP15) && marker != COM {
+		return
+	}
+	header.metadataSize += int64(length)
+	if limits.maxMetadata > 0 && header.metadataSize > limits.maxMetadata {
+		fail(header, "The APPn and COM segments are more than %d bytes", limits.maxMetadata)
+	}
+}
+
+// Fails if the file has more scans than the limits allow
+func checkScanLimit(header *Header) {
+	limits := &header.options.limits
+	if limits.maxScans > 0 && header.scanCount >= limits.maxScans {
+		fail(header, "The file has more than %d scans", limits.maxScans)
+	}
+}
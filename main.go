@@ -1,47 +1,115 @@
 package main
 
 import (
-	"dec/zmap"
+	"bufio"
+	"bytes"
+	"flag"
 	"fmt"
+	"io"
 	"math"
 	"os"
-	"path"
-	"strings"
 )
 
+// Where the progress of the decoder is written to
+var logOutput io.Writer = os.Stdout
+
+// Helper function to print the progress of the decoder
+func logf(format string, a ...interface{}) {
+	fmt.Fprintf(logOutput, format, a...)
+}
+
 type Buffer struct {
-	bf [2]byte
-	f  *os.File
+	bf        [2]byte
+	r         io.ByteReader
+	pos       int64 // The number of bytes read so far
+	panics    bool  // Panic with a decodeError instead of exiting on errors
+	tolerant  bool  // End a truncated file with an end-of-image marker
+	truncated int   // The number of bytes made up after the end of a truncated file
+	// The file when the buffer can seek in it and its size, see seek
+	file io.ReaderAt
+	size int64
+}
+
+// Continues reading at offset of the file, bf[0] is the byte at offset
+func (bf *Buffer) seek(offset int64) {
+	bf.r = bufio.NewReader(io.NewSectionReader(bf.file, offset, bf.size-offset))
+	bf.pos = offset
+	bf.advance()
 }
 
 func (bf *Buffer) advance() {
-	data := make([]byte, 1)
-	_, err := bf.f.Read(data)
+	data, err := bf.r.ReadByte()
+	// In tolerant mode the data is ended with (0xFF, EOI) so that the decoded part is rendered
+	if err != nil && bf.tolerant {
+		data = []byte{0xFF, EOI}[bf.truncated%2]
+		bf.truncated++
+		bf.bf[1] = bf.bf[0]
+		bf.bf[0] = data
+		return
+	}
 	// Since we need to read the EOI marker before we get to the end of the file
 	// We just os.Exit(1) if we get get to the end of file first
+	if err != nil && bf.panics {
+		panic(decodeError{err})
+	}
 	if err != nil {
 		fmt.Printf("Error! %s\n", err.Error())
 		os.Exit(1)
 	}
+	bf.pos++
 	bf.bf[1] = bf.bf[0]
-	bf.bf[0] = data[0]
+	bf.bf[0] = data
 }
 
-func decodeAPPN(header *Header) {
-	fmt.Printf("** Decoding APPN Marker (0xFF%X) **\n", header.buffer.bf[0])
+// Helper function to read the payload of a marker segment
+func readSegment(header *Header) []byte {
 	buf := header.buffer
+	marker := buf.bf[0]
 	buf.advance()
 	buf.advance()
 	// Length includes the 2 bytes that give you the length
 	length := (int(buf.bf[1]) << 8) + int(buf.bf[0]) - 2
+	if length < 0 {
+		fail(header, "Invalid segment length (%d)", length+2)
+	}
+	checkSegmentLimits(header, marker, length)
+	data := make([]byte, length)
 	for a := 0; a < length; a++ {
 		buf.advance()
+		data[a] = buf.bf[0]
+	}
+	return data
+}
+
+func decodeAPPN(header *Header) {
+	marker := header.buffer.bf[0]
+	logf("** Decoding APPN Marker (0xFF%X) **\n", marker)
+	data := readSegment(header)
+	header.segments = append(header.segments, Segment{marker: marker, data: data})
+	if marker == APP0 {
+		decodeAPP0(header, data)
+	} else if marker == APP1 && bytes.HasPrefix(data, exifIdentifier) {
+		decodeExif(header, data[len(exifIdentifier):])
+	} else if marker == APP1 && bytes.HasPrefix(data, xmpIdentifier) {
+		header.xmpPacket = data[len(xmpIdentifier):]
+		logf("XMP Packet                   : %d bytes\n", len(header.xmpPacket))
+	} else if marker == APP1 && bytes.HasPrefix(data, xmpExtensionIdentifier) {
+		decodeXMPExtension(header, data[len(xmpExtensionIdentifier):])
+	} else if marker == APP2 && bytes.HasPrefix(data, mpfIdentifier) {
+		// The offsets in the MP index are relative to the byte after the identifier
+		offset := header.buffer.pos - int64(len(data)) + int64(len(mpfIdentifier))
+		decodeMPF(header, data[len(mpfIdentifier):], offset)
+	} else if marker == APP2 && bytes.HasPrefix(data, iccIdentifier) {
+		decodeICCChunk(header, data[len(iccIdentifier):])
+	} else if marker == APP13 && bytes.HasPrefix(data, photoshopIdentifier) {
+		// The resource blocks may continue in the next APP13 segment
+		header.photoshop = append(header.photoshop, data[len(photoshopIdentifier):]...)
 	}
 }
 
 func decodeQuantizationTables(header *Header) {
 	buf := header.buffer
-	fmt.Printf("** Decoding the DQT Marker (0xFF%X) **\n", buf.bf[0])
+	logf("** Decoding the DQT Marker (0xFF%X) **\n", buf.bf[0])
 	buf.advance()
 	buf.advance()
 	length := (int(buf.bf[1]) << 8) + int(buf.bf[0]) - 2
@@ -53,39 +121,47 @@ func decodeQuantizationTables(header *Header) {
 		tableId := int(buf.bf[0] & 0x0F)
 		length -= 1
 		if tableId > 3 {
-			fmt.Printf("Error! Ivalid TableId: %d\n", tableId)
-			os.Exit(1)
+			fail(header, "Ivalid TableId: %d", tableId)
 		}
 		// If the upper nibble is non-zero then the table is 16bit
-		bit16 := (buf.bf[0] >> 4) != 0
-		table := [64]byte{}
+		precision := buf.bf[0] >> 4
+		bit16 := precision != 0
+		table := [64]uint16{}
 		if bit16 {
 			for a := 0; a < 64; a++ {
 				buf.advance()
 				buf.advance()
-				table[zigzag[a]] = (buf.bf[1] << 8) + buf.bf[0]
+				table[zigzag[a]] = (uint16(buf.bf[1]) << 8) + uint16(buf.bf[0])
 			}
 			length -= 128
 		} else {
 			for a := 0; a < 64; a++ {
 				buf.advance()
-				table[zigzag[a]] = buf.bf[0]
+				table[zigzag[a]] = uint16(buf.bf[0])
 			}
 			length -= 64
 		}
-		// Check if a table with the same ID already exist
+		validateQuantizationTable(header, precision, &table)
+		// A table with the same ID is replaced, the components of the earlier scans keep the
+		// table they latched (B.2.4.1)
+		replaced := false
 		for t := range header.qTables {
 			if tableId == header.qTables[t].Id {
-				fmt.Printf("Error! More than one Quantization Table with the same ID: %d\n", tableId)
-				os.Exit(1)
+				header.qTables[t].table = table
+				replaced = true
 			}
 		}
-		header.qTables = append(header.qTables, QuantizationTable{Id: tableId, table: table})
+		if !replaced {
+			header.qTables = append(header.qTables, QuantizationTable{Id: tableId, table: table})
+		}
+	}
+	if length != 0 {
+		violation(header, false, "DQT: the segment length is off by %d bytes", -length)
 	}
 }
 
 func decodeStartOfFrame(h *Header) {
-	fmt.Printf("** Decoding Start Of Frame (0xFF%X) **\n", h.buffer.bf[0])
+	logf("** Decoding Start Of Frame (0xFF%X) **\n", h.buffer.bf[0])
 	// Set the frameType of the image
 	h.frameType = h.buffer.bf[0]
 	buf := h.buffer
@@ -95,8 +171,7 @@ func decodeStartOfFrame(h *Header) {
 	buf.advance()
 	length -= 1
 	if buf.bf[0] != 8 {
-		fmt.Printf("Error! Invalid Precision (%d). Expected 8\n", buf.bf[0])
-		os.Exit(1)
+		fail(h, "Invalid Precision (%d). Expected 8", buf.bf[0])
 	}
 	buf.advance()
 	buf.advance()
@@ -110,8 +185,7 @@ func decodeStartOfFrame(h *Header) {
 	length -= 1
 	components := int(buf.bf[0])
 	if components > 3 {
-		fmt.Printf("Error! Number of components > 3. CMYK ColorMode not supported\n")
-		os.Exit(1)
+		fail(h, "Number of components > 3. CMYK ColorMode not supported")
 	}
 	// Set the width and the height
 	h.width = width
@@ -137,8 +211,7 @@ func decodeStartOfFrame(h *Header) {
 		for c := range h.cComponents {
 			comp := &h.cComponents[c]
 			if compId == comp.Id {
-				fmt.Printf("Error! Duplicate coponentId (%d) found when scanning 'START OF FRAME'\n", compId)
-				os.Exit(1)
+				fail(h, "Duplicate coponentId (%d) found when scanning 'START OF FRAME'", compId)
 			}
 		}
 
@@ -155,40 +228,59 @@ func decodeStartOfFrame(h *Header) {
 			h.cComponents[a].Id += 1
 		}
 	}
+	validateFrame(h, length)
 
 	// blocks
 	h.blockWidth = (h.width + 7) / 8
 	h.blockHeight = (h.height + 7) / 8
-	h.blockWidthReal = h.blockWidth
-	h.blockHeightReal = h.blockHeight
 	// the luminance channel determines the MCU dimensions
 	comp := h.cComponents[0]
-	if comp.vSamplingFactor == 2 && h.blockHeight%2 == 1 {
-		h.blockHeightReal += 1
-	}
-	if comp.hSamplingFactor == 2 && h.blockWidth%2 == 1 {
-		h.blockWidthReal += 1
+	mcusWide := (h.blockWidth + comp.hSamplingFactor - 1) / comp.hSamplingFactor
+	mcusHigh := (h.blockHeight + comp.vSamplingFactor - 1) / comp.vSamplingFactor
+	h.blockWidthReal = mcusWide * comp.hSamplingFactor
+	h.blockHeightReal = mcusHigh * comp.vSamplingFactor
+	if h.options.region != nil && !h.options.coefficientsOnly {
+		clipRegion(h)
 	}
-	h.blockCount = h.blockHeightReal * h.blockWidthReal
-	_arr := make([]Block, h.blockCount)
-	h.blocks = &_arr
-	// Check if len == 0
-	if length != 0 {
-		fmt.Printf("Error! Invalid Start Of Frame\n")
+	// the rows of a streamed baseline image go through a single MCU row of blocks, a region
+	// of a baseline image only needs its own blocks
+	h.streaming = h.options.rows != nil && h.frameType == SOF0 && !h.options.coefficientsOnly && h.region == nil
+	if h.streaming {
+		allocPlanes(h, 1)
+	} else if h.region != nil && h.frameType == SOF0 {
+		allocRegionPlanes(h)
+	} else if h.options.buildIndex {
+		// The blocks are only decoded to find the restart intervals
+		allocPlanes(h, 0)
+	} else {
+		allocPlanes(h, mcusHigh)
 	}
-
 }
 
-func decodeBandCoeffecients(header *Header, br *BitReader, acHuffmanTable *HuffmanTable, dcHuffmanTable *HuffmanTable, prevDC *int, skips *int, channel *[64]int) {
-	// cmap for mapping coeffecients
-	var cmap map[int]int = zmap.Map1
+// Gives every component a plane of blocks on its own sampling grid, mcusHigh MCU rows high
+func allocPlanes(h *Header, mcusHigh int) {
+	mcusWide := h.blockWidthReal / h.cComponents[0].hSamplingFactor
+	h.planes = make([]Plane, len(h.cComponents))
+	h.blockCount = 0
+	for c := range h.cComponents {
+		h.planes[c].blocksWide = mcusWide * h.cComponents[c].hSamplingFactor
+		h.planes[c].blocksHigh = mcusHigh * h.cComponents[c].vSamplingFactor
+		h.blockCount += h.planes[c].blocksWide * h.planes[c].blocksHigh
+	}
+	checkFrameLimits(h)
+	blocks := h.decoder.allocBlocks(h.blockCount)
+	for c := range h.planes {
+		n := h.planes[c].blocksWide * h.planes[c].blocksHigh
+		h.planes[c].blocks, blocks = blocks[:n:n], blocks[n:]
+	}
+}
 
+func decodeBandCoeffecients(header *Header, br *BitReader, acHuffmanTable *HuffmanTable, dcHuffmanTable *HuffmanTable, prevDC *int, skips *int, channel *[64]int16) {
 	if header.frameType == SOF0 {
 		// Decode the DC coeffecient
 		sym := scanSymbol(br, dcHuffmanTable)
 		if sym == 0xFF {
-			fmt.Printf("Error! invalid DC Symbols\n")
-			os.Exit(1)
+			corruptData(header, "invalid DC Symbols")
 		}
 		dcLength := int(sym)
 		// Since for DC length == sym
@@ -198,7 +290,7 @@ func decodeBandCoeffecients(header *Header, br *BitReader, acHuffmanTable *Huffm
 		}
 		coeff += *prevDC
 		*prevDC = coeff
-		(*channel)[0] = coeff
+		(*channel)[0] = int16(coeff)
 		// Decode the AC Coeffecients
 		index := 1
 		for {
@@ -206,27 +298,39 @@ func decodeBandCoeffecients(header *Header, br *BitReader, acHuffmanTable *Huffm
 				break
 			}
 			sym = scanSymbol(br, acHuffmanTable)
+			if sym == 0xFF {
+				corruptData(header, "invalid AC Symbols")
+			}
 			switch sym {
 			// The remaining coeffecients are all 0
 			case 0x00:
 				for a := index; a <= 63; a++ {
-					(*channel)[cmap[a]] = 0
+					(*channel)[zigzag[a]] = 0
 					index++
 				}
 			// The next 16 coeffecients are all 0
 			case 0xF0:
+				if index+15 > 63 {
+					corruptData(header, "zero run past the end of the block")
+				}
 				max := index + 16
 				for a := index; a < max; a++ {
-					(*channel)[cmap[a]] = 0
+					(*channel)[zigzag[a]] = 0
 					index++
 				}
 			// Decode the coeffLength and numZeros
 			default:
 				numZeros := sym >> 4
 				coeffLength := int(sym & 0x0F)
+				if coeffLength == 0 {
+					corruptData(header, "invalid AC Symbols (0x%02X)", sym)
+				}
+				if index+int(numZeros) > 63 {
+					corruptData(header, "zero run past the end of the block")
+				}
 				max := index + int(numZeros)
 				for a := index; a < max; a++ {
-					(*channel)[cmap[a]] = 0
+					(*channel)[zigzag[a]] = 0
 					index++
 				}
 				// read the coeffecient
@@ -234,7 +338,7 @@ func decodeBandCoeffecients(header *Header, br *BitReader, acHuffmanTable *Huffm
 				if coeff < (1 << (coeffLength - 1)) {
 					coeff -= ((1 << coeffLength) - 1)
 				}
-				(*channel)[cmap[index]] = coeff
+				(*channel)[zigzag[index]] = int16(coeff)
 				index++
 			}
 		}
@@ -250,7 +354,7 @@ func decodeBandCoeffecients(header *Header, br *BitReader, acHuffmanTable *Huffm
 			}
 			dcCoeffecient += *prevDC
 			*prevDC = dcCoeffecient
-			(*channel)[cmap[0]] = dcCoeffecient << header.successiveApproximationLow
+			(*channel)[zigzag[0]] = int16(dcCoeffecient << header.successiveApproximationLow)
 		} else if header.startOfSelection != 0 && header.successiveApproximationHigh == 0 {
 			/** AC First Visit **/
 			if *skips > 0 {
@@ -268,38 +372,42 @@ func decodeBandCoeffecients(header *Header, br *BitReader, acHuffmanTable *Huffm
 				}
 				sym := scanSymbol(br, acHuffmanTable)
 				if sym == 0xff {
-					fmt.Printf("Error! Invalid symbol 0xff found\n")
-					os.Exit(1)
+					corruptData(header, "Invalid symbol 0xff found")
 				}
 				switch sym {
 				case 0xF0:
 					// 0xF0 means the next 16 coeffecients are 0
+					if index+15 > end {
+						corruptData(header, "zero run past the end of the band")
+					}
 					max := index + 16
 					for a := index; a < max; a++ {
-						(*channel)[cmap[a]] = 0
+						(*channel)[zigzag[a]] = 0
 						index++
 					}
 				default:
 					numZeros := int(sym >> 4)
 					acLength := int(sym & 0x0F)
 					if acLength != 0 {
+						if index+numZeros > end {
+							corruptData(header, "zero run past the end of the band")
+						}
 						max := index + numZeros
 						for a := index; a < max; a++ {
-							(*channel)[cmap[a]] = 0
+							(*channel)[zigzag[a]] = 0
 							index++
 						}
 						acCoeffecient := br.readBits(acLength)
 						if acCoeffecient < (1 << (acLength - 1)) {
 							acCoeffecient -= (1<<acLength - 1)
 						}
-						(*channel)[cmap[index]] = acCoeffecient << int(header.successiveApproximationLow)
+						(*channel)[zigzag[index]] = int16(acCoeffecient << int(header.successiveApproximationLow))
 						index++
 					} else {
 						_skips := (1 << numZeros) - 1
 						_extra := br.readBits(numZeros)
-						if _extra == 0xff {
-							fmt.Printf("Error! Invalid EOB\n")
-							os.Exit(1)
+						if _extra == -1 {
+							corruptData(header, "Invalid EOB")
 						}
 						_skips += _extra
 						*skips = _skips
@@ -313,16 +421,16 @@ func decodeBandCoeffecients(header *Header, br *BitReader, acHuffmanTable *Huffm
 			// For DC refinement all you need to do is read a single bit,
 			// shift it left by successiveApproximationHight, then bin-or it with the current DC coeffecient
 			bit := br.readBit()
-			if bit == 0xff {
-				fmt.Printf("Error! invalid DC refinment bit read\n")
-				os.Exit(1)
+			if bit == -1 {
+				corruptData(header, "invalid DC refinment bit read")
 			}
-			(*channel)[cmap[0]] |= bit << header.successiveApproximationLow
+			(*channel)[zigzag[0]] |= int16(bit << header.successiveApproximationLow)
 		} else if header.startOfSelection != 0 && header.successiveApproximationHigh != 0 {
 			// negative and positie bits
-			positive := 1 << header.successiveApproximationLow
-			negative := -1 << header.successiveApproximationLow
+			positive := int16(1 << header.successiveApproximationLow)
+			negative := int16(-1 << header.successiveApproximationLow)
 			index := int(header.startOfSelection)
+			end := int(header.endOfSelection)
 
 			if *skips == 0 {
 				// Perform huffman-decoding, read a new bit for every non-zero coeffecient
@@ -333,20 +441,18 @@ func decodeBandCoeffecients(header *Header, br *BitReader, acHuffmanTable *Huffm
 					sym := scanSymbol(br, acHuffmanTable)
 					// check if the symbol is valid
 					if sym == 0xff {
-						fmt.Printf("Error! Invalid symbol 0xff\n")
-						os.Exit(1)
+						corruptData(header, "Invalid symbol 0xff")
 					}
 					// get the number of zeroes and the coeffecient lenght
 					zeroes := sym >> 4
 					coeffLen := sym & 0x0f
 					// the coeffecient that will be set
-					coeff := 0
+					coeff := int16(0)
 
 					// coeffLen should be 1 because this is a refinment scan
 					if coeffLen != 0 {
 						if coeffLen != 1 {
-							fmt.Printf("Error! Invalid coeffLen expected %d but got %d\n", 1, coeffLen)
-							os.Exit(1)
+							corruptData(header, "Invalid coeffLen expected %d but got %d", 1, coeffLen)
 						}
 						bit := br.readBit()
 						if bit == 1 {
@@ -354,21 +460,23 @@ func decodeBandCoeffecients(header *Header, br *BitReader, acHuffmanTable *Huffm
 						} else if bit == 0 {
 							coeff = negative
 						} else {
-							fmt.Printf("Error\n")
-							os.Exit(1)
+							corruptData(header, "Invalid refinement bit (%d)", bit)
 						}
 					}
 
 					// check for end-of-band symbols
 					if coeffLen == 0 && sym != 0xf0 {
 						*skips = (1 << zeroes) + br.readBits(int(zeroes))
-						// fmt.Printf("eob -> %d\n", *skips)
+						// logf("eob -> %d\n", *skips)
 						break
 					}
 					// Handle the zeroes
 					for {
-						var currCoeff *int
-						currCoeff = &((*channel)[cmap[index]])
+						if index > end {
+							corruptData(header, "zero run past the end of the band")
+						}
+						var currCoeff *int16
+						currCoeff = &((*channel)[zigzag[index]])
 						// read a new bit for every non-zero coeffecient
 						if *currCoeff != 0 {
 							bit := br.readBit()
@@ -381,8 +489,7 @@ func decodeBandCoeffecients(header *Header, br *BitReader, acHuffmanTable *Huffm
 							} else if bit == 0 {
 								// do nothing
 							} else {
-								fmt.Printf("Error bit -> %d\n", bit)
-								os.Exit(1)
+								corruptData(header, "Invalid refinement bit (%d)", bit)
 							}
 						} else {
 							if zeroes == 0 {
@@ -392,7 +499,7 @@ func decodeBandCoeffecients(header *Header, br *BitReader, acHuffmanTable *Huffm
 						}
 						index += 1
 					}
-					(*channel)[cmap[index]] = coeff
+					(*channel)[zigzag[index]] = coeff
 					index += 1
 				}
 			}
@@ -402,8 +509,8 @@ func decodeBandCoeffecients(header *Header, br *BitReader, acHuffmanTable *Huffm
 					if index > int(header.endOfSelection) {
 						break
 					}
-					var currCoeff *int
-					currCoeff = &(*channel)[cmap[index]]
+					var currCoeff *int16
+					currCoeff = &(*channel)[zigzag[index]]
 					// read a new bit for every non-zero coeffeceint
 					if *currCoeff != 0 {
 						bit := br.readBit()
@@ -416,8 +523,7 @@ func decodeBandCoeffecients(header *Header, br *BitReader, acHuffmanTable *Huffm
 						} else if bit == 0 {
 							// do nothing
 						} else {
-							fmt.Printf("Error bit 2-> %d\n", bit)
-							os.Exit(1)
+							corruptData(header, "Invalid refinement bit (%d)", bit)
 						}
 					}
 					index += 1
@@ -431,9 +537,9 @@ func decodeBandCoeffecients(header *Header, br *BitReader, acHuffmanTable *Huffm
 // Helper function to get the correct *HuffmanTable
 func getTable(header *Header, dc bool, Id int) *HuffmanTable {
 	for t := range header.huffmanTables {
-		tab := header.huffmanTables[t]
+		tab := &header.huffmanTables[t]
 		if Id == tab.Id && dc == tab.dc {
-			return &tab
+			return tab
 		}
 	}
 	return nil
@@ -441,17 +547,22 @@ func getTable(header *Header, dc bool, Id int) *HuffmanTable {
 
 // Helper function to get the correct quantization table
 func getQuantizationTable(header *Header, compIndex int) *QuantizationTable {
+	if header.cComponents[compIndex].qTable != nil {
+		return header.cComponents[compIndex].qTable
+	}
 	tId := header.cComponents[compIndex].qTableId
 	for a := range header.qTables {
-		t := header.qTables[a]
+		t := &header.qTables[a]
 		if t.Id == tId {
-			return &t
+			return t
 		}
 	}
 	return nil
 }
 
-func inverseDCTOnComponent(chann *[64]int) {
+// The IDCT of a block of coefficients in place, the passes are rounded towards zero in between
+func inverseDCTOnComponent(chann *[64]int16) {
+	var tmp [64]int
 	// 1D IDCT on Columns
 	for i := 0; i < 8; i++ {
 		// g
@@ -518,27 +629,27 @@ func inverseDCTOnComponent(chann *[64]int) {
 		var b7 float64 = c7
 
 		// a -> final output
-		(*chann)[i] = int(b0 + b7)
-		(*chann)[1*8+i] = int(b1 + b6)
-		(*chann)[2*8+i] = int(b2 + b5)
-		(*chann)[3*8+i] = int(b3 + b4)
-		(*chann)[4*8+i] = int(b3 - b4)
-		(*chann)[5*8+i] = int(b2 - b5)
-		(*chann)[6*8+i] = int(b1 - b6)
-		(*chann)[7*8+i] = int(b0 - b7)
+		tmp[i] = int(b0 + b7)
+		tmp[1*8+i] = int(b1 + b6)
+		tmp[2*8+i] = int(b2 + b5)
+		tmp[3*8+i] = int(b3 + b4)
+		tmp[4*8+i] = int(b3 - b4)
+		tmp[5*8+i] = int(b2 - b5)
+		tmp[6*8+i] = int(b1 - b6)
+		tmp[7*8+i] = int(b0 - b7)
 	}
 
 	// 1D IDCT On Rows
 	for i := 0; i < 8; i++ {
 		// g
-		var g0 float64 = float64((*chann)[i*8+0]) * S0
-		var g1 float64 = float64((*chann)[i*8+4]) * S4
-		var g2 float64 = float64((*chann)[i*8+2]) * S2
-		var g3 float64 = float64((*chann)[i*8+6]) * S6
-		var g4 float64 = float64((*chann)[i*8+5]) * S5
-		var g5 float64 = float64((*chann)[i*8+1]) * S1
-		var g6 float64 = float64((*chann)[i*8+7]) * S7
-		var g7 float64 = float64((*chann)[i*8+3]) * S3
+		var g0 float64 = float64(tmp[i*8+0]) * S0
+		var g1 float64 = float64(tmp[i*8+4]) * S4
+		var g2 float64 = float64(tmp[i*8+2]) * S2
+		var g3 float64 = float64(tmp[i*8+6]) * S6
+		var g4 float64 = float64(tmp[i*8+5]) * S5
+		var g5 float64 = float64(tmp[i*8+1]) * S1
+		var g6 float64 = float64(tmp[i*8+7]) * S7
+		var g7 float64 = float64(tmp[i*8+3]) * S3
 
 		// f
 		var f0 float64 = g0
@@ -594,236 +705,376 @@ func inverseDCTOnComponent(chann *[64]int) {
 		var b7 float64 = c7
 
 		// a -> final output
-		(*chann)[i*8+0] = int(b0 + b7)
-		(*chann)[i*8+1] = int(b1 + b6)
-		(*chann)[i*8+2] = int(b2 + b5)
-		(*chann)[i*8+3] = int(b3 + b4)
-		(*chann)[i*8+4] = int(b3 - b4)
-		(*chann)[i*8+5] = int(b2 - b5)
-		(*chann)[i*8+6] = int(b1 - b6)
-		(*chann)[i*8+7] = int(b0 - b7)
-	}
-}
-
-// Inverse DCT
-func inverseDCT(header *Header) {
-	for y := 0; y < header.blockHeightReal; y++ {
-		for x := 0; x < header.blockWidthReal; x++ {
-			blockIndex := x + y*header.blockWidthReal
-			block := &(*header.blocks)[blockIndex]
-			for cp := range header.cComponents {
-				//comp := header.cComponents[cp]
-				var chann *[64]int
-				switch cp {
-				case 0:
-					chann = &(*block).ch1
-				case 1:
-					chann = &(*block).ch2
-				case 2:
-					chann = &(*block).ch3
-				default:
-					chann = nil
-				}
-				if chann == nil {
-					fmt.Printf("Error! chan = nil\n")
-					os.Exit(1)
-				}
-				inverseDCTOnComponent(chann)
+		(*chann)[i*8+0] = clamp16(int(b0 + b7))
+		(*chann)[i*8+1] = clamp16(int(b1 + b6))
+		(*chann)[i*8+2] = clamp16(int(b2 + b5))
+		(*chann)[i*8+3] = clamp16(int(b3 + b4))
+		(*chann)[i*8+4] = clamp16(int(b3 - b4))
+		(*chann)[i*8+5] = clamp16(int(b2 - b5))
+		(*chann)[i*8+6] = clamp16(int(b1 - b6))
+		(*chann)[i*8+7] = clamp16(int(b0 - b7))
+	}
+}
+
+// Returns the rows of the blocks of a plane that it holds in the block rows [start, end) of
+// the luminance grid
+func planeRows(header *Header, c int, start int, end int) (int, int) {
+	vMax := header.cComponents[0].vSamplingFactor
+	v := header.cComponents[c].vSamplingFactor
+	plane := &header.planes[c]
+	first := start/vMax*v - plane.blockY
+	last := (end+vMax-1)/vMax*v - plane.blockY
+	if first < 0 {
+		first = 0
+	}
+	if last > plane.blocksHigh {
+		last = plane.blocksHigh
+	}
+	return first, last
+}
+
+// Inverse DCT of the block rows [start, end)
+func inverseDCT(header *Header, start int, end int) {
+	for c := range header.planes {
+		plane := &header.planes[c]
+		first, last := planeRows(header, c, start, end)
+		for a := first * plane.blocksWide; a < last*plane.blocksWide; a++ {
+			inverseDCTOnComponent(&plane.blocks[a])
+		}
+	}
+}
+
+// dequntize the coeffecients of the block rows [start, end)
+func dequantize(header *Header, start int, end int) {
+	for c := range header.planes {
+		plane := &header.planes[c]
+		tb := getQuantizationTable(header, c)
+		first, last := planeRows(header, c, start, end)
+		for a := first * plane.blocksWide; a < last*plane.blocksWide; a++ {
+			chann := &plane.blocks[a]
+			for i := 0; i < 64; i++ {
+				(*chann)[i] = clamp16(int((*chann)[i]) * int((*tb).table[i]))
 			}
 		}
 	}
 }
 
-// dequntize the coeffecients
-func dequantize(header *Header) {
-	for y := 0; y < header.blockHeightReal; y++ {
-		for x := 0; x < header.blockWidthReal; x++ {
-			blockIndex := x + y*header.blockWidthReal
-			block := &(*header.blocks)[blockIndex]
-			for cp := range header.cComponents {
-				var chann *[64]int
-				switch cp {
-				case 0:
-					chann = &(*block).ch1
-				case 1:
-					chann = &(*block).ch2
-				case 2:
-					chann = &(*block).ch3
-				default:
-					chann = nil
-				}
-				if chann == nil {
-					fmt.Printf("Error! chann = nil\n")
-					os.Exit(1)
-				}
-				tb := getQuantizationTable(header, cp)
-				for i := 0; i < 64; i++ {
-					(*chann)[i] *= int((*tb).table[i])
-				}
+// Limits a value to the range of an int16
+func clamp16(a int) int16 {
+	if a < math.MinInt16 {
+		return math.MinInt16
+	}
+	if a > math.MaxInt16 {
+		return math.MaxInt16
+	}
+	return int16(a)
+}
+
+// YCbCr -> RGB into img, whose top left pixel is the pixel x0, y0 of the image. The
+// chrominance of a subsampled component is spread over the luminance samples it covers.
+func convertColorSpace(header *Header, img *Image, x0 int, y0 int) {
+	xStep := header.cComponents[0].hSamplingFactor
+	yStep := header.cComponents[0].vSamplingFactor
+	luma := &header.planes[0]
+	for y := 0; y < img.height; y++ {
+		// the blocks of the row and the index of the row in them
+		py := y0 + y
+		row := py/8 - luma.blockY
+		lumaRow := luma.blocks[row*luma.blocksWide : (row+1)*luma.blocksWide]
+		lumaIndex := py % 8 * 8
+		var cbRow, crRow [][64]int16
+		chromaX, chromaIndex := 0, 0
+		if len(header.planes) == 3 {
+			cy := py / yStep
+			cb, cr := &header.planes[1], &header.planes[2]
+			row := cy/8 - cb.blockY
+			cbRow = cb.blocks[row*cb.blocksWide : (row+1)*cb.blocksWide]
+			crRow = cr.blocks[row*cr.blocksWide : (row+1)*cr.blocksWide]
+			chromaX = cb.blockX
+			chromaIndex = cy % 8 * 8
+		}
+		for x := 0; x < img.width; x++ {
+			// YCbCr, a grayscale image has no chrominance
+			px := x0 + x
+			Y := lumaRow[px/8-luma.blockX][lumaIndex+px%8]
+			var cb, cr int16
+			if cbRow != nil {
+				cx := px / xStep
+				cb = cbRow[cx/8-chromaX][chromaIndex+cx%8]
+				cr = crRow[cx/8-chromaX][chromaIndex+cx%8]
+			}
+			// RGB
+			r := float32(Y) + (1.402 * (float32(cr))) + 128
+			g := float32(Y) - (0.344 * (float32(cb))) - (0.714 * float32(cr)) + 128
+			b := float32(Y) + (1.772 * (float32(cb))) + 128
+			if r < 0 {
+				r = 0
 			}
+			if r > 255 {
+				r = 255
+			}
+			if b < 0 {
+				b = 0
+			}
+			if b > 255 {
+				b = 255
+			}
+			if g < 0 {
+				g = 0
+			}
+			if g > 255 {
+				g = 255
+			}
+			// set the 'rgb' values
+			i := (x + y*img.width) * 3
+			img.pix[i] = byte(r)
+			img.pix[i+1] = byte(g)
+			img.pix[i+2] = byte(b)
 		}
 	}
 }
 
-// YCbCr -> RGB
-func convertColorSpace(header *Header) {
-	for y := 0; y < header.blockHeightReal; y++ {
-		for x := 0; x < header.blockWidthReal; x++ {
-			block := &(*header.blocks)[x+y*header.blockWidthReal]
-			for a := 0; a < 64; a++ {
-				// YCbCr
-				Y := &(*block).ch1[a]
-				cb := &(*block).ch2[a]
-				cr := &(*block).ch3[a]
-				// RGB
-				r := float32((*Y)) + (1.402 * (float32(*cr))) + 128
-				g := float32((*Y)) - (0.344 * (float32(*cb))) - (0.714 * float32((*cr))) + 128
-				b := float32((*Y)) + (1.772 * (float32(*cb))) + 128
-				if r < 0 {
-					r = 0
-				}
-				if r > 255 {
-					r = 255
-				}
-				if b < 0 {
-					b = 0
-				}
-				if b > 255 {
-					b = 255
-				}
-				if g < 0 {
-					g = 0
-				}
-				if g > 255 {
-					g = 255
+// Calls fn for the blocks of the components in the scan of the MCU mx, my that the planes hold
+// in the order they are coded. The MCU of a scan with one component is a single block (ITU
+// T.81 A.2.2).
+func forEachMCUBlock(header *Header, mx int, my int, fn func(c int, block *[64]int16)) {
+	for c := range header.cComponents {
+		comp := &header.cComponents[c]
+		if !comp.usedInScan {
+			continue
+		}
+		plane := &header.planes[c]
+		xMax, yMax := comp.hSamplingFactor, comp.vSamplingFactor
+		if header.componentsInScan == 1 {
+			xMax, yMax = 1, 1
+		}
+		for u := 0; u < yMax; u++ {
+			for v := 0; v < xMax; v++ {
+				if block := plane.block(mx*xMax+v, my*yMax+u); block != nil {
+					fn(c, block)
 				}
-				// set the 'rgb' values
-				*Y = int(r)
-				*cb = int(g)
-				*cr = int(b)
 			}
 		}
 	}
 }
 
-// spread coeffecient values
-func spreadCoeffecients(header *Header) {
-	yStep := header.cComponents[0].vSamplingFactor
-	xStep := header.cComponents[0].hSamplingFactor
-
-	for y := 0; y < header.blockHeight; y += yStep {
-		for x := 0; x < header.blockWidth; x += xStep {
-			// rBlock contains all the coeffecients that we need for the cb and cr
-			rBlock := (*header.blocks)[x+y*header.blockWidthReal]
-			for py := 0; py < 8*yStep; py += yStep {
-				yBlock := py / 8
-				for px := 0; px < 8*xStep; px += xStep {
-					xBlock := px / 8
-					// cBlock is the block where the coeffecient data is being writen to
-					cBlock := &(*header.blocks)[(x+xBlock)+(y+yBlock)*header.blockWidthReal]
-					// the index of the coeffecients that we are copying from the refference block
-					rYIndex := py / 2
-					rXIndex := px / 2
-					// the index of the coffecients that we are writing to
-					cYIndex := py
-					cXIndex := px
-					if cYIndex >= 8 {
-						cYIndex %= 8
-					}
-					if cXIndex >= 8 {
-						cXIndex %= 8
-					}
-					// set the values
-					for u := 0; u < yStep; u++ {
-						for v := 0; v < xStep; v++ {
-							(*cBlock).ch2[(cXIndex+v)+8*(cYIndex+u)] = rBlock.ch2[rXIndex+8*rYIndex]
-							(*cBlock).ch3[(cXIndex+v)+8*(cYIndex+u)] = rBlock.ch3[rXIndex+8*rYIndex]
-						}
+// Decodes the blocks of the components in the scan of the MCU mx, my
+func decodeMCU(header *Header, br *BitReader, mx int, my int, prevDC *[3]int, skips *int) {
+	var scratch [64]int16
+	for cp := range header.cComponents {
+		comp := header.cComponents[cp]
+		acHuffmanTable := getTable(header, false, comp.acHuffmanTableId)
+		dcHuffmanTable := getTable(header, true, comp.dcHuffmanTableId)
+		if comp.usedInScan {
+			plane := &header.planes[cp]
+			var xMax int
+			var yMax int
+			if header.componentsInScan == 1 {
+				yMax = 1
+				xMax = 1
+			} else {
+				yMax = comp.vSamplingFactor
+				xMax = comp.hSamplingFactor
+			}
+			for u := 0; u < yMax; u++ {
+				for v := 0; v < xMax; v++ {
+					block := plane.block(mx*xMax+v, my*yMax+u)
+					if block == nil {
+						// A block outside the region is decoded to get to the next one
+						block = &scratch
 					}
+					// decode the coeffecients in the band
+					decodeBandCoeffecients(
+						header,
+						br,
+						acHuffmanTable,
+						dcHuffmanTable,
+						&prevDC[cp],
+						skips,
+						block,
+					)
 				}
 			}
 		}
 	}
 }
 
-func decodeHuffmanData(header *Header, br *BitReader) {
-	prevDC := [3]int{0, 0, 0}
-	skips := 0
+// Decodes an MCU in tolerant mode. If the data is corrupt or runs out the blocks of the
+// MCU are restored to what they were before the scan and the reason is returned.
+func decodeMCUTolerant(header *Header, br *BitReader, mx int, my int, prevDC *[3]int, skips *int) (reason string) {
+	saved := [][64]int16{}
+	forEachMCUBlock(header, mx, my, func(c int, block *[64]int16) {
+		saved = append(saved, *block)
+	})
+	restore := func() {
+		forEachMCUBlock(header, mx, my, func(c int, block *[64]int16) {
+			*block, saved = saved[0], saved[1:]
+		})
+	}
+	defer func() {
+		if r := recover(); r != nil {
+			e, ok := r.(corruptDataError)
+			if !ok {
+				panic(r)
+			}
+			restore()
+			reason = e.reason
+			if br.exhausted {
+				reason = "the data ends"
+			}
+		}
+	}()
+	decodeMCU(header, br, mx, my, prevDC, skips)
+	if br.exhausted {
+		restore()
+		return "the data ends"
+	}
+	return ""
+}
 
-	luminanceOnlyScan := false
-	if header.componentsInScan == 1 && header.cComponents[0].usedInScan {
-		luminanceOnlyScan = true
+// In tolerant mode corrupt entropy-coded data panics with a corruptDataError, which drops the MCU
+type corruptDataError struct {
+	reason string
+}
+
+// Reports corrupt entropy-coded data
+func corruptData(header *Header, format string, a ...interface{}) {
+	if header.options.tolerant {
+		panic(corruptDataError{fmt.Sprintf(format, a...)})
+	}
+	fail(header, format, a...)
+}
+
+// Returns the MCU that starts the restart interval after an RSTn marker, interval is the
+// restart interval that holds the MCU mcu. Without an RSTn marker it returns mcus.
+func resyncMCU(marker byte, mcu int, interval int, mcus int) int {
+	if interval == 0 || marker < RST0 || marker > RST7 {
+		return mcus
 	}
+	// The restart interval k follows the marker RSTn with n = (k-1)%8
+	current := mcu / interval
+	k := current + 1 + (int(marker-RST0)-current%8+8)%8
+	if k*interval > mcus {
+		return mcus
+	}
+	return k * interval
+}
 
-	var xStep int
-	var yStep int
+func decodeHuffmanData(header *Header, scan *scanReader) {
+	br := &BitReader{data: &scan.data, fill: scan.fill}
+	prevDC := [3]int{0, 0, 0}
+	skips := 0
 
-	if luminanceOnlyScan {
-		xStep = 1
+	// The MCUs of a scan with all the components cover the padded luminance grid, a scan with
+	// one component covers the blocks of the component inside the image (A.2.2)
+	xStep := header.cComponents[0].hSamplingFactor
+	yStep := header.cComponents[0].vSamplingFactor
+	mcusWide := header.blockWidthReal / xStep
+	mcusHigh := header.blockHeightReal / yStep
+	if header.componentsInScan == 1 {
+		for c := range header.cComponents {
+			comp := &header.cComponents[c]
+			if comp.usedInScan {
+				width := (header.width*comp.hSamplingFactor + xStep - 1) / xStep
+				height := (header.height*comp.vSamplingFactor + yStep - 1) / yStep
+				mcusWide, mcusHigh = (width+7)/8, (height+7)/8
+			}
+		}
+		// Only a grayscale scan is rendered as it is decoded, its MCUs are the block rows
 		yStep = 1
-	} else {
-		xStep = header.cComponents[0].hSamplingFactor
-		yStep = header.cComponents[0].vSamplingFactor
-	}
-
-	for y := 0; y < header.blockHeight; y += yStep {
-		for x := 0; x < header.blockWidth; x += xStep {
-			for cp := range header.cComponents {
-				comp := header.cComponents[cp]
-				acHuffmanTable := getTable(header, false, comp.acHuffmanTableId)
-				dcHuffmanTable := getTable(header, true, comp.dcHuffmanTableId)
-				if comp.usedInScan {
-					var xMax int
-					var yMax int
-					if luminanceOnlyScan {
-						yMax = 1
-						xMax = 1
-					} else {
-						yMax = comp.vSamplingFactor
-						xMax = comp.hSamplingFactor
-					}
-					for u := 0; u < yMax; u++ {
-						for v := 0; v < xMax; v++ {
-							blockIndex := (x + v) + (y+u)*header.blockWidthReal
-							block := &(*header.blocks)[blockIndex]
-							var chann *[64]int
-							switch cp {
-							case 0:
-								chann = &(*block).ch1
-							case 1:
-								chann = &(*block).ch2
-							case 2:
-								chann = &(*block).ch3
-							default:
-								chann = nil
-							}
-							// decode the coeffecients in the band
-							decodeBandCoeffecients(
-								header,
-								br,
-								acHuffmanTable,
-								dcHuffmanTable,
-								&prevDC[cp],
-								&skips,
-								chann,
-							)
-						}
-					}
+	}
+	// The rows of a baseline scan with all the components are final once they are decoded
+	incremental := header.frameType == SOF0 && header.componentsInScan == len(header.cComponents) &&
+		!header.options.coefficientsOnly && header.region == nil
+	mcus := mcusWide * mcusHigh
+	interval := header.restartInterval
+	// After corrupt data the MCUs before resume are skipped
+	resume := 0
+	// The scan of a region of a baseline image stops after the last MCU of the region, the
+	// restart intervals without MCUs of the region are skipped to their RSTn marker
+	windowed := header.region != nil && header.frameType == SOF0
+	last := mcus
+	skipping := false
+	var win window
+	if windowed {
+		win = scanWindow(header)
+		if win.x1 > mcusWide {
+			win.x1 = mcusWide
+		}
+		if win.y1 > mcusHigh {
+			win.y1 = mcusHigh
+		}
+		last = (win.y1-1)*mcusWide + win.x1
+	}
+	if header.options.buildIndex {
+		indexScan(header, scan, mcusWide, mcusHigh)
+		return
+	}
+	if header.options.index != nil && !header.options.tolerant && !header.streaming && (windowed || header.options.workers > 1) {
+		decodeIndexed(header, scan, mcusWide, mcusHigh, windowed, win)
+		return
+	}
+
+	for my := 0; my < mcusHigh; my++ {
+		for mx := 0; mx < mcusWide; mx++ {
+			mcu := mx + my*mcusWide
+			if mcu >= last {
+				return
+			}
+			if mcu < resume {
+				continue
+			}
+			if interval > 0 && mcu > 0 && mcu%interval == 0 {
+				// Every restart interval starts on a byte after an RSTn marker with the predictors reset
+				marker := scan.skipToMarker(br)
+				expected := RST0 + byte((mcu/interval-1)%8)
+				if marker == expected {
+					scan.resume()
+					br.exhausted = false
+					prevDC = [3]int{0, 0, 0}
+					skips = 0
+				} else if !header.options.tolerant {
+					fail(header, "Expected a restart marker (0xFF%X) but found (0xFF%X)", expected, marker)
+				} else {
+					resume = resyncMCU(marker, mcu-1, interval, mcus)
+					warn(header, "scan %d: missing restart marker at MCU %d, skipped %d MCUs", header.scanCount+1, mcu, resume-mcu)
+					continue
 				}
 			}
+			if windowed && interval > 0 && mcu%interval == 0 {
+				skipping = !win.holdsAny(mcu, mcu+interval, mcusWide)
+			}
+			if skipping {
+				continue
+			}
+			if !header.options.tolerant {
+				decodeMCU(header, br, mx, my, &prevDC, &skips)
+			} else if reason := decodeMCUTolerant(header, br, mx, my, &prevDC, &skips); reason != "" {
+				marker := scan.skipToMarker(br)
+				// A restart interval that ends early is corrupt
+				if marker >= RST0 && marker <= RST7 {
+					reason = "corrupt data"
+				}
+				resume = resyncMCU(marker, mcu, interval, mcus)
+				warn(header, "scan %d: %s at MCU %d of %d, skipped %d MCUs", header.scanCount+1, reason, mcu, mcus, resume-mcu)
+			}
+		}
+		if header.streaming {
+			streamRows(header, my)
+		} else if incremental {
+			renderDecodedRows(header, (my+1)*yStep)
 		}
 	}
 }
 
 func decodeDefineRestartInterval(header *Header) {
 	buf := header.buffer
-	fmt.Printf("** Decoding Define Restart Interval (0xFF%X)**\n", buf.bf[0])
+	logf("** Decoding Define Restart Interval (0xFF%X)**\n", buf.bf[0])
 	buf.advance()
 	buf.advance()
 	length := (int(buf.bf[1]) << 8) + int(buf.bf[0]) - 2
 	if length != 2 {
-		fmt.Printf("Error! Invalid Restart Interval Length (%d)\n", length)
-		os.Exit(1)
+		fail(header, "Invalid Restart Interval Length (%d)", length)
 	}
 	buf.advance()
 	buf.advance()
@@ -837,7 +1088,7 @@ func decodeDefineHuffmanTable(header *Header) {
 		header.huffmanTables[t].newInScan = false
 	}
 	buf := header.buffer
-	fmt.Printf("** Decoding Define Huffman Table (0xFF%X) **\n", buf.bf[0])
+	logf("** Decoding Define Huffman Table (0xFF%X) **\n", buf.bf[0])
 	buf.advance()
 	buf.advance()
 	length := (int(buf.bf[1]) << 8) + int(buf.bf[0]) - 2
@@ -847,7 +1098,8 @@ func decodeDefineHuffmanTable(header *Header) {
 		}
 		buf.advance()
 		length -= 1
-		dc := (buf.bf[0] >> 4) == 0
+		class := buf.bf[0] >> 4
+		dc := class == 0
 		tableId := int(buf.bf[0] & 0x0F)
 		// Create the new table
 		table := HuffmanTable{
@@ -863,11 +1115,13 @@ func decodeDefineHuffmanTable(header *Header) {
 			table.codesOfLen[a] = int(buf.bf[0])
 			count += int(buf.bf[0])
 		}
+		validateHuffmanTable(header, class, &table)
 		for a := 0; a < count; a++ {
 			buf.advance()
 			length -= 1
 			table.symbols = append(table.symbols, buf.bf[0])
 		}
+		validateHuffmanSymbols(header, &table)
 		// For progressive JPGs there are new huffman-tables, thus check for tables that have the same id
 		_newTables := []HuffmanTable{}
 		for t := range header.huffmanTables {
@@ -883,69 +1137,70 @@ func decodeDefineHuffmanTable(header *Header) {
 		header.huffmanTables = _newTables
 	}
 	if length != 0 {
-		fmt.Printf("Error! Invalid DefineHuffanTable Marker\n")
+		violation(header, false, "DHT: the segment length is off by %d bytes", -length)
 	}
 }
 
 // Helper function to print the scan information
 func printScanInfo(header *Header) {
-	fmt.Printf("*** SCAN ***\n")
-	fmt.Printf("** Huffman Tables (%d) **\n", len(header.huffmanTables))
+	logf("*** SCAN ***\n")
+	logf("** Huffman Tables (%d) **\n", len(header.huffmanTables))
 	for t := range header.huffmanTables {
 		tb := header.huffmanTables[t]
 		if tb.newInScan {
-			fmt.Printf("table id: %d ", tb.Id)
+			logf("table id: %d ", tb.Id)
 			if tb.dc {
-				fmt.Printf("DC")
+				logf("DC")
 			} else {
-				fmt.Printf("AC")
+				logf("AC")
 			}
-			fmt.Printf("\n")
-			fmt.Printf("Start Of Selection           : %d\n", header.startOfSelection)
-			fmt.Printf("End Of Selection             : %d\n", header.endOfSelection)
-			fmt.Printf("Succesive Approximation High : %d\n", header.successiveApproximationHigh)
-			fmt.Printf("Succesive Approximation Low  : %d\n", header.successiveApproximationLow)
-			fmt.Printf("# of components              : %d\n", header.componentsInScan)
+			logf("\n")
+			logf("Start Of Selection           : %d\n", header.startOfSelection)
+			logf("End Of Selection             : %d\n", header.endOfSelection)
+			logf("Succesive Approximation High : %d\n", header.successiveApproximationHigh)
+			logf("Succesive Approximation Low  : %d\n", header.successiveApproximationLow)
+			logf("# of components              : %d\n", header.componentsInScan)
 			if false {
-				fmt.Printf("--- Symbols ---\n")
+				logf("--- Symbols ---\n")
 				lastIndex := 0
 
 				for a := byte(0); a < 16; a++ {
-					fmt.Printf("%s -> ", pad(int(a)))
+					logf("%s -> ", pad(int(a)))
 					codesOfLen := tb.codesOfLen[int(a)]
 					for c := lastIndex; c < lastIndex+codesOfLen; c++ {
-						fmt.Printf("%x ", tb.symbols[c])
+						logf("%x ", tb.symbols[c])
 					}
 					lastIndex += codesOfLen
-					fmt.Printf("\n")
+					logf("\n")
 				}
 			}
-			fmt.Printf("\n")
+			logf("\n")
 			if false {
-				fmt.Printf("--- Codes ---\n")
+				logf("--- Codes ---\n")
 				lastIndex := 0
 				for a := byte(0); a < 16; a++ {
-					fmt.Printf("LEN (%d)\n", a)
+					logf("LEN (%d)\n", a)
 					codesOfLen := tb.codesOfLen[int(a)]
 					for c := lastIndex; c < lastIndex+codesOfLen; c++ {
-						fmt.Printf("%b\n", tb.codes[c])
+						logf("%b\n", tb.codes[c])
 					}
-					fmt.Printf("\n")
+					logf("\n")
 					lastIndex += codesOfLen
 				}
-				fmt.Printf("\n")
+				logf("\n")
 			}
 		}
 	}
 }
 
 func decodeStartOfScan(header *Header) {
+	checkScanLimit(header)
 	// Set the usedInScan prop of all components to false
 	for c := range header.cComponents {
 		header.cComponents[c].usedInScan = false
 	}
 	buf := header.buffer
-	fmt.Printf("** Decoding Start of Scan (0xFF%X) **\n", buf.bf[0])
+	logf("** Decoding Start of Scan (0xFF%X) **\n", buf.bf[0])
 	buf.advance()
 	buf.advance()
 	length := (int(buf.bf[1]) << 8) + int(buf.bf[0]) - 2
@@ -954,6 +1209,7 @@ func decodeStartOfScan(header *Header) {
 	components := int(buf.bf[0])
 	// Set header.componentsInScan
 	header.componentsInScan = components
+	ids := []int{}
 	for a := 0; a < components; a++ {
 		buf.advance()
 		length -= 1
@@ -961,6 +1217,7 @@ func decodeStartOfScan(header *Header) {
 		if header.zeroBased {
 			compId += 1
 		}
+		ids = append(ids, compId)
 		buf.advance()
 		length -= 1
 		dcHuffmanTableId := buf.bf[0] >> 4
@@ -985,124 +1242,299 @@ func decodeStartOfScan(header *Header) {
 	length -= 1
 	header.successiveApproximationHigh = buf.bf[0] >> 4
 	header.successiveApproximationLow = buf.bf[0] & 0x0F
-	/** Begin the SCAN **/
-	buf.advance()
-	// The ECS provided by the current scan
-	_bitstream := []byte{}
-	// This loop should only get the ECS and break when we encounter a valid marker
-	for {
-		if buf.bf[0] == 0xFF {
-			buf.advance()
-			if buf.bf[0] == 0xFF {
-				buf.advance()
-				continue
-			} else if buf.bf[0] >= RST0 && buf.bf[0] <= RST7 {
-				buf.advance()
-			} else if buf.bf[0] == EOI {
-				break
-			} else if buf.bf[0] == DRI && header.frameType == SOF2 {
-				break
-			} else if buf.bf[0] == DHT && header.frameType == SOF2 {
-				break
-			} else if buf.bf[0] == SOS && header.frameType == SOF2 {
-				break
-			} else if buf.bf[0] == 0x00 {
-				// If one or more than one '0xff' bytes is followed by '0x00' then save a single '0xff'
-				_bitstream = append(_bitstream, 0xff)
-				buf.advance()
-			} else {
-				fmt.Printf("Invalid marker (0xFF%X) found in the bitsteam\n", buf.bf[0])
-				os.Exit(1)
-			}
-		} else {
-			_bitstream = append(_bitstream, buf.bf[0])
-			buf.advance()
+	validateScan(header, ids, length)
+	// A component keeps the quantization table of its first scan, a DQT between the scans
+	// only changes the tables of the components of the later scans
+	for c := range header.cComponents {
+		comp := &header.cComponents[c]
+		if t := getQuantizationTable(header, c); comp.usedInScan && comp.qTable == nil && t != nil {
+			latched := *t
+			comp.qTable = &latched
 		}
 	}
+	if header.options.rows != nil && !header.options.coefficientsOnly {
+		startRows(header)
+	}
+	/** Begin the SCAN **/
+	buf.advance()
+	// The ECS is read as the coeffecients are decoded and ends at the next marker
+	scan := &scanReader{header: header, buffer: buf}
 	// Generate huffman codes for all the huffman tables
 	for t := range header.huffmanTables {
 		tb := &header.huffmanTables[t]
 		generateCodes(tb)
 	}
-	// Print the length of the bitstream
-	fmt.Printf("len(bitstream) = %d\n", len(_bitstream))
 	// Print the scan info
 	printScanInfo(header)
 	// Decode the Coeffecients
-	decodeHuffmanData(header, &BitReader{data: &_bitstream})
+	stage := header.options.profile.enter("huffman")
+	decodeHuffmanData(header, scan)
+	for c := range header.cComponents {
+		if header.cComponents[c].usedInScan {
+			header.cComponents[c].scanned = true
+		}
+	}
+	if regionDecoded(header) {
+		// The rest of the file isn't needed for the region
+		header.options.profile.enter(stage)
+		logf("len(bitstream) = %d, the region is decoded\n", scan.size)
+		header.scanCount++
+		renderRegion(header)
+		renderImage(header)
+		if header.options.rows != nil {
+			finishRows(header)
+		}
+		return
+	}
+	// Skip the rest of the ECS
+	for scan.fill() || scan.resume() {
+		scan.data = scan.data[:0]
+	}
+	if header.index != nil {
+		// The marker after the ECS
+		header.index.end = buf.pos - 2
+	}
+	header.options.profile.enter(stage)
+	// Print the length of the bitstream
+	logf("len(bitstream) = %d\n", scan.size)
+	header.scanCount++
+	previewScan(header)
 	// Continue reading the other markers
-
 	for {
 		if buf.bf[0] == 0xff {
 			buf.advance()
 			continue
 		}
-		// Check for markers
-		if buf.bf[0] == DRI && header.frameType == SOF2 {
+		if buf.bf[1] != 0xff {
+			fail(header, "Expected a Marker but found byte (%x)", buf.bf[0])
+		}
+		// Check for markers, the tables of a scan may be defined after the earlier scans (B.2.4)
+		if buf.bf[0] == DRI {
 			decodeDefineRestartInterval(header)
 			buf.advance()
-		}
-		if buf.bf[0] == SOS && header.frameType == SOF2 {
+		} else if buf.bf[0] == SOS {
 			decodeStartOfScan(header)
 			break
-		}
-		if buf.bf[0] == DHT && header.frameType == SOF2 {
+		} else if buf.bf[0] == DHT {
 			decodeDefineHuffmanTable(header)
 			buf.advance()
-		}
-		if buf.bf[0] == EOI {
-			dequantize(header)
-			inverseDCT(header)
-			spreadCoeffecients(header)
-			convertColorSpace(header)
-			writeBitMap(header)
-			fmt.Printf("*** Reached the end-of-image marker\n")
+		} else if buf.bf[0] == DQT {
+			decodeQuantizationTables(header)
+			buf.advance()
+		} else if buf.bf[0] == EOI {
+			if buf.truncated > 0 {
+				warn(header, "the file ends after %d bytes without an end-of-image marker", buf.pos)
+			}
+			if header.region != nil {
+				renderRegion(header)
+				renderImage(header)
+			} else if !header.options.coefficientsOnly && !header.streaming {
+				renderBlockRows(header, header.blockRowsRendered, header.blockHeightReal)
+				renderImage(header)
+			}
+			if header.options.rows != nil && !header.options.coefficientsOnly {
+				finishRows(header)
+			}
+			logf("*** Reached the end-of-image marker\n")
 			break
+		} else {
+			fail(header, "Unexpected marker (0xFF%X) after a scan", buf.bf[0])
 		}
 	}
 }
 
 func skipMarker(header *Header) {
 	buf := header.buffer
+	marker := buf.bf[0]
 	buf.advance()
 	buf.advance()
 	length := (int(buf.bf[1]) << 8) + int(buf.bf[0]) - 2
+	checkSegmentLimits(header, marker, length)
 	for a := 0; a < length; a++ {
 		buf.advance()
 	}
-	fmt.Printf("Skipped Marker (0xFF%X) Len (#%d) Bytes\n", buf.bf[0], length)
+	logf("Skipped Marker (0xFF%X) Len (#%d) Bytes\n", buf.bf[0], length)
 }
 
-func decodeJPEG(filename string) {
-	file, err := os.Open(filename)
-	if err != nil {
-		fmt.Printf("Error! %s\n", err.Error())
-		os.Exit(1)
+// Runs the block rows [start, end) through the pipeline and copies them into header.image,
+// start has to be the first row of an MCU
+func renderBlockRows(header *Header, start int, end int) {
+	if header.image == nil {
+		header.image = header.decoder.allocImage(header.width, header.height)
+	}
+	top, bottom := start*8, end*8
+	if bottom > header.height {
+		bottom = header.height
+	}
+	if top > bottom {
+		top = bottom
+	}
+	stride := header.width * 3
+	rows := &Image{width: header.width, height: bottom - top, pix: header.image.pix[top*stride : bottom*stride]}
+	renderBlocks(header, start, end, rows, 0, top)
+	header.blockRowsRendered = end
+	header.rowsAvailable = bottom
+}
+
+// Runs the blocks of the planes in the block rows [start, end) through the pipeline, img gets
+// the pixels from x, y of the image on
+func renderBlocks(header *Header, start int, end int, img *Image, x int, y int) {
+	profile := header.options.profile
+	stage := profile.enter("dequantize")
+	dequantize(header, start, end)
+	profile.enter("inverseDCT")
+	inverseDCT(header, start, end)
+	profile.enter("convertColorSpace")
+	convertColorSpace(header, img, x, y)
+	profile.enter(stage)
+}
+
+// Renders the whole MCU rows among the first end block rows that are not rendered yet
+func renderDecodedRows(header *Header, end int) {
+	end -= end % header.cComponents[0].vSamplingFactor
+	if end > header.blockRowsRendered {
+		renderBlockRows(header, header.blockRowsRendered, end)
+	}
+}
+
+// Applies the requested options to the rendered image
+func renderImage(header *Header) {
+	if convertsToSRGB(header) {
+		convertToSRGB(header.image, header.icc)
+	}
+	if header.options.autoOrient && header.exif != nil {
+		orientation := header.exif.orientation()
+		if orientation != 1 {
+			logf("Applying EXIF orientation (%d)\n", orientation)
+		}
+		header.image = orientImage(header.image, orientation)
+	}
+}
+
+// Renders the coefficients decoded so far without changing them
+func renderPreview(header *Header) *Image {
+	planes := header.planes
+	image := header.image
+	rendered, rows := header.blockRowsRendered, header.rowsAvailable
+	header.planes = make([]Plane, len(planes))
+	for c := range planes {
+		header.planes[c] = planes[c]
+		header.planes[c].blocks = append([][64]int16{}, planes[c].blocks...)
+	}
+	// A new image, the one of the decoder is still needed
+	header.image = newImage(header.width, header.height)
+	renderBlockRows(header, 0, header.blockHeightReal)
+	renderImage(header)
+	img := header.image
+	header.planes = planes
+	header.image = image
+	header.blockRowsRendered, header.rowsAvailable = rendered, rows
+	return img
+}
+
+// Calls the preview callback once a scan of a progressive file is decoded
+func previewScan(header *Header) {
+	if header.frameType != SOF2 || header.options.preview == nil {
+		return
+	}
+	if !header.options.previewDC {
+		header.options.preview(header, renderPreview(header), header.scanCount)
+		return
+	}
+	// Preview once the first DC scans of all components are decoded
+	if header.startOfSelection == 0 && header.successiveApproximationHigh == 0 {
+		for c := range header.cComponents {
+			if header.cComponents[c].usedInScan {
+				header.cComponents[c].dcDecoded = true
+			}
+		}
+	}
+	if header.previewed {
+		return
+	}
+	for c := range header.cComponents {
+		if !header.cComponents[c].dcDecoded {
+			return
+		}
 	}
-	stat, _ := file.Stat()
-	wd, _ := os.Getwd()
-	_filename := path.Join(wd, file.Name())
-	_filesize := stat.Size()
-	buffer := Buffer{f: file}
-	// Create the header
-	header := &Header{
-		filename: _filename,
-		filesize: uint(_filesize),
-		buffer:   &buffer,
+	header.previewed = true
+	header.options.preview(header, renderPreview(header), header.scanCount)
+}
+
+func decodeJPEG(filename string, options *Options) *Header {
+	return newDecoder(options).decodeFile(filename)
+}
+
+// Decodes a JPEG from a reader, the filename is only used to name the output
+func decodeJPEGReader(r io.ByteReader, filename string, options *Options) *Header {
+	header := newHeader(r, filename, options)
+	decodeMarkers(header)
+	return header
+}
+
+// Decodes a JPEG from a reader like decodeJPEGReader, but returns the errors instead of exiting
+func decodeJPEGSafe(r io.ByteReader, filename string, options *Options) (*Header, error) {
+	return newDecoder(options).decode(r, filename)
+}
+
+// Decodes that return their errors panic with a decodeError which is recovered where they started
+type decodeError struct {
+	err error
+}
+
+// Recovers a decodeError into err, other panics are passed on
+func recoverDecodeError(err *error) {
+	if r := recover(); r != nil {
+		e, ok := r.(decodeError)
+		if !ok {
+			panic(r)
+		}
+		*err = e.err
+	}
+}
+
+// Fails the decode: the error is printed and the decoder exits, or the decode returns it
+func fail(header *Header, format string, a ...interface{}) {
+	if header.buffer.panics {
+		panic(decodeError{fmt.Errorf(format, a...)})
+	}
+	fmt.Printf("Error! "+format+"\n", a...)
+	os.Exit(1)
+}
+
+// Records a problem the decoder worked around, the command line also prints it
+func warn(header *Header, format string, a ...interface{}) {
+	message := fmt.Sprintf(format, a...)
+	header.warnings = append(header.warnings, message)
+	if !header.buffer.panics {
+		fmt.Printf("Warning! %s\n", message)
+	}
+}
+
+func newHeader(r io.ByteReader, filename string, options *Options) *Header {
+	return &Header{
+		filename: filename,
+		buffer:   &Buffer{r: r, tolerant: options.tolerant},
+		options:  options,
 	}
+}
+
+// Parses the markers of the image from the start-of-image marker on
+func decodeMarkers(header *Header) {
+	stage := header.options.profile.enter("markers")
+	defer header.options.profile.enter(stage)
+	buffer := header.buffer
 	buffer.advance()
 	buffer.advance()
-	if buffer.bf[1] != 0xFF && buffer.bf[0] != SOI {
-		fmt.Printf("Error! The file is not a valid JPEG\n")
-		os.Exit(1)
+	if buffer.bf[1] != 0xFF || buffer.bf[0] != SOI {
+		fail(header, "The file is not a valid JPEG")
 	}
 	// For loop for parsig all the markers
 	buffer.advance()
 	buffer.advance()
 	for {
 		if buffer.bf[1] != 0xFF {
-			fmt.Printf("Error! Expected a Marker but found byte (%x)\n", buffer.bf[1])
-			os.Exit(1)
+			fail(header, "Expected a Marker but found byte (%x)", buffer.bf[1])
 		}
 		// The standard allows for any number of 0xFF bytes to precede the marker
 		if buffer.bf[0] == 0xFF {
@@ -1121,36 +1553,37 @@ func decodeJPEG(filename string) {
 		} else if buffer.bf[0] == DHT {
 			decodeDefineHuffmanTable(header)
 		} else if buffer.bf[0] == SOS {
+			decodeICCProfile(header)
+			decodeXMP(header)
+			decodeIPTC(header)
+			if header.options.metadataOnly {
+				break
+			}
 			decodeStartOfScan(header)
 			break
 		} else if (buffer.bf[0] >= JPG0 && buffer.bf[0] <= JPG13) ||
 			(buffer.bf[0] == DNL) ||
 			(buffer.bf[0] == DHP) ||
-			(buffer.bf[0] == EXP) ||
-			(buffer.bf[0] == COM) {
+			(buffer.bf[0] == EXP) {
 			skipMarker(header)
+		} else if buffer.bf[0] == COM {
+			decodeComment(header)
 		} else if buffer.bf[0] == TEM {
 			// TEM has no size nor payload
 		} else if buffer.bf[0] == EOI {
-			fmt.Printf("Error! Found EOI Marker (0xFF%X) before the Start Of Scan Marker\n", buffer.bf[0])
-			os.Exit(1)
+			fail(header, "Found EOI Marker (0xFF%X) before the Start Of Scan Marker", buffer.bf[0])
 		} else if buffer.bf[0] == SOI {
-			fmt.Printf("Error! Embeded JPG not supported\n")
-			os.Exit(1)
+			fail(header, "Unexpected SOI marker, embedded images are decoded through their MPF index")
 		} else if buffer.bf[0] == DAC {
-			fmt.Printf("Error! Arithmetic Coding not supported\n")
-			os.Exit(1)
+			fail(header, "Arithmetic Coding not supported")
 		} else if buffer.bf[0] >= SOF0 && buffer.bf[0] <= SOF15 {
-			fmt.Printf("Error! SOF Marker (0xFF%X) not supported\n", buffer.bf[0])
-			os.Exit(1)
+			fail(header, "SOF Marker (0xFF%X) not supported", buffer.bf[0])
 		} else {
-			fmt.Printf("Invalid Marker (0xFF%X)\n", buffer.bf[0])
-			os.Exit(1)
+			fail(header, "Invalid Marker (0xFF%X)", buffer.bf[0])
 		}
 		buffer.advance()
 		buffer.advance()
 	}
-	file.Close()
 }
 
 func generateCodes(tb *HuffmanTable) {
@@ -1168,57 +1601,71 @@ func generateCodes(tb *HuffmanTable) {
 	}
 }
 
-func writeBitMap(header *Header) {
-	paddingSize := header.width % 4
-	size := 14 + 12 + (header.height * header.width * 3) + (paddingSize * header.height)
+func writeBitMap(filename string, img *Image, density Density) {
 	// Create the file
-	//filename := header.filename
-	filename := path.Base(header.filename)
-	i := strings.LastIndex(filename, ".")
-	filename = filename[:i]
-	filename += ".bmp"
 	f, err := os.Create(filename)
 	if err != nil {
 		fmt.Printf("Error! %s\n", err.Error())
 		os.Exit(1)
 	}
-	fmt.Printf("Writing bitmap to %s ... \n", filename)
+	logf("Writing bitmap to %s ... \n", filename)
+	encodeBitMap(f, img, density)
+	f.Close()
+}
+
+// The size of the file header and the DIB header of a BMP, the pixel array follows them
+const bitMapHeaderSize = 14 + 40
+
+// Returns the headers of a 24 bit BMP
+func bitMapHeader(width int, height int, density Density) []byte {
+	paddingSize := width % 4
+	imageSize := (height * width * 3) + (paddingSize * height)
+	size := bitMapHeaderSize + imageSize
+	w := &bytes.Buffer{}
 	// Write 'B' 'M'
-	f.Write([]byte("BM"))  // BM
-	put4Int(uint(size), f) // The size of the file as a 4 byte integer
-	put4Int(uint(0), f)    // 4 zeros as 4 byte integer
-	put4Int(uint(26), f)   // The pixel array offset as a 4 byte integer
-	// The DIB Header
-	put4Int(12, f)                  // The size of the DIB header as a 4 byte integer
-	put2Int(uint(header.width), f)  // The height as a 2 byte integer
-	put2Int(uint(header.height), f) // The width as a 2 byte integer
-	put2Int(uint(1), f)             // The number of planes as 2 bit integer
-	put2Int(uint(24), f)            // The number of bits per pixel as 2 bit integer
-
-	for y := header.height - 1; y >= 0; y-- {
-		blockRow := y / 8
-		pixelRow := y % 8
-		for x := 0; x < header.width; x++ {
-			blockColumn := x / 8
-			pixelColumn := x % 8
-			blockIndex := blockColumn + blockRow*header.blockWidthReal
-			pixelIndex := pixelColumn + pixelRow*8
-			// write the 'rgb' values
-			block := (*header.blocks)[blockIndex]
-			rgbData := []byte{}
-			rgbData = append(rgbData, byte(block.ch3[pixelIndex]))
-			rgbData = append(rgbData, byte(block.ch2[pixelIndex]))
-			rgbData = append(rgbData, byte(block.ch1[pixelIndex]))
-			f.Write(rgbData)
+	w.Write([]byte("BM"))              // BM
+	put4Int(uint(size), w)             // The size of the file as a 4 byte integer
+	put4Int(uint(0), w)                // 4 zeros as 4 byte integer
+	put4Int(uint(bitMapHeaderSize), w) // The pixel array offset as a 4 byte integer
+	// The DIB Header (BITMAPINFOHEADER)
+	put4Int(40, w)                      // The size of the DIB header as a 4 byte integer
+	put4Int(uint(width), w)             // The width as a 4 byte integer
+	put4Int(uint(height), w)            // The height as a 4 byte integer
+	put2Int(uint(1), w)                 // The number of planes as 2 bit integer
+	put2Int(uint(24), w)                // The number of bits per pixel as 2 bit integer
+	put4Int(uint(0), w)                 // No compression
+	put4Int(uint(imageSize), w)         // The size of the pixel array
+	put4Int(dotsPerMeter(density.x), w) // The horizontal resolution in pixels per meter
+	put4Int(dotsPerMeter(density.y), w) // The vertical resolution in pixels per meter
+	put4Int(uint(0), w)                 // The number of colors in the palette
+	put4Int(uint(0), w)                 // The number of important colors
+	return w.Bytes()
+}
+
+// Writes an image as a 24 bit BMP
+func encodeBitMap(out io.Writer, img *Image, density Density) {
+	paddingSize := img.width % 4
+	w := bufio.NewWriter(out)
+	w.Write(bitMapHeader(img.width, img.height, density))
+
+	for y := img.height - 1; y >= 0; y-- {
+		for x := 0; x < img.width; x++ {
+			p := (x + y*img.width) * 3
+			// write the 'bgr' values
+			rgbData := []byte{img.pix[p+2], img.pix[p+1], img.pix[p]}
+			w.Write(rgbData)
 		}
 		padding := make([]byte, paddingSize)
-		f.Write(padding)
+		w.Write(padding)
+	}
+	if err := w.Flush(); err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
 	}
-	f.Close()
 }
 
 // Helper function to write a 4 byte integer in little endian
-func put4Int(a uint, f *os.File) {
+func put4Int(a uint, f io.Writer) {
 	data := make([]byte, 4)
 	data[0] = byte((a >> 0) & 0xFF)
 	data[1] = byte((a >> 8) & 0xFF)
@@ -1232,7 +1679,7 @@ func put4Int(a uint, f *os.File) {
 }
 
 // Helper function to write a 2 byte integer in little endian
-func put2Int(a uint, f *os.File) {
+func put2Int(a uint, f io.Writer) {
 	data := make([]byte, 2)
 	data[0] = byte((a >> 0) & 0xFF)
 	data[1] = byte((a >> 8) & 0xFF)
@@ -1243,27 +1690,138 @@ func put2Int(a uint, f *os.File) {
 	}
 }
 
-type Block struct {
-	ch1 [64]int
-	ch2 [64]int
-	ch3 [64]int
+// The blocks of a component on its own sampling grid, padded to whole MCUs. They hold the
+// coefficients in natural order and, once rendered, the samples. A plane can hold only a part
+// of the grid (a region or a streamed MCU row), its first block is then not at 0, 0.
+type Plane struct {
+	blocksWide int
+	blocksHigh int
+	blockX     int // The first block of the plane on the grid of the component
+	blockY     int
+	blocks     [][64]int16
+}
+
+// Returns the block bx, by of the grid of the component, nil if the plane doesn't hold it
+func (plane *Plane) block(bx int, by int) *[64]int16 {
+	bx -= plane.blockX
+	by -= plane.blockY
+	if bx < 0 || by < 0 || bx >= plane.blocksWide || by >= plane.blocksHigh {
+		return nil
+	}
+	return &plane.blocks[bx+by*plane.blocksWide]
 }
 
 type BitReader struct {
-	data     *[]byte
-	nextByte int
-	nextBit  int
+	data      *[]byte
+	nextByte  int
+	nextBit   int
+	fill      func() bool // Appends more data, returns false at the end of the data
+	exhausted bool        // Was a bit read past the end of the data
 }
 
-// Todo: Handle restart interval
-func (br *BitReader) align() {
-	if br.nextByte >= len(*br.data) {
-		return
+// Reads the ECS of a scan as it is needed, it stops at the next marker
+type scanReader struct {
+	header   *Header
+	buffer   *Buffer
+	data     []byte // The bytes of the ECS that are not read yet
+	offset   int64  // The offset in the file of the last byte of data
+	size     int    // The bytes of the ECS so far
+	consumed bool   // Is buf.bf[0] already used
+	done     bool
+	marker   byte // The marker the ECS stopped at
+}
+
+// Appends the next byte of the ECS to data, returns false once a marker is reached
+func (s *scanReader) fill() bool {
+	buf := s.buffer
+	for !s.done {
+		if s.consumed {
+			buf.advance()
+			s.consumed = false
+		}
+		if buf.bf[0] != 0xFF {
+			s.data = append(s.data, buf.bf[0])
+			s.offset = buf.pos - 1
+			s.size++
+			s.consumed = true
+			return true
+		}
+		buf.advance()
+		if buf.bf[0] == 0xFF {
+			s.consumed = true
+		} else if buf.bf[0] >= RST0 && buf.bf[0] <= RST7 {
+			s.done = true
+		} else if buf.bf[0] == EOI {
+			s.done = true
+		} else if buf.bf[0] == DRI || buf.bf[0] == DHT || buf.bf[0] == DQT || buf.bf[0] == SOS {
+			// The segments before the next scan
+			s.done = true
+		} else if buf.bf[0] == 0x00 {
+			// If one or more than one '0xff' bytes is followed by '0x00' then save a single '0xff'
+			s.data = append(s.data, 0xff)
+			s.offset = buf.pos - 2
+			s.size++
+			s.consumed = true
+			return true
+		} else if s.header.options.tolerant {
+			warn(s.header, "scan %d: dropped an invalid marker (0xFF%02X)", s.header.scanCount+1, buf.bf[0])
+			s.consumed = true
+		} else {
+			fail(s.header, "Invalid marker (0xFF%X) found in the bitsteam", buf.bf[0])
+		}
+		if s.done {
+			s.marker = buf.bf[0]
+		}
 	}
-	if br.nextBit != 0 {
-		br.nextBit = 0
-		br.nextByte += 1
+	return false
+}
+
+// Continues after an RSTn marker, returns false if the ECS stopped at another marker
+func (s *scanReader) resume() bool {
+	if !s.done || s.marker < RST0 || s.marker > RST7 {
+		return false
+	}
+	s.done = false
+	s.consumed = true
+	s.marker = 0
+	return true
+}
+
+// Drops the rest of the data before the next marker and returns the marker
+func (s *scanReader) skipToMarker(br *BitReader) byte {
+	for s.fill() {
+		s.data = s.data[:0]
 	}
+	s.data = s.data[:0]
+	br.nextByte = 0
+	br.nextBit = 0
+	return s.marker
+}
+
+// Returns the offset in the file of the byte that holds the next bit of br and the bits of
+// it that are already read. The bit reader drops the bytes it has read, so data holds at
+// most the byte it is in.
+func (s *scanReader) position(br *BitReader) (int64, int) {
+	if br.nextByte < len(s.data) {
+		return s.offset, br.nextBit
+	}
+	if s.consumed {
+		return s.buffer.pos, 0
+	}
+	return s.buffer.pos - 1, 0
+}
+
+// Continues the ECS at an entry of a restart index, the buffer has to seek in the file
+func (s *scanReader) seek(br *BitReader, e IndexEntry) {
+	s.buffer.seek(e.offset)
+	s.data = s.data[:0]
+	s.consumed = false
+	s.done = false
+	s.marker = 0
+	br.nextByte = 0
+	br.nextBit = 0
+	br.exhausted = false
+	br.readBits(e.bit)
 }
 
 // Helper function used to read individual bits
@@ -1271,7 +1829,17 @@ func (br *BitReader) align() {
 func (br *BitReader) readBit() int {
 	b := 0
 	if br.nextByte >= len(*br.data) {
-		return -1
+		if br.fill == nil {
+			br.exhausted = true
+			return -1
+		}
+		// The bytes that are read are dropped, so the data of a scan isn't kept
+		*br.data = (*br.data)[:0]
+		br.nextByte = 0
+		if !br.fill() {
+			br.exhausted = true
+			return -1
+		}
 	}
 	b = (int((*br.data)[br.nextByte]) >> (7 - br.nextBit)) & 1
 	br.nextBit++
@@ -1442,10 +2010,16 @@ const (
 )
 
 type QuantizationTable struct {
-	table [64]byte
+	table [64]uint16
 	Id    int
 }
 
+// A marker segment that is kept as read from the file
+type Segment struct {
+	marker byte
+	data   []byte // The payload without the marker and the length
+}
+
 type HuffmanTable struct {
 	Id         int
 	codes      []int
@@ -1479,15 +2053,77 @@ type Header struct {
 	successiveApproximationHigh byte
 	successiveApproximationLow  byte
 	zeroBased                   bool
-	componentsInScan            int  // The numnber of components used in the scan
-	frameType                   byte // SOF0 or SOF2
+	componentsInScan            int   // The numnber of components used in the scan
+	frameType                   byte  // SOF0 or SOF2
+	scanCount                   int   // The number of scans decoded so far
+	previewed                   bool  // Is the DC preview done
+	blockRowsRendered           int   // The block rows that went through the pipeline
+	rowsAvailable               int   // The pixel rows of header.image that are decoded
+	metadataSize                int64 // The bytes of the APPn and COM segments read so far
 	/**/
-	blocks          *[]Block
-	blockWidth      int
+	planes          []Plane // The blocks of each component
+	blockWidth      int     // The blocks of the luminance in the image
 	blockHeight     int
-	blockWidthReal  int
+	blockWidthReal  int // The blocks of the luminance padded to whole MCUs
 	blockHeightReal int
-	blockCount      int
+	blockCount      int           // The blocks of all the planes
+	streaming       bool          // The planes hold one MCU row whose rows go to options.rows
+	region          *Region       // The region of options.region clipped to the image
+	index           *RestartIndex // The index built with options.buildIndex
+	decoder         *Decoder      // Reuses the memory of earlier decodes when not nil
+	/**/
+	options *Options
+	exif    *Exif
+	jfif    *JFIF
+	jfxx    *JFXX
+	/**/
+	iccChunks []ICCChunk
+	icc       *ICCProfile
+	/**/
+	xmpPacket     []byte
+	xmpExtensions []XMPExtension
+	xmp           map[string][]string
+	photoshop     []byte
+	iptc          map[string][]string
+	comments      []string
+	mpf           *MPF
+	segments      []Segment // The APPn and COM segments in the order they were read
+	image         *Image    // The decoded image, baseline images are filled in as the rows are decoded
+	warnings      []string  // The problems the decoder worked around
+}
+
+// Options that change how an image is decoded
+type Options struct {
+	autoOrient bool   // Apply the EXIF orientation to the decoded image
+	format     string // The output format: bmp, png, ppm, tiff or jpg
+	thumbnail  bool   // Also write the embedded thumbnail
+	toSRGB     bool   // Convert from the embedded ICC profile to sRGB
+	// Decode truncated and corrupt files as far as possible, damaged MCUs are left gray
+	// (or as the earlier scans left them) and described in header.warnings
+	tolerant bool
+	// Fail on every violation of the structure of the file instead of only on the ones
+	// the decoder can't work around, the others are described in header.warnings
+	strict bool
+	/**/
+	metadataOnly     bool // Stop at the first Start Of Scan marker
+	coefficientsOnly bool // Stop at the end-of-image marker and keep the quantized coefficients
+	// Called with the image rendered from the scans decoded so far after each scan of a
+	// progressive file, or only once after the first DC scans of all components with previewDC
+	preview   func(header *Header, img *Image, scans int)
+	previewDC bool
+	limits    Limits
+	profile   *Profile // Counts the time spent in each stage when not nil
+	// Gets the rows of the image as they are decoded instead of header.image keeping them all,
+	// see startRows
+	rows RowWriter
+	// Decode only this rectangle of the image, header.image is the size of the region
+	region *Region
+	// Build header.index while the first scan is read, see buildIndex
+	buildIndex bool
+	// The restart index of the file: the region jumps to its restart intervals and with more
+	// than one worker the intervals are decoded in parallel, see decodeJPEGIndexed
+	index   *RestartIndex
+	workers int
 }
 
 type ColorComponent struct {
@@ -1498,16 +2134,151 @@ type ColorComponent struct {
 	acHuffmanTableId int
 	dcHuffmanTableId int
 	usedInScan       bool // Is this component used in the scan
+	dcDecoded        bool // Is the first DC scan of the component decoded
+	scanned          bool // Was the component in one of the scans so far
+	// The quantization table of the component, latched at its first scan
+	qTable *QuantizationTable
 }
 
 func main() {
-	if len(os.Args) < 2 {
+	if len(os.Args) > 1 && os.Args[1] == "info" {
+		infoCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "mpf" {
+		mpfCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "encode" {
+		encodeCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "optimize" {
+		optimizeCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "coeffs" {
+		coeffsCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "transform" {
+		transformCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "crop" {
+		cropCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "edit" {
+		editCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "stream" {
+		streamCommand(os.Args[2:])
+		return
+	}
+	if len(os.Args) > 1 && os.Args[1] == "index" {
+		indexCommand(os.Args[2:])
+		return
+	}
+	options := &Options{}
+	flag.BoolVar(&options.autoOrient, "orient", false, "apply the EXIF orientation to the decoded image")
+	flag.StringVar(&options.format, "format", "bmp", "output format: bmp, png, ppm, tiff or jpg")
+	flag.BoolVar(&options.thumbnail, "thumbnail", false, "also write the embedded thumbnail")
+	flag.BoolVar(&options.toSRGB, "srgb", false, "convert from the embedded ICC profile to sRGB")
+	flag.BoolVar(&options.tolerant, "tolerant", false, "decode truncated and corrupt files as far as possible")
+	flag.BoolVar(&options.strict, "strict", false, "fail on every violation of the structure of the file")
+	limitFlags(flag.CommandLine, &options.limits)
+	preview := flag.String("preview", "", "write the image after every scan (scans) or after the DC scans (dc) of a progressive file")
+	profile := flag.Bool("profile", false, "print the time spent in each stage of the decoder")
+	cpuProfile := flag.String("cpuprofile", "", "write a pprof CPU profile to the file")
+	memProfile := flag.String("memprofile", "", "write a pprof heap profile to the file")
+	stream := flag.Bool("stream", false, "write the rows of baseline images as they are decoded instead of keeping the whole image")
+	region := flag.String("region", "", "decode only the rectangle WxH+X+Y of the image")
+	index := flag.Bool("index", false, "use the restart index in <name>.idx (see dec index) for -region and -workers")
+	flag.IntVar(&options.workers, "workers", 1, "decode the restart intervals of the index with this many goroutines")
+	flag.Parse()
+	suffix := ""
+	if *region != "" {
+		r := Region{}
+		if _, err := fmt.Sscanf(*region, "%dx%d+%d+%d", &r.width, &r.height, &r.x, &r.y); err != nil {
+			fmt.Printf("Error! Invalid region (%s), expected WxH+X+Y\n", *region)
+			os.Exit(1)
+		}
+		options.region = &r
+		suffix = "-region"
+	}
+	if *stream && *region != "" {
+		fmt.Printf("Error! -stream and -region can't be used together\n")
+		os.Exit(1)
+	}
+	if *stream && *index {
+		fmt.Printf("Error! -stream and -index can't be used together\n")
+		os.Exit(1)
+	}
+	if options.workers > 1 && !*index {
+		fmt.Printf("Error! -workers needs the restart index of -index\n")
+		os.Exit(1)
+	}
+	if *stream && options.format != "bmp" && options.format != "ppm" && options.format != "png" {
+		fmt.Printf("Error! -stream writes bmp, ppm or png, not %s\n", options.format)
+		os.Exit(1)
+	}
+	if *stream && options.autoOrient {
+		fmt.Printf("Error! -stream can't apply the EXIF orientation\n")
+		os.Exit(1)
+	}
+	switch *preview {
+	case "":
+	case "scans", "dc":
+		options.previewDC = *preview == "dc"
+		options.preview = func(header *Header, img *Image, scans int) {
+			writeImage(header, img, fmt.Sprintf("-scan%d", scans))
+		}
+	default:
+		fmt.Printf("Error! Invalid preview (%s), expected scans or dc\n", *preview)
+		os.Exit(1)
+	}
+	if flag.NArg() < 1 {
 		fmt.Printf("Error! No file given\n")
 		os.Exit(1)
 	}
-	fmt.Printf("***** JPEG Decoder by Maxwell Mbugua *****\n\n")
-	filenames := os.Args[1:]
+	if *profile {
+		options.profile = newProfile()
+	}
+	if *cpuProfile != "" {
+		defer startCPUProfile(*cpuProfile)()
+	}
+	logf("***** JPEG Decoder by Maxwell Mbugua *****\n\n")
+	filenames := flag.Args()
+	// The image of a file is written before the next one reuses its memory
+	decoder := newDecoder(options)
 	for a := range filenames {
-		decodeJPEG(filenames[a])
+		var header *Header
+		if *stream {
+			header = streamImage(decoder, filenames[a])
+		} else if *index {
+			header = decodeIndexedFile(decoder, filenames[a])
+			options.profile.enter("writeImage")
+			writeImage(header, header.image, suffix)
+		} else {
+			header = decoder.decodeFile(filenames[a])
+			options.profile.enter("writeImage")
+			writeImage(header, header.image, suffix)
+		}
+		if options.thumbnail {
+			thumb := thumbnailImage(header)
+			if thumb == nil {
+				logf("No embedded thumbnail found in %s\n", filenames[a])
+			} else {
+				writeImage(header, thumb, "-thumb")
+			}
+		}
+		if options.profile != nil {
+			options.profile.print(filenames[a])
+		}
+	}
+	if *memProfile != "" {
+		writeHeapProfile(*memProfile)
 	}
 }
@@ -0,0 +1,487 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// The identifiers at the start of APP1 XMP and APP13 Photoshop payloads
+var xmpIdentifier = []byte("http://ns.adobe.com/xap/1.0/\x00")
+var xmpExtensionIdentifier = []byte("http://ns.adobe.com/xmp/extension/\x00")
+var photoshopIdentifier = []byte("Photoshop 3.0\x00")
+
+// The Photoshop image resource that holds the IPTC-IIM records
+const iptcResourceId = 0x0404
+
+// IPTC-IIM application record (2) datasets
+var iptcNames = map[int]string{
+	5:   "ObjectName",
+	25:  "Keywords",
+	55:  "DateCreated",
+	80:  "By-line",
+	85:  "By-lineTitle",
+	90:  "City",
+	95:  "Province-State",
+	101: "Country",
+	105: "Headline",
+	110: "Credit",
+	115: "Source",
+	116: "CopyrightNotice",
+	120: "Caption-Abstract",
+	122: "Writer-Editor",
+}
+
+// An extended XMP packet that is split across several APP1 segments
+type XMPExtension struct {
+	guid     string
+	length   int
+	chunks   []XMPChunk // The chunks as they were read, see assemble
+	received int
+}
+
+// A chunk of an extended XMP packet at its offset in the packet
+type XMPChunk struct {
+	offset int
+	data   []byte
+}
+
+// Puts the chunks of a complete packet together. The packet is only allocated once all the
+// bytes arrived, so the full length in the file can't make the decoder allocate more than
+// the segments it read.
+func (ext *XMPExtension) assemble() []byte {
+	data := make([]byte, ext.length)
+	for _, chunk := range ext.chunks {
+		copy(data[chunk.offset:], chunk.data)
+	}
+	return data
+}
+
+// The descriptive metadata of an image, gathered from XMP, IPTC, EXIF and COM
+type Metadata struct {
+	Filename    string              `json:"filename"`
+	Width       int                 `json:"width"`
+	Height      int                 `json:"height"`
+	Title       string              `json:"title,omitempty"`
+	Caption     string              `json:"caption,omitempty"`
+	Keywords    []string            `json:"keywords,omitempty"`
+	Creators    []string            `json:"creators,omitempty"`
+	Copyright   string              `json:"copyright,omitempty"`
+	Rating      *float64            `json:"rating,omitempty"`
+	Comments    []string            `json:"comments,omitempty"`
+	DPI         *[2]float64         `json:"dpi,omitempty"`
+	ICCProfile  string              `json:"iccProfile,omitempty"`
+	Orientation int                 `json:"orientation,omitempty"`
+	GPS         *[2]float64         `json:"gps,omitempty"`
+	EXIF        map[string]string   `json:"exif,omitempty"`
+	XMP         map[string][]string `json:"xmp,omitempty"`
+	IPTC        map[string][]string `json:"iptc,omitempty"`
+	MPF         []string            `json:"mpf,omitempty"`
+}
+
+// Parses an XMP packet into a map of 'prefix:name' -> values.
+// Array items (rdf:Bag, rdf:Seq, rdf:Alt) become multiple values and
+// the fields of structures are stored as 'field=value' under the property.
+func parseXMP(data []byte) (map[string][]string, error) {
+	props := map[string][]string{}
+	decoder := xml.NewDecoder(bytes.NewReader(data))
+	decoder.Strict = false
+	// The property that is currently being read and the depth it was found at
+	property := ""
+	propertyDepth := 0
+	depth := 0
+	inDescription := 0
+	text := ""
+	for {
+		token, err := decoder.RawToken()
+		if token == nil || err != nil {
+			break
+		}
+		switch t := token.(type) {
+		case xml.StartElement:
+			depth++
+			name := t.Name.Space + ":" + t.Name.Local
+			text = ""
+			if name == "rdf:Description" && property == "" {
+				inDescription = depth
+				// Simple properties can be written as attributes of the description
+				for a := range t.Attr {
+					attr := t.Attr[a]
+					if attr.Name.Space == "xmlns" || attr.Name.Space == "rdf" || attr.Name.Space == "" {
+						continue
+					}
+					key := attr.Name.Space + ":" + attr.Name.Local
+					props[key] = append(props[key], attr.Value)
+				}
+				continue
+			}
+			if inDescription != 0 && property == "" && depth == inDescription+1 {
+				property = name
+				propertyDepth = depth
+				if _, ok := props[property]; !ok {
+					props[property] = []string{}
+				}
+			}
+			// Structure fields written as attributes
+			if property != "" {
+				for a := range t.Attr {
+					attr := t.Attr[a]
+					if attr.Name.Space == "xmlns" || attr.Name.Space == "rdf" || attr.Name.Space == "xml" {
+						continue
+					}
+					props[property] = append(props[property], attr.Name.Space+":"+attr.Name.Local+"="+attr.Value)
+				}
+			}
+		case xml.CharData:
+			text += string(t)
+		case xml.EndElement:
+			name := t.Name.Space + ":" + t.Name.Local
+			value := strings.TrimSpace(text)
+			text = ""
+			if property != "" && value != "" {
+				if depth == propertyDepth || name == "rdf:li" {
+					props[property] = append(props[property], value)
+				} else {
+					props[property] = append(props[property], name+"="+value)
+				}
+			}
+			if depth == propertyDepth {
+				property = ""
+			}
+			if depth == inDescription {
+				inDescription = 0
+			}
+			depth--
+		}
+	}
+	if len(props) == 0 {
+		return nil, errors.New("no XMP properties found")
+	}
+	return props, nil
+}
+
+func decodeXMPExtension(header *Header, data []byte) {
+	// GUID (32) + full length (4) + offset (4)
+	if len(data) < 40 {
+		warn(header, "Extended XMP segment too short")
+		return
+	}
+	guid := string(data[:32])
+	length := int(binary.BigEndian.Uint32(data[32:]))
+	offset := int(binary.BigEndian.Uint32(data[36:]))
+	chunk := data[40:]
+	var ext *XMPExtension
+	for e := range header.xmpExtensions {
+		if header.xmpExtensions[e].guid == guid {
+			ext = &header.xmpExtensions[e]
+		}
+	}
+	if ext == nil {
+		header.xmpExtensions = append(header.xmpExtensions, XMPExtension{guid: guid, length: length})
+		ext = &header.xmpExtensions[len(header.xmpExtensions)-1]
+	}
+	if length != ext.length || offset+len(chunk) > ext.length || ext.received+len(chunk) > ext.length {
+		warn(header, "Extended XMP chunk (offset %d) does not fit the packet length %d", offset, ext.length)
+		return
+	}
+	ext.chunks = append(ext.chunks, XMPChunk{offset: offset, data: chunk})
+	ext.received += len(chunk)
+	logf("Extended XMP                 : %s %d/%d bytes\n", guid, ext.received, ext.length)
+}
+
+// Parses the XMP packet and merges the extended XMP packet it references
+func decodeXMP(header *Header) {
+	if header.xmpPacket == nil {
+		return
+	}
+	props, err := parseXMP(header.xmpPacket)
+	if err != nil {
+		warn(header, "Invalid XMP packet: %s", err.Error())
+		return
+	}
+	if guid := props["xmpNote:HasExtendedXMP"]; len(guid) == 1 {
+		for e := range header.xmpExtensions {
+			ext := &header.xmpExtensions[e]
+			if ext.guid != guid[0] {
+				continue
+			}
+			if ext.received != ext.length {
+				warn(header, "Extended XMP %s is incomplete (%d/%d bytes)", ext.guid, ext.received, ext.length)
+				break
+			}
+			extProps, err := parseXMP(ext.assemble())
+			if err != nil {
+				warn(header, "Invalid extended XMP packet: %s", err.Error())
+				break
+			}
+			for key, values := range extProps {
+				props[key] = append(props[key], values...)
+			}
+		}
+	}
+	header.xmp = props
+	logf("*** XMP (%d properties) ***\n", len(props))
+}
+
+// Parses the Photoshop image resource blocks and returns the IPTC-IIM data
+func parsePhotoshopResources(data []byte) ([]byte, error) {
+	for len(data) > 0 {
+		if len(data) < 12 || string(data[:4]) != "8BIM" {
+			return nil, errors.New("invalid image resource block")
+		}
+		id := binary.BigEndian.Uint16(data[4:])
+		// The name is a pascal string padded to an even size
+		nameLength := int(data[6]) + 1
+		if nameLength%2 == 1 {
+			nameLength++
+		}
+		pos := 6 + nameLength
+		if pos+4 > len(data) {
+			return nil, errors.New("image resource block truncated")
+		}
+		size := int(binary.BigEndian.Uint32(data[pos:]))
+		pos += 4
+		if pos+size > len(data) {
+			return nil, fmt.Errorf("image resource 0x%04X truncated", id)
+		}
+		if id == iptcResourceId {
+			return data[pos : pos+size], nil
+		}
+		if size%2 == 1 {
+			size++
+		}
+		if pos+size >= len(data) {
+			break
+		}
+		data = data[pos+size:]
+	}
+	return nil, nil
+}
+
+// Parses IPTC-IIM datasets into a map of 'record:dataset' names -> values
+func parseIPTC(data []byte) (map[string][]string, error) {
+	records := map[string][]string{}
+	for len(data) > 0 {
+		if data[0] != 0x1C {
+			// Padding at the end of the block
+			if data[0] == 0 {
+				break
+			}
+			return records, fmt.Errorf("invalid IPTC tag marker (0x%X)", data[0])
+		}
+		if len(data) < 5 {
+			return records, errors.New("IPTC dataset truncated")
+		}
+		record := int(data[1])
+		dataset := int(data[2])
+		size := int(binary.BigEndian.Uint16(data[3:]))
+		pos := 5
+		// Extended datasets give the number of bytes holding the size
+		if size&0x8000 != 0 {
+			n := size & 0x7FFF
+			if n > 4 || pos+n > len(data) {
+				return records, errors.New("invalid extended IPTC dataset")
+			}
+			size = 0
+			for a := 0; a < n; a++ {
+				size = (size << 8) + int(data[pos+a])
+			}
+			pos += n
+		}
+		if pos+size > len(data) {
+			return records, fmt.Errorf("IPTC dataset %d:%d truncated", record, dataset)
+		}
+		value := string(data[pos : pos+size])
+		if record == 2 {
+			name, ok := iptcNames[dataset]
+			if !ok {
+				name = fmt.Sprintf("2:%d", dataset)
+			}
+			records[name] = append(records[name], value)
+		}
+		data = data[pos+size:]
+	}
+	return records, nil
+}
+
+// Parses the Photoshop APP13 segments once all the APPN markers have been read
+func decodeIPTC(header *Header) {
+	if header.photoshop == nil {
+		return
+	}
+	data, err := parsePhotoshopResources(header.photoshop)
+	if err != nil {
+		warn(header, "Invalid Photoshop segment: %s", err.Error())
+		return
+	}
+	if data == nil {
+		return
+	}
+	records, err := parseIPTC(data)
+	if err != nil {
+		warn(header, "Invalid IPTC data: %s", err.Error())
+	}
+	header.iptc = records
+	logf("*** IPTC (%d datasets) ***\n", len(records))
+}
+
+func decodeComment(header *Header) {
+	logf("** Decoding Comment (0xFF%X) **\n", header.buffer.bf[0])
+	data := readSegment(header)
+	header.segments = append(header.segments, Segment{marker: COM, data: data})
+	comment := strings.TrimRight(string(data), "\x00")
+	header.comments = append(header.comments, comment)
+	logf("Comment                      : %s\n", comment)
+}
+
+// Helper function to return the first value of a property
+func first(values []string) string {
+	if len(values) == 0 {
+		return ""
+	}
+	return values[0]
+}
+
+// Helper function to add values to a list without duplicates
+func appendUnique(list []string, values ...string) []string {
+	for v := range values {
+		found := false
+		for l := range list {
+			if list[l] == values[v] {
+				found = true
+			}
+		}
+		if !found && values[v] != "" {
+			list = append(list, values[v])
+		}
+	}
+	return list
+}
+
+// Gathers the metadata of a decoded image.
+// XMP takes precedence over IPTC which takes precedence over EXIF.
+func collectMetadata(header *Header) *Metadata {
+	meta := &Metadata{
+		Filename: header.filename,
+		Width:    header.width,
+		Height:   header.height,
+		Comments: header.comments,
+		XMP:      header.xmp,
+		IPTC:     header.iptc,
+	}
+	xmp := header.xmp
+	iptc := header.iptc
+	var exifString = func(id uint16) string {
+		if header.exif == nil {
+			return ""
+		}
+		if tag := header.exif.tag(id); tag != nil {
+			return tag.stringValue()
+		}
+		return ""
+	}
+	meta.Title = first(xmp["dc:title"])
+	if meta.Title == "" {
+		meta.Title = first(iptc["ObjectName"])
+	}
+	meta.Caption = first(xmp["dc:description"])
+	if meta.Caption == "" {
+		meta.Caption = first(iptc["Caption-Abstract"])
+	}
+	if meta.Caption == "" {
+		meta.Caption = exifString(tagImageDescription)
+	}
+	meta.Keywords = appendUnique(meta.Keywords, xmp["dc:subject"]...)
+	meta.Keywords = appendUnique(meta.Keywords, iptc["Keywords"]...)
+	meta.Creators = appendUnique(meta.Creators, xmp["dc:creator"]...)
+	meta.Creators = appendUnique(meta.Creators, iptc["By-line"]...)
+	meta.Creators = appendUnique(meta.Creators, exifString(tagArtist))
+	meta.Copyright = first(xmp["dc:rights"])
+	if meta.Copyright == "" {
+		meta.Copyright = first(iptc["CopyrightNotice"])
+	}
+	if meta.Copyright == "" {
+		meta.Copyright = exifString(tagCopyright)
+	}
+	if rating, err := strconv.ParseFloat(first(xmp["xmp:Rating"]), 64); err == nil {
+		meta.Rating = &rating
+	} else if header.exif != nil {
+		if tag := header.exif.tag(tagRating); tag != nil {
+			rating := tag.floatValue(0)
+			meta.Rating = &rating
+		}
+	}
+	if density := imageDensity(header); density.known() {
+		meta.DPI = &[2]float64{density.x, density.y}
+	}
+	if header.icc != nil {
+		meta.ICCProfile = header.icc.description
+	}
+	if header.exif != nil {
+		meta.Orientation = header.exif.orientation()
+		if lat, lon, ok := header.exif.gpsPosition(); ok {
+			meta.GPS = &[2]float64{lat, lon}
+		}
+		meta.EXIF = map[string]string{}
+		for _, ifd := range [][]ExifTag{header.exif.ifd0, header.exif.exifIFD} {
+			for t := range ifd {
+				if name, ok := exifTagNames[ifd[t].Id]; ok {
+					meta.EXIF[name] = ifd[t].String()
+				}
+			}
+		}
+	}
+	if header.mpf != nil {
+		for e := range header.mpf.entries {
+			meta.MPF = append(meta.MPF, header.mpf.entries[e].typeName())
+		}
+	}
+	return meta
+}
+
+// Helper function to print the metadata in a human readable form
+func printMetadata(meta *Metadata) {
+	fmt.Printf("%s (%dx%d)\n", meta.Filename, meta.Width, meta.Height)
+	line := func(name string, value string) {
+		if value != "" {
+			fmt.Printf("  %-18s: %s\n", name, value)
+		}
+	}
+	line("Title", meta.Title)
+	line("Caption", meta.Caption)
+	line("Keywords", strings.Join(meta.Keywords, ", "))
+	line("Creators", strings.Join(meta.Creators, ", "))
+	line("Copyright", meta.Copyright)
+	if meta.Rating != nil {
+		line("Rating", strconv.FormatFloat(*meta.Rating, 'g', -1, 64))
+	}
+	for c := range meta.Comments {
+		line("Comment", meta.Comments[c])
+	}
+	if meta.DPI != nil {
+		line("DPI", fmt.Sprintf("%gx%g", meta.DPI[0], meta.DPI[1]))
+	}
+	line("ICC Profile", meta.ICCProfile)
+	if meta.Orientation > 1 {
+		line("Orientation", strconv.Itoa(meta.Orientation))
+	}
+	if meta.GPS != nil {
+		line("GPS", fmt.Sprintf("%.6f, %.6f", meta.GPS[0], meta.GPS[1]))
+	}
+	for m := range meta.MPF {
+		line(fmt.Sprintf("MPF Image %d", m), meta.MPF[m])
+	}
+	keys := []string{}
+	for key := range meta.EXIF {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for k := range keys {
+		line(keys[k], meta.EXIF[keys[k]])
+	}
+}
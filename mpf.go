@@ -0,0 +1,179 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// The identifier at the start of an APP2 MPF payload
+var mpfIdentifier = []byte("MPF\x00")
+
+// MP Index IFD tags
+const (
+	tagMPFVersion     = 0xB000
+	tagNumberOfImages = 0xB001
+	tagMPEntry        = 0xB002
+)
+
+// MP image type codes
+var mpTypeNames = map[uint32]string{
+	0x030000: "Baseline MP Primary Image",
+	0x010001: "Large Thumbnail (VGA)",
+	0x010002: "Large Thumbnail (Full HD)",
+	0x020001: "Multi-Frame Panorama",
+	0x020002: "Multi-Frame Disparity",
+	0x020003: "Multi-Frame Multi-Angle",
+	0x000000: "Undefined",
+}
+
+// An entry of the MP Index IFD describing one of the images in the file
+type MPEntry struct {
+	attribute  uint32 // Flags (upper 8 bits) and the type code (lower 24 bits)
+	size       uint32
+	offset     uint32 // Relative to the MP header, 0 for the first image
+	dependent1 uint16
+	dependent2 uint16
+}
+
+// The Multi-Picture Format index of a file
+type MPF struct {
+	version string
+	offset  int64 // The file offset of the MP header (the TIFF byte order mark)
+	entries []MPEntry
+}
+
+func (e *MPEntry) typeCode() uint32 {
+	return e.attribute & 0xFFFFFF
+}
+
+func (e *MPEntry) typeName() string {
+	if name, ok := mpTypeNames[e.typeCode()]; ok {
+		return name
+	}
+	return fmt.Sprintf("Unknown (0x%06X)", e.typeCode())
+}
+
+// Returns the file offset of the image
+func (m *MPF) imageOffset(index int) int64 {
+	if m.entries[index].offset == 0 {
+		return 0
+	}
+	return m.offset + int64(m.entries[index].offset)
+}
+
+// Parses the MP Index IFD of an APP2 MPF payload (without the 'MPF\0' identifier)
+func parseMPF(data []byte) (*MPF, error) {
+	order, offset, err := readTiffHeader(data)
+	if err != nil {
+		return nil, err
+	}
+	tags, _, err := readIFD(data, order, offset)
+	if err != nil {
+		return nil, err
+	}
+	mpf := &MPF{}
+	if version := findTag(tags, tagMPFVersion); version != nil {
+		mpf.version = string(version.value)
+	}
+	entries := findTag(tags, tagMPEntry)
+	if entries == nil {
+		// Only the MP Index IFD of the first image lists the images
+		return mpf, nil
+	}
+	count := len(entries.value) / 16
+	if number := findTag(tags, tagNumberOfImages); number != nil && int(number.intValue(0)) != count {
+		return nil, fmt.Errorf("NumberOfImages (%d) does not match the %d MP entries", number.intValue(0), count)
+	}
+	for a := 0; a < count; a++ {
+		entry := entries.value[a*16:]
+		mpf.entries = append(mpf.entries, MPEntry{
+			attribute:  order.Uint32(entry),
+			size:       order.Uint32(entry[4:]),
+			offset:     order.Uint32(entry[8:]),
+			dependent1: order.Uint16(entry[12:]),
+			dependent2: order.Uint16(entry[14:]),
+		})
+	}
+	return mpf, nil
+}
+
+func decodeMPF(header *Header, data []byte, offset int64) {
+	mpf, err := parseMPF(data)
+	if err != nil {
+		warn(header, "Invalid MPF segment: %s", err.Error())
+		return
+	}
+	// Secondary images carry an MPF segment as well, only the first one is used
+	if header.mpf != nil {
+		return
+	}
+	mpf.offset = offset
+	header.mpf = mpf
+	logf("*** MPF (%d images) ***\n", len(mpf.entries))
+	for e := range mpf.entries {
+		entry := &mpf.entries[e]
+		logf("Image %d                      : %s, %d bytes at %d\n", e, entry.typeName(), entry.size, mpf.imageOffset(e))
+	}
+}
+
+// Returns a reader for the bytes of the embedded image
+func mpfImageReader(file *os.File, header *Header, index int) (*io.SectionReader, error) {
+	if header.mpf == nil || len(header.mpf.entries) == 0 {
+		return nil, errors.New("the file has no MPF index")
+	}
+	if index < 0 || index >= len(header.mpf.entries) {
+		return nil, fmt.Errorf("MPF image index %d out of range 0-%d", index, len(header.mpf.entries)-1)
+	}
+	entry := header.mpf.entries[index]
+	offset := header.mpf.imageOffset(index)
+	if offset+int64(entry.size) > int64(header.filesize) {
+		return nil, fmt.Errorf("MPF image %d (%d bytes at %d) is past the end of the file", index, entry.size, offset)
+	}
+	r := io.NewSectionReader(file, offset, int64(entry.size))
+	soi := make([]byte, 2)
+	if _, err := r.ReadAt(soi, 0); err != nil || soi[0] != 0xFF || soi[1] != SOI {
+		return nil, fmt.Errorf("MPF image %d does not start with SOI", index)
+	}
+	return r, nil
+}
+
+// Decodes one of the images listed in the MPF index of a decoded file
+func decodeMPFImage(header *Header, index int, options *Options) *Header {
+	file, err := os.Open(header.filename)
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer file.Close()
+	r, err := mpfImageReader(file, header, index)
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	logf("*** Decoding MPF image %d ***\n", index)
+	image := decodeJPEGReader(bufio.NewReader(r), header.filename, options)
+	image.filesize = uint(r.Size())
+	return image
+}
+
+// Copies the bytes of one of the images listed in the MPF index to w
+func extractMPFImage(header *Header, index int, w io.Writer) {
+	file, err := os.Open(header.filename)
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	defer file.Close()
+	r, err := mpfImageReader(file, header, index)
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+}
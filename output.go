@@ -0,0 +1,205 @@
+package main
+
+import (
+	"bufio"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"path"
+	"strings"
+)
+
+// Returns the name of the output file for the image, the suffix is added before the extension
+func outputFilename(header *Header, suffix string, ext string) string {
+	filename := path.Base(header.filename)
+	i := strings.LastIndex(filename, ".")
+	if i >= 0 {
+		filename = filename[:i]
+	}
+	return filename + suffix + "." + ext
+}
+
+// Writes the image in the format selected in the options
+func writeImage(header *Header, img *Image, suffix string) {
+	format := header.options.format
+	if format == "" {
+		format = "bmp"
+	}
+	filename := outputFilename(header, suffix, format)
+	density := imageDensity(header)
+	switch format {
+	case "bmp":
+		writeBitMap(filename, img, density)
+	case "png":
+		writePNG(filename, img, density)
+	case "ppm":
+		writePPM(filename, img)
+	case "tiff":
+		writeTIFF(filename, img, density)
+	case "jpg":
+		writeJPEG(filename, img, &EncodeOptions{quality: 90, sampling: "420", density: density})
+	default:
+		fmt.Printf("Error! Unsupported output format (%s)\n", format)
+		os.Exit(1)
+	}
+}
+
+// Converts dots per inch to dots per meter
+func dotsPerMeter(dpi float64) uint {
+	return uint(math.Round(dpi / 0.0254))
+}
+
+// Helper function to write a PNG chunk
+func writePNGChunk(w io.Writer, typ string, data []byte) error {
+	chunk := make([]byte, 8, len(data)+12)
+	binary.BigEndian.PutUint32(chunk, uint32(len(data)))
+	copy(chunk[4:], typ)
+	chunk = append(chunk, data...)
+	sum := make([]byte, 4)
+	binary.BigEndian.PutUint32(sum, crc32.ChecksumIEEE(chunk[4:]))
+	_, err := w.Write(append(chunk, sum...))
+	return err
+}
+
+func writePNG(filename string, img *Image, density Density) {
+	f, err := os.Create(filename)
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	logf("Writing png to %s ... \n", filename)
+	w := bufio.NewWriter(f)
+	err = writeAllRows(newPNGRowWriter(w), img, density)
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	f.Close()
+}
+
+// Writes a binary PPM, it has no density
+func writePPM(filename string, img *Image) {
+	f, err := os.Create(filename)
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	logf("Writing ppm to %s ... \n", filename)
+	w := bufio.NewWriter(f)
+	err = writeAllRows(newPPMRowWriter(w), img, Density{})
+	if err == nil {
+		err = w.Flush()
+	}
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	f.Close()
+}
+
+// TIFF tags used by the writer
+const (
+	tiffTagImageWidth      = 256
+	tiffTagImageLength     = 257
+	tiffTagBitsPerSample   = 258
+	tiffTagCompression     = 259
+	tiffTagPhotometric     = 262
+	tiffTagStripOffsets    = 273
+	tiffTagSamplesPerPixel = 277
+	tiffTagRowsPerStrip    = 278
+	tiffTagStripByteCounts = 279
+	tiffTagXResolution     = 282
+	tiffTagYResolution     = 283
+	tiffTagResolutionUnit  = 296
+)
+
+// Writes an uncompressed RGB TIFF with a single strip
+func writeTIFF(filename string, img *Image, density Density) {
+	f, err := os.Create(filename)
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	logf("Writing tiff to %s ... \n", filename)
+	le := binary.LittleEndian
+	type entry struct {
+		tag   uint16
+		typ   uint16
+		count uint32
+		value uint32
+	}
+	if !density.known() {
+		density = Density{x: 72, y: 72}
+	}
+	entries := []entry{
+		{tiffTagImageWidth, tiffLong, 1, uint32(img.width)},
+		{tiffTagImageLength, tiffLong, 1, uint32(img.height)},
+		{tiffTagBitsPerSample, tiffShort, 3, 0},
+		{tiffTagCompression, tiffShort, 1, 1},
+		{tiffTagPhotometric, tiffShort, 1, 2},
+		{tiffTagStripOffsets, tiffLong, 1, 0},
+		{tiffTagSamplesPerPixel, tiffShort, 1, 3},
+		{tiffTagRowsPerStrip, tiffLong, 1, uint32(img.height)},
+		{tiffTagStripByteCounts, tiffLong, 1, uint32(len(img.pix))},
+		{tiffTagXResolution, tiffRational, 1, 0},
+		{tiffTagYResolution, tiffRational, 1, 0},
+		{tiffTagResolutionUnit, tiffShort, 1, 2},
+	}
+	// The values that do not fit into an entry follow the IFD
+	ifdSize := 2 + len(entries)*12 + 4
+	extra := 8 + ifdSize
+	bitsOffset := extra
+	xResOffset := bitsOffset + 6
+	yResOffset := xResOffset + 8
+	pixOffset := yResOffset + 8
+	for e := range entries {
+		switch entries[e].tag {
+		case tiffTagBitsPerSample:
+			entries[e].value = uint32(bitsOffset)
+		case tiffTagStripOffsets:
+			entries[e].value = uint32(pixOffset)
+		case tiffTagXResolution:
+			entries[e].value = uint32(xResOffset)
+		case tiffTagYResolution:
+			entries[e].value = uint32(yResOffset)
+		}
+	}
+	data := make([]byte, pixOffset)
+	copy(data, "II")
+	le.PutUint16(data[2:], 42)
+	le.PutUint32(data[4:], 8)
+	le.PutUint16(data[8:], uint16(len(entries)))
+	for e := range entries {
+		pos := 10 + e*12
+		le.PutUint16(data[pos:], entries[e].tag)
+		le.PutUint16(data[pos+2:], entries[e].typ)
+		le.PutUint32(data[pos+4:], entries[e].count)
+		// SHORT values are left justified in the value field
+		if entries[e].typ == tiffShort && entries[e].count == 1 {
+			le.PutUint16(data[pos+8:], uint16(entries[e].value))
+		} else {
+			le.PutUint32(data[pos+8:], entries[e].value)
+		}
+	}
+	for a := 0; a < 3; a++ {
+		le.PutUint16(data[bitsOffset+a*2:], 8)
+	}
+	le.PutUint32(data[xResOffset:], uint32(math.Round(density.x*100)))
+	le.PutUint32(data[xResOffset+4:], 100)
+	le.PutUint32(data[yResOffset:], uint32(math.Round(density.y*100)))
+	le.PutUint32(data[yResOffset+4:], 100)
+	w := bufio.NewWriter(f)
+	w.Write(data)
+	w.Write(img.pix)
+	if err := w.Flush(); err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	f.Close()
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"runtime"
+	"runtime/pprof"
+	"time"
+)
+
+// The time spent in each stage of the decoder. The stages don't overlap: entering a stage
+// stops counting the time of the one before. A nil Profile counts nothing.
+type Profile struct {
+	times  map[string]time.Duration
+	stages []string // In the order they were first entered
+	stage  string   // The stage the time is counted for, empty for none
+	since  time.Time
+}
+
+func newProfile() *Profile {
+	return &Profile{times: map[string]time.Duration{}}
+}
+
+// Counts the time since the last switch for the current stage and switches to stage.
+// Returns the previous stage, so a nested stage can switch back to it.
+func (p *Profile) enter(stage string) string {
+	if p == nil {
+		return ""
+	}
+	now := time.Now()
+	if p.stage != "" {
+		p.times[p.stage] += now.Sub(p.since)
+	}
+	if _, ok := p.times[stage]; !ok && stage != "" {
+		p.stages = append(p.stages, stage)
+		p.times[stage] = 0
+	}
+	previous := p.stage
+	p.stage = stage
+	p.since = now
+	return previous
+}
+
+// Prints the time of every stage and resets the profile
+func (p *Profile) print(filename string) {
+	p.enter("")
+	total := time.Duration(0)
+	for _, stage := range p.stages {
+		total += p.times[stage]
+	}
+	fmt.Printf("Stage timings of %s:\n", filename)
+	for _, stage := range p.stages {
+		percent := 0.0
+		if total > 0 {
+			percent = float64(p.times[stage]) * 100 / float64(total)
+		}
+		fmt.Printf("  %-20s %12s %5.1f%%\n", stage, p.times[stage].Round(time.Microsecond), percent)
+	}
+	fmt.Printf("  %-20s %12s\n", "total", total.Round(time.Microsecond))
+	p.times = map[string]time.Duration{}
+	p.stages = nil
+}
+
+// Starts writing a pprof CPU profile to filename, the returned function stops it
+func startCPUProfile(filename string) func() {
+	f, err := os.Create(filename)
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	if err := pprof.StartCPUProfile(f); err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	return func() {
+		pprof.StopCPUProfile()
+		f.Close()
+	}
+}
+
+// Writes a pprof heap profile of the allocations so far to filename
+func writeHeapProfile(filename string) {
+	f, err := os.Create(filename)
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	runtime.GC()
+	if err := pprof.WriteHeapProfile(f); err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	f.Close()
+}
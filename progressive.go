@@ -0,0 +1,368 @@
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A scan of a progressive JPEG
+type ScanSpec struct {
+	components []int // Indexes of the components coded in the scan
+	ss         int   // Spectral selection start
+	se         int   // Spectral selection end
+	ah         int   // Successive approximation bit position high
+	al         int   // Successive approximation bit position low
+}
+
+// The most correction bits that are buffered during an EOB run (as done by libjpeg)
+const maxCorrectionBits = 1000 - 63
+
+// Returns the scan script used by libjpeg's simple progression
+func defaultScanScript(components int) []ScanSpec {
+	if components == 1 {
+		return []ScanSpec{
+			{[]int{0}, 0, 0, 0, 1},
+			{[]int{0}, 1, 5, 0, 2},
+			{[]int{0}, 6, 63, 0, 2},
+			{[]int{0}, 1, 63, 2, 1},
+			{[]int{0}, 0, 0, 1, 0},
+			{[]int{0}, 1, 63, 1, 0},
+		}
+	}
+	return []ScanSpec{
+		{[]int{0, 1, 2}, 0, 0, 0, 1},
+		{[]int{0}, 1, 5, 0, 2},
+		{[]int{2}, 1, 63, 0, 1},
+		{[]int{1}, 1, 63, 0, 1},
+		{[]int{0}, 6, 63, 0, 2},
+		{[]int{0}, 1, 63, 2, 1},
+		{[]int{0, 1, 2}, 0, 0, 1, 0},
+		{[]int{2}, 1, 63, 1, 0},
+		{[]int{1}, 1, 63, 1, 0},
+		{[]int{0}, 1, 63, 1, 0},
+	}
+}
+
+// Parses a scan script in the format used by libjpeg's -scans option.
+// Each scan is written as 'components: Ss-Se, Ah, Al;' and # starts a comment.
+//
+//	0,1,2: 0-0, 0, 1;
+//	0: 1-63, 0, 0;
+func parseScanScript(script string) ([]ScanSpec, error) {
+	lines := strings.Split(script, "\n")
+	for l := range lines {
+		if i := strings.Index(lines[l], "#"); i >= 0 {
+			lines[l] = lines[l][:i]
+		}
+	}
+	scans := []ScanSpec{}
+	for _, text := range strings.Split(strings.Join(lines, " "), ";") {
+		text = strings.TrimSpace(text)
+		if text == "" {
+			continue
+		}
+		parts := strings.SplitN(text, ":", 2)
+		if len(parts) != 2 {
+			return nil, fmt.Errorf("scan '%s' has no ':' after the components", text)
+		}
+		scan := ScanSpec{}
+		for _, c := range strings.FieldsFunc(parts[0], func(r rune) bool { return r == ',' || r == ' ' || r == '\t' }) {
+			component, err := strconv.Atoi(c)
+			if err != nil {
+				return nil, fmt.Errorf("invalid component '%s' in scan '%s'", c, text)
+			}
+			scan.components = append(scan.components, component)
+		}
+		// Ss-Se, Ah, Al
+		params := strings.FieldsFunc(parts[1], func(r rune) bool { return r == ',' || r == '-' || r == ' ' || r == '\t' })
+		if len(params) != 4 {
+			return nil, fmt.Errorf("scan '%s' needs Ss-Se, Ah, Al", text)
+		}
+		values := [4]int{}
+		for p := range params {
+			v, err := strconv.Atoi(params[p])
+			if err != nil {
+				return nil, fmt.Errorf("invalid value '%s' in scan '%s'", params[p], text)
+			}
+			values[p] = v
+		}
+		scan.ss, scan.se, scan.ah, scan.al = values[0], values[1], values[2], values[3]
+		scans = append(scans, scan)
+	}
+	if len(scans) == 0 {
+		return nil, fmt.Errorf("the scan script is empty")
+	}
+	return scans, nil
+}
+
+// Checks that a scan script follows the progression rules of ITU T.81 G.1.1.1
+// and that it codes every bit of every coefficient.
+func validateScanScript(scans []ScanSpec, components int) error {
+	// The successive approximation bit position each coefficient has been coded down to, -1 if it has not been coded
+	coded := make([][64]int, components)
+	for c := range coded {
+		for k := range coded[c] {
+			coded[c][k] = -1
+		}
+	}
+	for s, scan := range scans {
+		if len(scan.components) == 0 || len(scan.components) > 4 {
+			return fmt.Errorf("scan %d has %d components", s, len(scan.components))
+		}
+		if scan.ss < 0 || scan.se > 63 || scan.ss > scan.se {
+			return fmt.Errorf("scan %d has an invalid spectral selection %d-%d", s, scan.ss, scan.se)
+		}
+		if scan.ss == 0 && scan.se != 0 {
+			return fmt.Errorf("scan %d mixes the DC and AC coefficients", s)
+		}
+		if scan.ss > 0 && len(scan.components) != 1 {
+			return fmt.Errorf("scan %d codes AC coefficients of more than one component", s)
+		}
+		if scan.al < 0 || scan.al > 13 || scan.ah < 0 || scan.ah > 13 {
+			return fmt.Errorf("scan %d has an invalid successive approximation %d, %d", s, scan.ah, scan.al)
+		}
+		if scan.ah != 0 && scan.ah != scan.al+1 {
+			return fmt.Errorf("scan %d refines more than one bit (Ah %d, Al %d)", s, scan.ah, scan.al)
+		}
+		for i, c := range scan.components {
+			if c < 0 || c >= components {
+				return fmt.Errorf("scan %d has component %d, the image has %d", s, c, components)
+			}
+			for j := 0; j < i; j++ {
+				if scan.components[j] == c {
+					return fmt.Errorf("scan %d has component %d twice", s, c)
+				}
+			}
+			if scan.ss > 0 && coded[c][0] < 0 {
+				return fmt.Errorf("scan %d codes AC coefficients of component %d before its DC coefficient", s, c)
+			}
+			for k := scan.ss; k <= scan.se; k++ {
+				if scan.ah == 0 && coded[c][k] >= 0 {
+					return fmt.Errorf("scan %d codes coefficient %d of component %d a second time", s, k, c)
+				}
+				if scan.ah != 0 && coded[c][k] != scan.ah {
+					return fmt.Errorf("scan %d refines coefficient %d of component %d out of order", s, k, c)
+				}
+				coded[c][k] = scan.al
+			}
+		}
+	}
+	for c := range coded {
+		for k := range coded[c] {
+			if coded[c][k] != 0 {
+				return fmt.Errorf("the scan script does not code every bit of coefficient %d of component %d", k, c)
+			}
+		}
+	}
+	return nil
+}
+
+func (s *scanEncoder) correctionBits(bits []byte) {
+	for _, b := range bits {
+		s.bits(int(b), 1)
+	}
+}
+
+// Codes the pending EOB run followed by the correction bits buffered during the run
+func (s *scanEncoder) flushEOBRun() {
+	if s.eobrun == 0 {
+		return
+	}
+	length := bitLength(s.eobrun) - 1
+	s.symbol(s.eobTable, byte(length<<4))
+	s.bits(s.eobrun, length)
+	s.eobrun = 0
+	s.correctionBits(s.correction)
+	s.correction = s.correction[:0]
+}
+
+// DC first scan, the DC difference of the coefficient shifted by Al
+func (s *scanEncoder) encodeDCFirst(block *[64]int, prevDC *int, table int, al int) {
+	dc := block[0] >> al
+	diff := dc - *prevDC
+	*prevDC = dc
+	length := bitLength(diff)
+	s.symbol(table, byte(length))
+	s.bits(coeffBits(diff, length), length)
+}
+
+// DC refinement scan, a single bit without Huffman coding
+func (s *scanEncoder) encodeDCRefine(block *[64]int, al int) {
+	s.bits((block[0]>>al)&1, 1)
+}
+
+// AC first scan, the coefficients are divided by 2^Al and runs of empty blocks are coded as EOB runs
+func (s *scanEncoder) encodeACFirst(block *[64]int, table int, ss int, se int, al int) {
+	s.eobTable = table
+	zeroes := 0
+	for k := ss; k <= se; k++ {
+		coeff := block[zigzag[k]]
+		// Divide rounding towards zero
+		if coeff < 0 {
+			coeff = -(-coeff >> al)
+		} else {
+			coeff >>= al
+		}
+		if coeff == 0 {
+			zeroes++
+			continue
+		}
+		s.flushEOBRun()
+		for zeroes > 15 {
+			s.symbol(table, 0xF0)
+			zeroes -= 16
+		}
+		length := bitLength(coeff)
+		s.symbol(table, byte(zeroes<<4|length))
+		s.bits(coeffBits(coeff, length), length)
+		zeroes = 0
+	}
+	if zeroes > 0 {
+		s.eobrun++
+		if s.eobrun == 0x7FFF {
+			s.flushEOBRun()
+		}
+	}
+}
+
+// AC refinement scan (ITU T.81 G.1.2.3). Coefficients that become non-zero are coded
+// like in the first scan with a size of 1, coefficients that already are non-zero
+// get a correction bit that is written after the next symbol.
+func (s *scanEncoder) encodeACRefine(block *[64]int, table int, ss int, se int, al int) {
+	s.eobTable = table
+	abs := [64]int{}
+	// The last coefficient that becomes non-zero in this scan
+	last := 0
+	for k := ss; k <= se; k++ {
+		coeff := block[zigzag[k]]
+		if coeff < 0 {
+			coeff = -coeff
+		}
+		abs[k] = coeff >> al
+		if abs[k] == 1 {
+			last = k
+		}
+	}
+	zeroes := 0
+	correction := []byte{}
+	for k := ss; k <= se; k++ {
+		if abs[k] == 0 {
+			zeroes++
+			continue
+		}
+		// A run of 16 zeroes can only be coded if a new coefficient follows, otherwise it is part of the EOB
+		for zeroes > 15 && k <= last {
+			s.flushEOBRun()
+			s.symbol(table, 0xF0)
+			zeroes -= 16
+			s.correctionBits(correction)
+			correction = correction[:0]
+		}
+		if abs[k] > 1 {
+			correction = append(correction, byte(abs[k]&1))
+			continue
+		}
+		s.flushEOBRun()
+		s.symbol(table, byte(zeroes<<4|1))
+		sign := 1
+		if block[zigzag[k]] < 0 {
+			sign = 0
+		}
+		s.bits(sign, 1)
+		s.correctionBits(correction)
+		correction = correction[:0]
+		zeroes = 0
+	}
+	if zeroes > 0 || len(correction) > 0 {
+		s.eobrun++
+		s.correction = append(s.correction, correction...)
+		if s.eobrun == 0x7FFF || len(s.correction) > maxCorrectionBits {
+			s.flushEOBRun()
+		}
+	}
+}
+
+// Codes all blocks of a scan
+func (s *scanEncoder) encodeScan(coeffs *Coefficients, scan *ScanSpec, tables []int) {
+	prevDC := make([]int, len(scan.components))
+	forEachScanBlock(coeffs, scan.components, func(p int, block *[64]int) {
+		switch {
+		case scan.ss == 0 && scan.ah == 0:
+			s.encodeDCFirst(block, &prevDC[p], tables[p], scan.al)
+		case scan.ss == 0:
+			s.encodeDCRefine(block, scan.al)
+		case scan.ah == 0:
+			s.encodeACFirst(block, tables[p], scan.ss, scan.se, scan.al)
+		default:
+			s.encodeACRefine(block, tables[p], scan.ss, scan.se, scan.al)
+		}
+	})
+	s.flushEOBRun()
+}
+
+// Writes a progressive (SOF2) JPEG from quantized coefficients.
+// Every scan gets Huffman tables built from its own symbol statistics.
+func writeProgressive(w io.Writer, coeffs *Coefficients, options *EncodeOptions) {
+	scans := options.scans
+	if scans == nil {
+		scans = defaultScanScript(len(coeffs.planes))
+	}
+	if err := validateScanScript(scans, len(coeffs.planes)); err != nil {
+		fmt.Printf("Error! Invalid scan script: %s\n", err.Error())
+		os.Exit(1)
+	}
+	bw := bufio.NewWriter(w)
+	bw.Write([]byte{0xFF, SOI})
+	writeHeaderSegments(bw, options)
+	writeQuantizationTables(bw, coeffs.qTables)
+	writeStartOfFrame(bw, SOF2, coeffs)
+	for s := range scans {
+		scan := &scans[s]
+		dc := scan.ss == 0
+		// The first component uses table 0 and the others table 1
+		tables := make([]int, len(scan.components))
+		ids := [][2]int{}
+		for p, c := range scan.components {
+			if c > 0 {
+				tables[p] = 1
+			}
+			ids = append(ids, [2]int{tables[p], tables[p]})
+		}
+		// DC refinement scans are not Huffman coded
+		if !dc || scan.ah == 0 {
+			counter := &scanEncoder{counting: true, freq: make([][256]int, 2)}
+			counter.encodeScan(coeffs, scan, tables)
+			encoder := &scanEncoder{encoders: make([]*HuffmanEncoder, 2)}
+			for t := range counter.freq {
+				used := false
+				for p := range tables {
+					used = used || tables[p] == t
+				}
+				if !used {
+					continue
+				}
+				table := buildHuffmanTable(&counter.freq[t], t, dc)
+				writeHuffmanTable(bw, &table)
+				encoder.encoders[t] = newHuffmanEncoder(&table)
+			}
+			writeStartOfScan(bw, coeffs, scan.components, ids, scan.ss, scan.se, scan.ah, scan.al)
+			encoder.bw = &BitWriter{w: bw}
+			encoder.encodeScan(coeffs, scan, tables)
+			encoder.bw.flush()
+			continue
+		}
+		writeStartOfScan(bw, coeffs, scan.components, ids, scan.ss, scan.se, scan.ah, scan.al)
+		encoder := &scanEncoder{bw: &BitWriter{w: bw}}
+		encoder.encodeScan(coeffs, scan, tables)
+		encoder.bw.flush()
+	}
+	bw.Write([]byte{0xFF, EOI})
+	if err := bw.Flush(); err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+}
@@ -0,0 +1,145 @@
+package main
+
+import "io"
+
+// A rectangle of the image in pixels
+type Region struct {
+	x      int
+	y      int
+	width  int
+	height int
+}
+
+// Decodes only a region of the image, header.image holds the pixels of the region
+func decodeJPEGRegion(r io.ByteReader, filename string, region Region, options *Options) (*Header, error) {
+	regionOptions := *options
+	regionOptions.region = &region
+	return newDecoder(&regionOptions).decode(r, filename)
+}
+
+// Clips the region of the options to the frame, it fails if nothing is left
+func clipRegion(header *Header) {
+	r := *header.options.region
+	if r.x < 0 || r.y < 0 || r.width <= 0 || r.height <= 0 || r.x >= header.width || r.y >= header.height {
+		fail(header, "The region %dx%d+%d+%d is outside the %dx%d image", r.width, r.height, r.x, r.y, header.width, header.height)
+	}
+	if r.x+r.width > header.width {
+		r.width = header.width - r.x
+	}
+	if r.y+r.height > header.height {
+		r.height = header.height - r.y
+	}
+	header.region = &r
+}
+
+// Returns the blocks [x0, x1) x [y0, y1) of component c that the pixels of the region use,
+// the chrominance is subsampled by the sampling factors of the luminance like in
+// convertColorSpace
+func regionBlocks(header *Header, c int) (int, int, int, int) {
+	r := header.region
+	xStep, yStep := 1, 1
+	if c > 0 {
+		xStep = header.cComponents[0].hSamplingFactor
+		yStep = header.cComponents[0].vSamplingFactor
+	}
+	return r.x / xStep / 8, r.y / yStep / 8, (r.x+r.width-1)/xStep/8 + 1, (r.y+r.height-1)/yStep/8 + 1
+}
+
+// Gives every component a plane that only holds the blocks of the region
+func allocRegionPlanes(h *Header) {
+	h.planes = make([]Plane, len(h.cComponents))
+	h.blockCount = 0
+	for c := range h.planes {
+		x0, y0, x1, y1 := regionBlocks(h, c)
+		h.planes[c] = Plane{blocksWide: x1 - x0, blocksHigh: y1 - y0, blockX: x0, blockY: y0}
+		h.blockCount += h.planes[c].blocksWide * h.planes[c].blocksHigh
+	}
+	checkFrameLimits(h)
+	blocks := h.decoder.allocBlocks(h.blockCount)
+	for c := range h.planes {
+		n := h.planes[c].blocksWide * h.planes[c].blocksHigh
+		h.planes[c].blocks, blocks = blocks[:n:n], blocks[n:]
+	}
+}
+
+// Replaces the whole planes of a progressive image with planes that only hold the blocks of
+// the region, once all the scans are decoded
+func cropRegionPlanes(header *Header) {
+	for c := range header.planes {
+		plane := &header.planes[c]
+		x0, y0, x1, y1 := regionBlocks(header, c)
+		region := Plane{blocksWide: x1 - x0, blocksHigh: y1 - y0, blockX: x0, blockY: y0}
+		region.blocks = make([][64]int16, region.blocksWide*region.blocksHigh)
+		for by := y0; by < y1; by++ {
+			copy(region.blocks[(by-y0)*region.blocksWide:], plane.blocks[x0+by*plane.blocksWide:x1+by*plane.blocksWide])
+		}
+		*plane = region
+	}
+}
+
+// Runs the blocks of the region through the pipeline into an image of the size of the region
+func renderRegion(header *Header) {
+	if header.frameType != SOF0 {
+		cropRegionPlanes(header)
+	}
+	r := header.region
+	header.image = header.decoder.allocImage(r.width, r.height)
+	renderBlocks(header, 0, header.blockHeightReal, header.image, r.x, r.y)
+	header.blockRowsRendered = header.blockHeightReal
+	header.rowsAvailable = r.height
+}
+
+// Is every component of a baseline image decoded as far as the region goes
+func regionDecoded(header *Header) bool {
+	if header.region == nil || header.frameType != SOF0 {
+		return false
+	}
+	for c := range header.cComponents {
+		if !header.cComponents[c].scanned {
+			return false
+		}
+	}
+	return true
+}
+
+// The MCUs [x0, x1) x [y0, y1) of a scan that hold blocks of the region
+type window struct {
+	x0, y0, x1, y1 int
+}
+
+// Returns the window of the region in the MCUs of the scan, a scan with one component has
+// a block per MCU
+func scanWindow(header *Header) window {
+	for c := range header.cComponents {
+		comp := &header.cComponents[c]
+		if !comp.usedInScan {
+			continue
+		}
+		plane := &header.planes[c]
+		h, v := 1, 1
+		if header.componentsInScan > 1 {
+			h, v = comp.hSamplingFactor, comp.vSamplingFactor
+		}
+		return window{
+			plane.blockX / h, plane.blockY / v,
+			(plane.blockX + plane.blocksWide + h - 1) / h, (plane.blockY + plane.blocksHigh + v - 1) / v,
+		}
+	}
+	return window{}
+}
+
+// Does one of the MCUs [first, last) of a scan mcusWide MCUs wide lie in the window
+func (w window) holdsAny(first int, last int, mcusWide int) bool {
+	for mcu := first; mcu < last; {
+		mx, my := mcu%mcusWide, mcu/mcusWide
+		end := mcusWide
+		if last-my*mcusWide < end {
+			end = last - my*mcusWide
+		}
+		if my >= w.y0 && my < w.y1 && mx < w.x1 && end > w.x0 {
+			return true
+		}
+		mcu = my*mcusWide + end
+	}
+	return false
+}
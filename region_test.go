@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Encodes the image of a JPEG again as a baseline file with a restart interval
+func restartJPEG(t *testing.T, data []byte, restart int, interleaved bool, sampling string) []byte {
+	whole, err := decodeJPEGSafe(bytes.NewReader(data), "restart.jpg", &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	coeffs := computeCoefficients(whole.image, &EncodeOptions{quality: 75, sampling: sampling})
+	var out bytes.Buffer
+	writeBaselineFixture(&out, coeffs, &fixture{width: whole.width, height: whole.height, sampling: sampling, restart: restart, interleaved: interleaved})
+	return out.Bytes()
+}
+
+// The pixels of a region have to be the ones of the whole image
+func checkRegions(t *testing.T, data []byte) {
+	checkRegionsWith(t, data, func(r Region) (*Header, error) {
+		return decodeJPEGRegion(bytes.NewReader(data), "region.jpg", r, &Options{})
+	})
+}
+
+// Compares the regions decoded by decodeRegion to the whole image
+func checkRegionsWith(t *testing.T, data []byte, decodeRegion func(r Region) (*Header, error)) {
+	whole, err := decodeJPEGSafe(bytes.NewReader(data), "whole.jpg", &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, h := whole.width, whole.height
+	regions := []Region{
+		{0, 0, w, h},
+		{0, 0, 1, 1},
+		{w - 1, h - 1, 1, 1},
+		{w / 3, h / 3, w/3 + 1, h/3 + 1},
+		{w / 2, 5, w, 9},
+		{7, h / 2, 9, h},
+	}
+	for _, r := range regions {
+		header, err := decodeRegion(r)
+		if err != nil {
+			t.Fatalf("%v: %v", r, err)
+		}
+		img := header.image
+		if img.width != header.region.width || img.height != header.region.height {
+			t.Fatalf("%v: the image is %dx%d, the region is %dx%d", r, img.width, img.height, header.region.width, header.region.height)
+		}
+		for y := 0; y < img.height; y++ {
+			row := img.pix[y*img.width*3 : (y+1)*img.width*3]
+			i := ((r.y+y)*w + r.x) * 3
+			if !bytes.Equal(row, whole.image.pix[i:i+len(row)]) {
+				t.Errorf("%v: row %d differs from the whole image", r, y)
+				break
+			}
+		}
+	}
+}
+
+func TestRegion(t *testing.T) {
+	logOutput = io.Discard
+	defer func() { logOutput = os.Stdout }()
+	names := []string{"testdata/rows/gray-22.jpg"}
+	for _, pattern := range []string{"test/*.jpg", "test/p/*.jpg", fixtureDir + "/*.jpg"} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, matches...)
+	}
+	for _, name := range names {
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkRegions(t, data)
+		})
+	}
+}
+
+// The restart intervals without blocks of the region are skipped, the file is read up to
+// the last MCU of the region
+func TestRegionRestarts(t *testing.T) {
+	logOutput = io.Discard
+	defer func() { logOutput = os.Stdout }()
+	data, err := os.ReadFile("test/cat0.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, sampling := range []string{"444", "422", "440", "420"} {
+		for _, restart := range []int{1, 3, 7} {
+			checkRegions(t, restartJPEG(t, data, restart, true, sampling))
+			checkRegions(t, restartJPEG(t, data, restart, false, sampling))
+		}
+	}
+	data = restartJPEG(t, data, 2, true, "420")
+	header, err := decodeJPEGRegion(bytes.NewReader(data), "region.jpg", Region{0, 0, 16, 16}, &Options{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if header.buffer.pos > int64(len(data)/2) {
+		t.Errorf("read %d of %d bytes for the first MCU", header.buffer.pos, len(data))
+	}
+}
+
+func TestRegionOutside(t *testing.T) {
+	logOutput = io.Discard
+	defer func() { logOutput = os.Stdout }()
+	data, err := os.ReadFile("test/cat0.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, r := range []Region{{-1, 0, 8, 8}, {0, 0, 0, 8}, {100000, 0, 8, 8}} {
+		if _, err := decodeJPEGRegion(bytes.NewReader(data), "region.jpg", r, &Options{}); err == nil {
+			t.Errorf("%v: expected an error", r)
+		}
+	}
+}
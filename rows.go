@@ -0,0 +1,287 @@
+package main
+
+import (
+	"bufio"
+	"compress/zlib"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"os"
+)
+
+// Receives the rows of an image from the top down as they are decoded
+type RowWriter interface {
+	start(width int, height int, density Density) error
+	writeRows(img *Image) error // The next img.height rows
+	close() error
+}
+
+// Starts streaming the rows of the image at the first scan. Only a baseline image with all
+// the components in its first scan is streamed, the planes of the other images are allocated
+// whole and the image is written once it is decoded.
+func startRows(header *Header) {
+	if !header.streaming {
+		return
+	}
+	if header.scanCount > 0 {
+		fail(header, "The components of a streamed image are decoded in the first scan, found a second scan")
+	}
+	// The MCUs of a grayscale scan are single blocks, whatever the sampling factors say
+	if header.componentsInScan != len(header.cComponents) ||
+		(header.componentsInScan == 1 && header.cComponents[0].vSamplingFactor != 1) {
+		logf("The scan is not interleaved, the whole image is decoded before it is written\n")
+		header.streaming = false
+		allocPlanes(header, header.blockHeightReal/header.cComponents[0].vSamplingFactor)
+		return
+	}
+	// The rows are converted as they are rendered
+	convertsToSRGB(header)
+	if header.options.autoOrient && header.exif != nil && header.exif.orientation() != 1 {
+		warn(header, "The EXIF orientation (%d) is not applied to streamed rows", header.exif.orientation())
+	}
+	if err := header.options.rows.start(header.width, header.height, imageDensity(header)); err != nil {
+		fail(header, "%s", err.Error())
+	}
+}
+
+// Runs the MCU row my, which is the only one the planes hold, through the pipeline and writes
+// its rows. The blocks are cleared and moved down to the next MCU row.
+func streamRows(header *Header, my int) {
+	yStep := header.cComponents[0].vSamplingFactor
+	if header.image == nil {
+		header.image = header.decoder.allocImage(header.width, yStep*8)
+	}
+	top := my * yStep * 8
+	rows := header.height - top
+	if rows > yStep*8 {
+		rows = yStep * 8
+	}
+	img := &Image{width: header.width, height: rows, pix: header.image.pix[:rows*header.width*3]}
+	renderBlocks(header, my*yStep, (my+1)*yStep, img, 0, top)
+	if header.options.toSRGB && header.icc != nil && header.icc.hasMatrix {
+		convertToSRGB(img, header.icc)
+	}
+	stage := header.options.profile.enter("writeImage")
+	if err := header.options.rows.writeRows(img); err != nil {
+		fail(header, "%s", err.Error())
+	}
+	header.options.profile.enter(stage)
+	header.blockRowsRendered = (my + 1) * yStep
+	header.rowsAvailable = top + rows
+	for c := range header.planes {
+		plane := &header.planes[c]
+		for a := range plane.blocks {
+			plane.blocks[a] = [64]int16{}
+		}
+		plane.blockY += header.cComponents[c].vSamplingFactor
+	}
+}
+
+// Ends the rows at the end-of-image marker, an image that was not streamed is written as a whole
+func finishRows(header *Header) {
+	rows := header.options.rows
+	stage := header.options.profile.enter("writeImage")
+	defer header.options.profile.enter(stage)
+	var err error
+	if header.streaming {
+		err = rows.close()
+	} else {
+		err = writeAllRows(rows, header.image, imageDensity(header))
+	}
+	if err != nil {
+		fail(header, "%s", err.Error())
+	}
+}
+
+// Decodes a file and writes its rows to the output file of the format in the options as
+// they are decoded
+func streamImage(decoder *Decoder, filename string) *Header {
+	options := decoder.options
+	output := outputFilename(&Header{filename: filename}, "", options.format)
+	f, err := os.Create(output)
+	if err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	logf("Streaming the rows to %s ... \n", output)
+	// The bitmap seeks in the file, the others are written in order
+	w := bufio.NewWriter(f)
+	switch options.format {
+	case "bmp":
+		options.rows = newBitMapRowWriter(f)
+	case "ppm":
+		options.rows = newPPMRowWriter(w)
+	case "png":
+		options.rows = newPNGRowWriter(w)
+	}
+	header := decoder.decodeFile(filename)
+	options.rows = nil
+	if err := w.Flush(); err != nil {
+		fmt.Printf("Error! %s\n", err.Error())
+		os.Exit(1)
+	}
+	f.Close()
+	return header
+}
+
+// Writes a whole image through a RowWriter
+func writeAllRows(rows RowWriter, img *Image, density Density) error {
+	if err := rows.start(img.width, img.height, density); err != nil {
+		return err
+	}
+	if err := rows.writeRows(img); err != nil {
+		return err
+	}
+	return rows.close()
+}
+
+// Writes a 24 bit BMP, which is stored bottom-up: the rows are written to their place in the
+// file from the end of the pixel array to the start
+type bitMapRowWriter struct {
+	w      io.WriteSeeker
+	width  int
+	height int
+	row    int    // The rows written so far
+	buf    []byte // The rows of a writeRows in the order of the file
+}
+
+func newBitMapRowWriter(w io.WriteSeeker) *bitMapRowWriter {
+	return &bitMapRowWriter{w: w}
+}
+
+func (bw *bitMapRowWriter) start(width int, height int, density Density) error {
+	bw.width, bw.height = width, height
+	_, err := bw.w.Write(bitMapHeader(width, height, density))
+	return err
+}
+
+func (bw *bitMapRowWriter) writeRows(img *Image) error {
+	stride := bw.width*3 + bw.width%4
+	bw.buf = bw.buf[:0]
+	for y := img.height - 1; y >= 0; y-- {
+		for x := 0; x < img.width; x++ {
+			p := (x + y*img.width) * 3
+			bw.buf = append(bw.buf, img.pix[p+2], img.pix[p+1], img.pix[p])
+		}
+		for a := 0; a < bw.width%4; a++ {
+			bw.buf = append(bw.buf, 0)
+		}
+	}
+	bw.row += img.height
+	offset := int64(bitMapHeaderSize) + int64(bw.height-bw.row)*int64(stride)
+	if _, err := bw.w.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+	_, err := bw.w.Write(bw.buf)
+	return err
+}
+
+func (bw *bitMapRowWriter) close() error {
+	if bw.row != bw.height {
+		return fmt.Errorf("%d of the %d rows of the bitmap were written", bw.row, bw.height)
+	}
+	return nil
+}
+
+// Writes a binary PPM (P6), its rows are the rgb bytes of the image from the top down
+type ppmRowWriter struct {
+	w io.Writer
+}
+
+func newPPMRowWriter(w io.Writer) *ppmRowWriter {
+	return &ppmRowWriter{w: w}
+}
+
+func (pw *ppmRowWriter) start(width int, height int, density Density) error {
+	_, err := fmt.Fprintf(pw.w, "P6\n%d %d\n255\n", width, height)
+	return err
+}
+
+func (pw *ppmRowWriter) writeRows(img *Image) error {
+	_, err := pw.w.Write(img.pix[:img.width*img.height*3])
+	return err
+}
+
+func (pw *ppmRowWriter) close() error {
+	return nil
+}
+
+// The most bytes of the zlib stream in an IDAT chunk
+const pngChunkSize = 1 << 16
+
+// Splits the zlib stream of a PNG into IDAT chunks
+type idatWriter struct {
+	w   io.Writer
+	buf []byte
+}
+
+func (iw *idatWriter) Write(p []byte) (int, error) {
+	iw.buf = append(iw.buf, p...)
+	for len(iw.buf) >= pngChunkSize {
+		if err := writePNGChunk(iw.w, "IDAT", iw.buf[:pngChunkSize]); err != nil {
+			return 0, err
+		}
+		iw.buf = iw.buf[:copy(iw.buf, iw.buf[pngChunkSize:])]
+	}
+	return len(p), nil
+}
+
+// Writes an 8 bit RGB PNG, the rows are compressed as they come
+type pngRowWriter struct {
+	w    io.Writer
+	idat *idatWriter
+	zw   *zlib.Writer
+}
+
+func newPNGRowWriter(w io.Writer) *pngRowWriter {
+	idat := &idatWriter{w: w}
+	return &pngRowWriter{w: w, idat: idat, zw: zlib.NewWriter(idat)}
+}
+
+func (pw *pngRowWriter) start(width int, height int, density Density) error {
+	if _, err := pw.w.Write([]byte("\x89PNG\r\n\x1a\n")); err != nil {
+		return err
+	}
+	// IHDR: width, height, bit depth 8, color type 2 (RGB), no interlacing
+	ihdr := make([]byte, 13)
+	binary.BigEndian.PutUint32(ihdr[0:], uint32(width))
+	binary.BigEndian.PutUint32(ihdr[4:], uint32(height))
+	ihdr[8] = 8
+	ihdr[9] = 2
+	if err := writePNGChunk(pw.w, "IHDR", ihdr); err != nil {
+		return err
+	}
+	// pHYs: pixels per unit with the unit being the meter
+	if density.known() {
+		phys := make([]byte, 9)
+		binary.BigEndian.PutUint32(phys[0:], uint32(dotsPerMeter(density.x)))
+		binary.BigEndian.PutUint32(phys[4:], uint32(dotsPerMeter(density.y)))
+		phys[8] = 1
+		return writePNGChunk(pw.w, "pHYs", phys)
+	}
+	return nil
+}
+
+func (pw *pngRowWriter) writeRows(img *Image) error {
+	// Every row starts with the filter type, 0 means no filtering
+	stride := img.width * 3
+	for y := 0; y < img.height; y++ {
+		if _, err := pw.zw.Write([]byte{0}); err != nil {
+			return err
+		}
+		if _, err := pw.zw.Write(img.pix[y*stride : (y+1)*stride]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (pw *pngRowWriter) close() error {
+	if err := pw.zw.Close(); err != nil {
+		return err
+	}
+	if err := writePNGChunk(pw.w, "IDAT", pw.idat.buf); err != nil {
+		return err
+	}
+	return writePNGChunk(pw.w, "IEND", nil)
+}
@@ -0,0 +1,154 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Decodes data with its rows written to rows, the file of a bitmap is read back
+func decodeRows(t *testing.T, data []byte, options Options, format string) ([]byte, *Header) {
+	var out bytes.Buffer
+	var f *os.File
+	switch format {
+	case "bmp":
+		var err error
+		if f, err = os.CreateTemp(t.TempDir(), "*.bmp"); err != nil {
+			t.Fatal(err)
+		}
+		defer f.Close()
+		options.rows = newBitMapRowWriter(f)
+	case "ppm":
+		options.rows = newPPMRowWriter(&out)
+	case "png":
+		options.rows = newPNGRowWriter(&out)
+	}
+	header, err := decodeJPEGSafe(bytes.NewReader(data), "rows.jpg", &options)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if f != nil {
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := io.Copy(&out, f); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return out.Bytes(), header
+}
+
+// The streamed rows have to give the same file as the whole image, baseline images with a
+// single interleaved scan are streamed through one MCU row of blocks
+func TestRowWriters(t *testing.T) {
+	logOutput = io.Discard
+	defer func() { logOutput = os.Stdout }()
+	// A grayscale file with 2x2 sampling factors, its MCUs are still single blocks
+	names := []string{"testdata/rows/gray-22.jpg"}
+	for _, pattern := range []string{"test/*.jpg", "test/p/*.jpg", fixtureDir + "/*.jpg"} {
+		matches, err := filepath.Glob(pattern)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names = append(names, matches...)
+	}
+	for _, name := range names {
+		name := name
+		t.Run(name, func(t *testing.T) {
+			data, err := os.ReadFile(name)
+			if err != nil {
+				t.Fatal(err)
+			}
+			whole, err := decodeJPEGSafe(bytes.NewReader(data), name, &Options{})
+			if err != nil {
+				t.Fatal(err)
+			}
+			density := imageDensity(whole)
+			for _, format := range []string{"bmp", "ppm", "png"} {
+				var want bytes.Buffer
+				switch format {
+				case "bmp":
+					encodeBitMap(&want, whole.image, density)
+				case "ppm":
+					err = writeAllRows(newPPMRowWriter(&want), whole.image, density)
+				case "png":
+					err = writeAllRows(newPNGRowWriter(&want), whole.image, density)
+				}
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, header := decodeRows(t, data, Options{}, format)
+				if !bytes.Equal(got, want.Bytes()) {
+					t.Errorf("%s: the streamed rows differ from the whole image", format)
+				}
+				interleaved := whole.frameType == SOF0 && whole.scanCount == 1 &&
+					(len(whole.cComponents) > 1 || whole.cComponents[0].vSamplingFactor == 1)
+				if header.streaming != interleaved {
+					t.Errorf("%s: streaming is %v, expected %v", format, header.streaming, interleaved)
+				}
+				if header.streaming && len(header.planes[0].blocks) != header.planes[0].blocksWide*header.cComponents[0].vSamplingFactor {
+					t.Errorf("%s: the planes hold %d blocks, expected one MCU row", format, len(header.planes[0].blocks))
+				}
+			}
+		})
+	}
+}
+
+// A truncated file still gives all the rows in tolerant mode, the missing ones are gray
+func TestRowWritersTruncated(t *testing.T) {
+	logOutput = io.Discard
+	defer func() { logOutput = os.Stdout }()
+	data, err := os.ReadFile("test/cat0-q.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = data[:len(data)/2]
+	whole, err := decodeJPEGSafe(bytes.NewReader(data), "cat0-q.jpg", &Options{tolerant: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var want bytes.Buffer
+	if err := writeAllRows(newPPMRowWriter(&want), whole.image, Density{}); err != nil {
+		t.Fatal(err)
+	}
+	got, header := decodeRows(t, data, Options{tolerant: true}, "ppm")
+	if !bytes.Equal(got, want.Bytes()) {
+		t.Errorf("the streamed rows differ from the whole image")
+	}
+	if len(header.warnings) == 0 {
+		t.Errorf("expected a warning about the truncated data")
+	}
+}
+
+// The EXIF orientation and an ICC profile that can't be converted are warnings of the header
+// when the rows are streamed
+func TestRowWritersWarnings(t *testing.T) {
+	logOutput = io.Discard
+	defer func() { logOutput = os.Stdout }()
+	data, err := os.ReadFile(filepath.Join(fixtureDir, "b-420-32x32.jpg"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	// An orientation of 6 in the IFD0 of a big-endian EXIF segment
+	exif := append([]byte{}, exifIdentifier...)
+	exif = append(exif, 'M', 'M', 0, 42, 0, 0, 0, 8, 0, 1, 0x01, 0x12, 0, 3, 0, 0, 0, 1, 0, 6, 0, 0, 0, 0, 0, 0)
+	// A profile whose matrix has no inverse
+	icc := append([]byte{}, iccIdentifier...)
+	icc = append(icc, 1, 1)
+	icc = append(icc, iccProfileData([3]float64{0, 0, 0}, 0, []float64{2.2})...)
+	segments := []byte{}
+	for _, segment := range []struct {
+		marker  byte
+		payload []byte
+	}{{APP1, exif}, {APP2, icc}} {
+		segments = append(segments, 0xFF, segment.marker, byte((len(segment.payload)+2)>>8), byte(len(segment.payload)+2))
+		segments = append(segments, segment.payload...)
+	}
+	data = append(append(append([]byte{}, data[:2]...), segments...), data[2:]...)
+	_, header := decodeRows(t, data, Options{autoOrient: true, toSRGB: true}, "ppm")
+	if len(header.warnings) != 2 {
+		t.Errorf("the warnings are %q, expected the orientation and the ICC profile", header.warnings)
+	}
+}
@@ -0,0 +1,140 @@
+package main
+
+import (
+	"errors"
+	"io"
+)
+
+// Decodes a JPEG from data that is written to it in chunks as it arrives (e.g. from
+// a socket). The parser runs in its own goroutine and waits whenever it runs out of
+// data, so its state is kept across writes. Write returns once all the data written
+// so far is decoded, baseline images are filled in one MCU row at a time.
+type StreamDecoder struct {
+	header  *Header
+	input   chan []byte   // The chunks of data, nil marks the end of the data
+	need    chan struct{} // The parser used up its data
+	done    chan struct{} // The parser stopped
+	quit    chan struct{} // Closed by Close to stop the parser
+	waiting bool          // Is the parser waiting for data
+	closed  bool
+	err     error
+}
+
+// The error of a StreamDecoder that was closed before its data ended
+var errStreamClosed = errors.New("the stream decoder was closed")
+
+// Hands the chunks written to a StreamDecoder to its parser
+type chunkReader struct {
+	decoder *StreamDecoder
+	chunk   []byte
+	eof     bool
+}
+
+func (r *chunkReader) ReadByte() (byte, error) {
+	for len(r.chunk) == 0 {
+		if r.eof {
+			return 0, io.ErrUnexpectedEOF
+		}
+		// Once the decoder is closed the parser stops, even in tolerant mode
+		select {
+		case r.decoder.need <- struct{}{}:
+		case <-r.decoder.quit:
+			panic(decodeError{errStreamClosed})
+		}
+		select {
+		case r.chunk = <-r.decoder.input:
+		case <-r.decoder.quit:
+			panic(decodeError{errStreamClosed})
+		}
+		r.eof = r.chunk == nil
+	}
+	b := r.chunk[0]
+	r.chunk = r.chunk[1:]
+	return b, nil
+}
+
+func newStreamDecoder(filename string, options *Options) *StreamDecoder {
+	d := &StreamDecoder{
+		input: make(chan []byte),
+		need:  make(chan struct{}),
+		done:  make(chan struct{}),
+		quit:  make(chan struct{}),
+	}
+	d.header = newHeader(&chunkReader{decoder: d}, filename, options)
+	d.header.buffer.panics = true
+	go d.run()
+	return d
+}
+
+func (d *StreamDecoder) run() {
+	defer close(d.done)
+	defer recoverDecodeError(&d.err)
+	decodeMarkers(d.header)
+}
+
+// Waits until the parser needs more data, returns false once it stopped
+func (d *StreamDecoder) wait() bool {
+	if d.closed {
+		return false
+	}
+	if d.waiting {
+		return true
+	}
+	select {
+	case <-d.need:
+		d.waiting = true
+		return true
+	case <-d.done:
+		return false
+	}
+}
+
+// Decodes the next chunk of data, data after the end-of-image marker is ignored
+func (d *StreamDecoder) Write(p []byte) (int, error) {
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if d.wait() {
+		d.input <- p
+		d.waiting = false
+		d.wait()
+	}
+	if d.err != nil {
+		return 0, d.err
+	}
+	return len(p), nil
+}
+
+// Marks the end of the data and waits for the parser, it fails if the image is incomplete
+func (d *StreamDecoder) Flush() error {
+	if d.wait() {
+		d.input <- nil
+		d.waiting = false
+		<-d.done
+	}
+	return d.err
+}
+
+// Stops the parser and waits for it, e.g. when the connection the data came from is lost.
+// It can be called after Flush and more than once.
+func (d *StreamDecoder) Close() {
+	if !d.closed {
+		d.closed = true
+		close(d.quit)
+	}
+	<-d.done
+}
+
+// The number of rows at the top of Image that are decoded
+func (d *StreamDecoder) Rows() int {
+	return d.header.rowsAvailable
+}
+
+// The image decoded so far, nil until the first rows are decoded
+func (d *StreamDecoder) Image() *Image {
+	return d.header.image
+}
+
+func (d *StreamDecoder) Header() *Header {
+	return d.header
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"io"
+	"os"
+	"runtime"
+	"testing"
+)
+
+// A decoder that is dropped before its data ended stops its parser, also in tolerant mode
+func TestStreamDecoderClose(t *testing.T) {
+	logOutput = io.Discard
+	defer func() { logOutput = os.Stdout }()
+	data, err := os.ReadFile("test/cat0.jpg")
+	if err != nil {
+		t.Fatal(err)
+	}
+	goroutines := runtime.NumGoroutine()
+	for _, tolerant := range []bool{false, true} {
+		d := newStreamDecoder("cat0.jpg", &Options{tolerant: tolerant})
+		if _, err := d.Write(data[:len(data)/2]); err != nil {
+			t.Fatal(err)
+		}
+		d.Close()
+		d.Close()
+		if _, err := d.Write(data[len(data)/2:]); err != errStreamClosed {
+			t.Errorf("tolerant %v: Write after Close returned %v", tolerant, err)
+		}
+	}
+	d := newStreamDecoder("cat0.jpg", &Options{})
+	if _, err := d.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	d.Close()
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Errorf("%d goroutines are left, %d before", n, goroutines)
+	}
+}
@@ -0,0 +1,218 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// A lossless transform is done as a transpose followed by horizontal and vertical flips
+type Transform struct {
+	transpose bool
+	flipH     bool
+	flipV     bool
+}
+
+var transforms = map[string]Transform{
+	"flip-h":     {false, true, false},
+	"flip-v":     {false, false, true},
+	"transpose":  {true, false, false},
+	"transverse": {true, true, true},
+	"rot90":      {true, true, false},
+	"rot180":     {false, true, true},
+	"rot270":     {true, false, true},
+}
+
+// The transforms that undo each EXIF orientation
+var orientationTransforms = map[int]string{
+	2: "flip-h",
+	3: "rot180",
+	4: "flip-v",
+	5: "transpose",
+	6: "rot90",
+	7: "transverse",
+	8: "rot270",
+}
+
+// Returns the names of the transforms
+func transformNames() []string {
+	names := []string{}
+	for name := range transforms {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Returns the size of an iMCU (the pixels covered by an MCU) of the image
+func (coeffs *Coefficients) mcuSize() (int, int) {
+	return 8 * coeffs.planes[0].hSamplingFactor, 8 * coeffs.planes[0].vSamplingFactor
+}
+
+// Returns a copy of the blocks of a plane starting at block x, y
+func cropPlane(plane *CoefficientPlane, x int, y int, blocksWide int, blocksHigh int) CoefficientPlane {
+	res := *plane
+	res.blocksWide = blocksWide
+	res.blocksHigh = blocksHigh
+	res.blocks = make([][64]int, blocksWide*blocksHigh)
+	for by := 0; by < blocksHigh; by++ {
+		copy(res.blocks[by*blocksWide:(by+1)*blocksWide], plane.blocks[x+(y+by)*plane.blocksWide:])
+	}
+	return res
+}
+
+// Mirrors the coefficients of a block along the diagonal
+func transposeBlock(block *[64]int) {
+	for v := 0; v < 8; v++ {
+		for u := v + 1; u < 8; u++ {
+			block[u+v*8], block[v+u*8] = block[v+u*8], block[u+v*8]
+		}
+	}
+}
+
+// Flipping a block negates the coefficients with an odd horizontal (or vertical) frequency
+func flipBlock(block *[64]int, horizontal bool) {
+	for v := 0; v < 8; v++ {
+		for u := 0; u < 8; u++ {
+			if (horizontal && u%2 == 1) || (!horizontal && v%2 == 1) {
+				block[u+v*8] = -block[u+v*8]
+			}
+		}
+	}
+}
+
+func transposePlane(plane *CoefficientPlane) CoefficientPlane {
+	res := *plane
+	res.hSamplingFactor, res.vSamplingFactor = plane.vSamplingFactor, plane.hSamplingFactor
+	res.blocksWide, res.blocksHigh = plane.blocksHigh, plane.blocksWide
+	res.blocks = make([][64]int, len(plane.blocks))
+	for y := 0; y < res.blocksHigh; y++ {
+		for x := 0; x < res.blocksWide; x++ {
+			block := plane.blocks[y+x*plane.blocksWide]
+			transposeBlock(&block)
+			res.blocks[x+y*res.blocksWide] = block
+		}
+	}
+	return res
+}
+
+// Mirrors the first full blocks of each row (or column), the partial iMCU at the edge is left in place
+func flipPlane(plane *CoefficientPlane, full int, horizontal bool) {
+	for y := 0; y < plane.blocksHigh; y++ {
+		for x := 0; x < plane.blocksWide; x++ {
+			if (horizontal && x >= full) || (!horizontal && y >= full) {
+				continue
+			}
+			flipBlock(&plane.blocks[x+y*plane.blocksWide], horizontal)
+		}
+	}
+	for y := 0; y < plane.blocksHigh; y++ {
+		for x := 0; x < plane.blocksWide; x++ {
+			if horizontal && x < full/2 {
+				a, b := x+y*plane.blocksWide, full-1-x+y*plane.blocksWide
+				plane.blocks[a], plane.blocks[b] = plane.blocks[b], plane.blocks[a]
+			}
+			if !horizontal && y < full/2 {
+				a, b := x+y*plane.blocksWide, x+(full-1-y)*plane.blocksWide
+				plane.blocks[a], plane.blocks[b] = plane.blocks[b], plane.blocks[a]
+			}
+		}
+	}
+}
+
+// Losslessly transforms the coefficients of an image (like jpegtran).
+// Only whole iMCUs can be moved, with trim the partial iMCUs at the edges that
+// would have to move are dropped, otherwise they are kept in place untransformed.
+func transformCoefficients(coeffs *Coefficients, name string, trim bool) (*Coefficients, error) {
+	transform, ok := transforms[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown transform (%s)", name)
+	}
+	res := &Coefficients{width: coeffs.width, height: coeffs.height}
+	for t := range coeffs.qTables {
+		table := coeffs.qTables[t]
+		// The coefficients and their quantization steps are transposed together
+		if transform.transpose {
+			tmp := [64]int{}
+			for a := 0; a < 64; a++ {
+				tmp[a] = int(table.table[a])
+			}
+			transposeBlock(&tmp)
+			for a := 0; a < 64; a++ {
+				table.table[a] = uint16(tmp[a])
+			}
+		}
+		res.qTables = append(res.qTables, table)
+	}
+	for p := range coeffs.planes {
+		if transform.transpose {
+			res.planes = append(res.planes, transposePlane(&coeffs.planes[p]))
+		} else {
+			res.planes = append(res.planes, cropPlane(&coeffs.planes[p], 0, 0, coeffs.planes[p].blocksWide, coeffs.planes[p].blocksHigh))
+		}
+	}
+	if transform.transpose {
+		res.width, res.height = coeffs.height, coeffs.width
+	}
+	mcuWidth, mcuHeight := res.mcuSize()
+	// The number of whole iMCUs in a row and in a column
+	fullX := res.width / mcuWidth
+	fullY := res.height / mcuHeight
+	for p := range res.planes {
+		plane := &res.planes[p]
+		if transform.flipH {
+			flipPlane(plane, fullX*plane.hSamplingFactor, true)
+		}
+		if transform.flipV {
+			flipPlane(plane, fullY*plane.vSamplingFactor, false)
+		}
+	}
+	if !trim {
+		return res, nil
+	}
+	width, height := res.width, res.height
+	if transform.flipH {
+		width = fullX * mcuWidth
+	}
+	if transform.flipV {
+		height = fullY * mcuHeight
+	}
+	if width == 0 || height == 0 {
+		return nil, fmt.Errorf("the image is smaller than an iMCU (%dx%d), nothing is left after trimming", mcuWidth, mcuHeight)
+	}
+	return cropCoefficients(res, 0, 0, width, height), nil
+}
+
+// Returns a part of the image, x and y have to be on iMCU boundaries
+func cropCoefficients(coeffs *Coefficients, x int, y int, width int, height int) *Coefficients {
+	res := &Coefficients{width: width, height: height, qTables: coeffs.qTables}
+	mcuWidth, mcuHeight := coeffs.mcuSize()
+	mcusX := (width + mcuWidth - 1) / mcuWidth
+	mcusY := (height + mcuHeight - 1) / mcuHeight
+	for p := range coeffs.planes {
+		plane := &coeffs.planes[p]
+		res.planes = append(res.planes, cropPlane(plane,
+			x/mcuWidth*plane.hSamplingFactor, y/mcuHeight*plane.vSamplingFactor,
+			mcusX*plane.hSamplingFactor, mcusY*plane.vSamplingFactor))
+	}
+	return res
+}
+
+// Losslessly crops the image to a region. The origin is moved up and left to the
+// iMCU grid and the region is grown by the same amount, it is clipped to the image.
+func cropImage(coeffs *Coefficients, x int, y int, width int, height int) (*Coefficients, error) {
+	if x < 0 || y < 0 || width <= 0 || height <= 0 || x >= coeffs.width || y >= coeffs.height {
+		return nil, fmt.Errorf("the region %dx%d+%d+%d is outside the %dx%d image", width, height, x, y, coeffs.width, coeffs.height)
+	}
+	mcuWidth, mcuHeight := coeffs.mcuSize()
+	width += x % mcuWidth
+	height += y % mcuHeight
+	x -= x % mcuWidth
+	y -= y % mcuHeight
+	if x+width > coeffs.width {
+		width = coeffs.width - x
+	}
+	if y+height > coeffs.height {
+		height = coeffs.height - y
+	}
+	return cropCoefficients(coeffs, x, y, width, height), nil
+}
@@ -0,0 +1,188 @@
+package main
+
+// Reports a violation of the structure of the file (ITU T.81 B.2). Violations the decoder
+// can't work around always fail, the others fail in strict mode and are warnings otherwise.
+func violation(header *Header, fatal bool, format string, a ...interface{}) {
+	if fatal || header.options.strict {
+		fail(header, format, a...)
+	}
+	warn(header, format, a...)
+}
+
+// Checks the frame header (B.2.2), length is what is left of the segment after the components
+func validateFrame(header *Header, length int) {
+	if header.planes != nil {
+		violation(header, true, "SOF: more than one frame")
+	}
+	if header.height == 0 {
+		violation(header, true, "SOF: the number of lines is 0, defining it with a DNL marker is not supported")
+	}
+	if header.width == 0 {
+		violation(header, true, "SOF: the number of samples per line is 0")
+	}
+	if len(header.cComponents) != 1 && len(header.cComponents) != 3 {
+		violation(header, true, "SOF: %d components, only 1 or 3 are supported", len(header.cComponents))
+	}
+	if length != 0 {
+		violation(header, false, "SOF: the segment length is off by %d bytes", -length)
+	}
+	blocks := 0
+	for c := range header.cComponents {
+		comp := &header.cComponents[c]
+		if comp.hSamplingFactor < 1 || comp.hSamplingFactor > 4 || comp.vSamplingFactor < 1 || comp.vSamplingFactor > 4 {
+			violation(header, true, "SOF: component %d has sampling factors %dx%d, they have to be 1-4",
+				comp.Id, comp.hSamplingFactor, comp.vSamplingFactor)
+		}
+		if comp.qTableId > 3 {
+			violation(header, true, "SOF: component %d uses quantization table %d, the ids are 0-3", comp.Id, comp.qTableId)
+		}
+		blocks += comp.hSamplingFactor * comp.vSamplingFactor
+	}
+	if len(header.cComponents) > 1 && blocks > 10 {
+		violation(header, true, "SOF: an MCU has %d blocks, at most 10 are allowed", blocks)
+	}
+	// The blocks are stored on the grid of the first component, the others are subsampled 1x1
+	for c := range header.cComponents {
+		comp := &header.cComponents[c]
+		if (c == 0 && (comp.hSamplingFactor > 2 || comp.vSamplingFactor > 2)) ||
+			(c > 0 && (comp.hSamplingFactor != 1 || comp.vSamplingFactor != 1)) {
+			violation(header, true, "SOF: the sampling factors %dx%d of component %d are not supported",
+				comp.hSamplingFactor, comp.vSamplingFactor, comp.Id)
+		}
+	}
+}
+
+// Checks a quantization table (B.2.4.1)
+func validateQuantizationTable(header *Header, precision byte, table *[64]uint16) {
+	if precision > 1 {
+		violation(header, true, "DQT: invalid precision (%d)", precision)
+	}
+	if precision == 1 {
+		violation(header, false, "DQT: 16 bit tables are not allowed with 8 bit samples")
+	}
+	for a := 0; a < 64; a++ {
+		if table[a] == 0 {
+			violation(header, false, "DQT: a quantization step is 0")
+			return
+		}
+	}
+}
+
+// Checks a Huffman table (B.2.4.2 and C), class is Tc and the table is not read yet past the code counts
+func validateHuffmanTable(header *Header, class byte, table *HuffmanTable) {
+	if class > 1 {
+		violation(header, false, "DHT: invalid table class (%d)", class)
+	}
+	if table.Id > 3 {
+		violation(header, true, "DHT: invalid table id (%d), the ids are 0-3", table.Id)
+	}
+	if table.Id > 1 && header.frameType == SOF0 {
+		violation(header, false, "DHT: baseline files only have tables 0 and 1, not %d", table.Id)
+	}
+	count := 0
+	// The codes of each length are counted up from the codes of the shorter lengths (Figure C.2),
+	// there are 2^length codes of a length and the all-ones code is reserved
+	code := 0
+	allOnes := false
+	for a := 0; a < 16; a++ {
+		count += table.codesOfLen[a]
+		code += table.codesOfLen[a]
+		if code > 1<<(a+1) {
+			violation(header, true, "DHT: the %d codes of length %d don't fit in the code space", table.codesOfLen[a], a+1)
+		}
+		if code == 1<<(a+1) && table.codesOfLen[a] > 0 {
+			allOnes = true
+		}
+		code <<= 1
+	}
+	if count > 256 {
+		violation(header, true, "DHT: table %d has %d symbols, at most 256 are allowed", table.Id, count)
+	}
+	if allOnes {
+		violation(header, false, "DHT: table %d uses an all-ones code", table.Id)
+	}
+}
+
+// Checks the symbols of a Huffman table once they are read
+func validateHuffmanSymbols(header *Header, table *HuffmanTable) {
+	for _, sym := range table.symbols {
+		if table.dc && sym > 11 {
+			violation(header, false, "DHT: DC table %d has the symbol %d, the largest DC difference has 11 bits", table.Id, sym)
+			return
+		}
+		if !table.dc && sym&0x0F > 10 {
+			violation(header, false, "DHT: AC table %d has the symbol 0x%02X, the largest AC coefficient has 10 bits", table.Id, sym)
+			return
+		}
+	}
+}
+
+// Checks a scan header (B.2.3), ids are the component ids of the scan in order
+func validateScan(header *Header, ids []int, length int) {
+	if header.planes == nil {
+		violation(header, true, "SOS: a scan before the frame header")
+	}
+	if len(ids) < 1 || len(ids) > 4 {
+		violation(header, true, "SOS: %d components, a scan has 1-4", len(ids))
+	}
+	if length != 0 {
+		violation(header, false, "SOS: the segment length is off by %d bytes", -length)
+	}
+	// The components of a scan are in the order of the frame
+	next := 0
+	for _, id := range ids {
+		found := false
+		for c := next; c < len(header.cComponents); c++ {
+			if header.cComponents[c].Id == id {
+				found = true
+				next = c + 1
+			}
+		}
+		if !found {
+			violation(header, false, "SOS: component %d is not in the frame, used twice or out of order", id)
+		}
+	}
+	ss, se := int(header.startOfSelection), int(header.endOfSelection)
+	ah, al := int(header.successiveApproximationHigh), int(header.successiveApproximationLow)
+	if header.frameType == SOF0 && (ss != 0 || se != 63 || ah != 0 || al != 0) {
+		violation(header, false, "SOS: a sequential scan has Ss=0, Se=63, Ah=0 and Al=0, not %d, %d, %d, %d", ss, se, ah, al)
+	}
+	if header.frameType == SOF2 {
+		if ss > se || se > 63 {
+			violation(header, true, "SOS: invalid spectral selection %d-%d", ss, se)
+		}
+		if ss == 0 && se != 0 {
+			violation(header, false, "SOS: a DC scan ends at %d, it has to end at 0", se)
+		}
+		if ss > 0 && len(ids) != 1 {
+			violation(header, false, "SOS: an AC scan has %d components, it has to have 1", len(ids))
+		}
+		if ah > 13 || al > 13 {
+			violation(header, false, "SOS: invalid successive approximation %d, %d", ah, al)
+		}
+		if ah != 0 && al != ah-1 {
+			violation(header, false, "SOS: a refinement scan has Al=%d, it has to be Ah-1=%d", al, ah-1)
+		}
+	}
+	for c := range header.cComponents {
+		comp := &header.cComponents[c]
+		if !comp.usedInScan {
+			continue
+		}
+		if header.frameType == SOF0 && (comp.dcHuffmanTableId > 1 || comp.acHuffmanTableId > 1) {
+			violation(header, false, "SOS: baseline files only have tables 0 and 1, component %d uses %d and %d",
+				comp.Id, comp.dcHuffmanTableId, comp.acHuffmanTableId)
+		}
+		// Sequential scans always code both, DC refinement scans don't code symbols
+		sequential := header.frameType == SOF0
+		if (sequential || (ss == 0 && ah == 0)) && getTable(header, true, comp.dcHuffmanTableId) == nil {
+			violation(header, true, "SOS: component %d uses DC table %d, which is not defined", comp.Id, comp.dcHuffmanTableId)
+		}
+		if (sequential || se > 0) && getTable(header, false, comp.acHuffmanTableId) == nil {
+			violation(header, true, "SOS: component %d uses AC table %d, which is not defined", comp.Id, comp.acHuffmanTableId)
+		}
+		if getQuantizationTable(header, c) == nil {
+			violation(header, true, "SOS: component %d uses quantization table %d, which is not defined", comp.Id, comp.qTableId)
+		}
+	}
+}
@@ -1,136 +0,0 @@
-package zmap
-
-var Map1 = map[int]int{
-	0:  0,
-	1:  1,
-	2:  8,
-	3:  16,
-	4:  9,
-	5:  2,
-	6:  3,
-	7:  10,
-	8:  17,
-	9:  24,
-	10: 32,
-	11: 25,
-	12: 18,
-	13: 11,
-	14: 4,
-	15: 5,
-	16: 12,
-	17: 19,
-	18: 26,
-	19: 33,
-	20: 40,
-	21: 48,
-	22: 41,
-	23: 34,
-	24: 27,
-	25: 20,
-	26: 13,
-	27: 6,
-	28: 7,
-	29: 14,
-	30: 21,
-	31: 28,
-	32: 35,
-	33: 42,
-	34: 49,
-	35: 56,
-	36: 57,
-	37: 50,
-	38: 43,
-	39: 36,
-	40: 29,
-	41: 22,
-	42: 15,
-	43: 23,
-	44: 30,
-	45: 37,
-	46: 44,
-	47: 51,
-	48: 58,
-	49: 59,
-	50: 52,
-	51: 45,
-	52: 38,
-	53: 31,
-	54: 39,
-	55: 46,
-	56: 53,
-	57: 60,
-	58: 61,
-	59: 54,
-	60: 47,
-	61: 55,
-	62: 62,
-	63: 63,
-}
-
-// For the right half just add 8
-var Map2 = map[int]int{
-	0:  0,
-	1:  1,
-	2:  16,
-	3:  32,
-	4:  17,
-	5:  2,
-	6:  3,
-	7:  18,
-	8:  33,
-	9:  48,
-	10: 64,
-	11: 49,
-	12: 34,
-	13: 19,
-	14: 4,
-	15: 5,
-	16: 20,
-	17: 35,
-	18: 50,
-	19: 65,
-	20: 80,
-	21: 96,
-	22: 81,
-	23: 66,
-	24: 51,
-	25: 36,
-	26: 21,
-	27: 6,
-	28: 7,
-	29: 22,
-	30: 37,
-	31: 52,
-	32: 67,
-	33: 82,
-	34: 97,
-	35: 112,
-	36: 113,
-	37: 98,
-	38: 83,
-	39: 68,
-	40: 53,
-	41: 38,
-	42: 23,
-	43: 39,
-	44: 54,
-	45: 69,
-	46: 84,
-	47: 99,
-	48: 114,
-	49: 115,
-	50: 100,
-	51: 85,
-	52: 70,
-	53: 55,
-	54: 71,
-	55: 86,
-	56: 101,
-	57: 116,
-	58: 117,
-	59: 102,
-	60: 87,
-	61: 103,
-	62: 118,
-	63: 119,
-}